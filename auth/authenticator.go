@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"errors"
+	"log"
+
+	"authgo/data"
+	"authgo/models"
+)
+
+// Authenticator verifies a username and password. Implementations return
+// data.ErrInvalidCredentials when they do not accept the credentials.
+// *data.UserService is the Authenticator for local passwords.
+type Authenticator interface {
+	Authenticate(username, password string) (models.User, error)
+}
+
+// Chain tries each Authenticator in order and returns the user of the first
+// that accepts the credentials. A backend failing with an internal error,
+// such as an unreachable directory, is logged and skipped so that the
+// remaining backends still work. A disabled account ends the chain.
+type Chain []Authenticator
+
+// Authenticate implements Authenticator
+func (ch Chain) Authenticate(username, password string) (models.User, error) {
+	var failure error
+	for _, a := range ch {
+		u, err := a.Authenticate(username, password)
+		if err == nil || errors.Is(err, data.ErrUserDisabled) {
+			return u, err
+		}
+		if !errors.Is(err, data.ErrInvalidCredentials) {
+			log.Printf("authentication backend failed for %s: %v", username, err)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	if failure != nil {
+		return models.User{}, failure
+	}
+	return models.User{}, data.ErrInvalidCredentials
+}
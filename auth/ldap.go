@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapProvider is the provider name of identities linked by LDAPAuthenticator
+const ldapProvider = "ldap"
+
+// LDAPConfig configures an LDAP or Active Directory server. Users are either
+// bound directly with a DN built from UserDNTemplate, or looked up below
+// BaseDN with UserFilter, bound as BindDN, and then bound as the entry found.
+type LDAPConfig struct {
+	// URL is the server address, ldap://host:389 or ldaps://host:636
+	URL string
+	// StartTLS upgrades an ldap:// connection before any credentials are sent
+	StartTLS bool
+	// TLS is used for ldaps:// and StartTLS; nil uses the system roots
+	TLS *tls.Config
+	// BindDN and BindPassword are the service account used for searches
+	BindDN       string
+	BindPassword string
+	// UserDNTemplate is a DN with one %s for the username, such as
+	// "uid=%s,ou=people,dc=example,dc=org"
+	UserDNTemplate string
+	// BaseDN and UserFilter locate users when UserDNTemplate is empty; the
+	// filter has one %s for the username, such as "(sAMAccountName=%s)"
+	BaseDN     string
+	UserFilter string
+	// GroupAttribute lists the groups of a user entry, "memberOf" by default
+	GroupAttribute string
+	// GroupBaseDN and GroupFilter additionally search for groups; the filter
+	// has one %s for the user DN, such as "(member=%s)"
+	GroupBaseDN string
+	GroupFilter string
+	// GroupRoles maps groups, by DN or common name, to roles. When set, the
+	// roles are synced from the groups on every login.
+	GroupRoles map[string]string
+	// DefaultRole is given to users in none of the mapped groups, "user" by default
+	DefaultRole string
+	// Timeout bounds connecting and each request
+	Timeout time.Duration
+}
+
+// LDAPAuthenticator checks passwords by binding to an LDAP server. Users are
+// provisioned on their first login and linked to their directory entry.
+type LDAPAuthenticator struct {
+	cfg   LDAPConfig
+	users *data.UserService
+}
+
+// NewLDAPAuthenticator constructs an LDAPAuthenticator, filling in defaults
+func NewLDAPAuthenticator(cfg LDAPConfig, us *data.UserService) (*LDAPAuthenticator, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("ldap url is required")
+	}
+	if cfg.UserDNTemplate == "" && (cfg.BaseDN == "" || cfg.UserFilter == "") {
+		return nil, errors.New("ldap user dn template, or base dn and user filter, are required")
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = "user"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	roles := make(map[string]string, len(cfg.GroupRoles))
+	for group, role := range cfg.GroupRoles {
+		roles[normalizeDN(group)] = role
+	}
+	cfg.GroupRoles = roles
+	return &LDAPAuthenticator{cfg: cfg, users: us}, nil
+}
+
+// Authenticate implements Authenticator
+func (a *LDAPAuthenticator) Authenticate(username, password string) (models.User, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return models.User{}, data.ErrInvalidCredentials
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return models.User{}, err
+	}
+	defer conn.Close()
+
+	dn, groups, err := a.bindUser(conn, username, password)
+	if err != nil {
+		return models.User{}, err
+	}
+	more, err := a.searchGroups(conn, dn)
+	if err != nil {
+		return models.User{}, err
+	}
+	groups = append(groups, more...)
+	u, err := a.linkUser(username, dn, groups)
+	if err != nil {
+		return models.User{}, err
+	}
+	if u.Disabled {
+		return models.User{}, data.ErrUserDisabled
+	}
+	return u, nil
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.cfg.Timeout}),
+		ldap.DialWithTLSConfig(a.cfg.TLS),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.cfg.Timeout)
+	if a.cfg.StartTLS {
+		tc := a.cfg.TLS
+		if tc == nil {
+			host, _, _ := net.SplitHostPort(strings.TrimPrefix(a.cfg.URL, "ldap://"))
+			tc = &tls.Config{ServerName: host}
+		}
+		if err := conn.StartTLS(tc); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// bindUser binds as the user and returns the user's DN and the groups listed
+// on the entry
+func (a *LDAPAuthenticator) bindUser(conn *ldap.Conn, username, password string) (string, []string, error) {
+	var dn string
+	if a.cfg.UserDNTemplate != "" {
+		dn = fmt.Sprintf(a.cfg.UserDNTemplate, ldap.EscapeDN(username))
+	} else {
+		if a.cfg.BindDN != "" {
+			if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+				return "", nil, fmt.Errorf("service bind: %w", err)
+			}
+		}
+		res, err := conn.Search(ldap.NewSearchRequest(
+			a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+			fmt.Sprintf(a.cfg.UserFilter, ldap.EscapeFilter(username)),
+			[]string{"dn"}, nil,
+		))
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return "", nil, fmt.Errorf("user search: %w", err)
+		}
+		// the filter must identify exactly one user
+		if res == nil || len(res.Entries) != 1 {
+			return "", nil, data.ErrInvalidCredentials
+		}
+		dn = res.Entries[0].DN
+	}
+
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", nil, data.ErrInvalidCredentials
+		}
+		return "", nil, err
+	}
+
+	// read the entry as the user, who can usually see their own groups
+	res, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", []string{a.cfg.GroupAttribute}, nil,
+	))
+	if err != nil || len(res.Entries) != 1 {
+		if err == nil || ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", nil, data.ErrInvalidCredentials
+		}
+		return "", nil, fmt.Errorf("user entry: %w", err)
+	}
+	return res.Entries[0].DN, res.Entries[0].GetAttributeValues(a.cfg.GroupAttribute), nil
+}
+
+// searchGroups returns the DNs of the groups found by GroupFilter
+func (a *LDAPAuthenticator) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	if a.cfg.GroupBaseDN == "" || a.cfg.GroupFilter == "" {
+		return nil, nil
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.cfg.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("group search: %w", err)
+	}
+	groups := make([]string, 0, len(res.Entries))
+	for _, e := range res.Entries {
+		groups = append(groups, e.DN)
+	}
+	return groups, nil
+}
+
+// linkUser returns the local user linked to the directory entry, creating it
+// on first login and syncing its roles from the groups
+func (a *LDAPAuthenticator) linkUser(username, dn string, groups []string) (models.User, error) {
+	roles := models.RolesForGroups(groupNames(groups), a.cfg.GroupRoles, a.cfg.DefaultRole)
+	subject := normalizeDN(dn)
+
+	u, err := a.users.FindByIdentity(a.cfg.URL, subject)
+	if err != nil {
+		return models.User{}, err
+	}
+	if u.Username == "" {
+		u, err = a.users.CreateFederatedUser(username, roles, models.FederatedIdentity{
+			Provider: ldapProvider,
+			Issuer:   a.cfg.URL,
+			Subject:  subject,
+		})
+		if errors.Is(err, data.ErrUsernameTaken) {
+			// never sign in to a local account that happens to share the name
+			log.Printf("ldap user %s not linked: username belongs to another account", username)
+			return models.User{}, data.ErrInvalidCredentials
+		}
+		return u, err
+	}
+	if len(a.cfg.GroupRoles) > 0 && !models.SameRoles(u.Roles, roles) {
+		updated, err := a.users.SetRoles(u.ID, roles)
+		if errors.Is(err, data.ErrLastAdmin) {
+			// the directory cannot lock everyone out of administration
+			log.Printf("ldap user %s keeps the admin role: no other admin remains", u.Username)
+			updated, err = a.users.SetRoles(u.ID, append(roles, models.RoleAdmin))
+		}
+		if err != nil {
+			return models.User{}, err
+		}
+		if updated.Username == "" {
+			return models.User{}, data.ErrInvalidCredentials
+		}
+		u = updated
+	}
+	return u, nil
+}
+
+// groupNames returns each group DN followed by its common name, normalized,
+// so that GroupRoles may name groups either way
+func groupNames(dns []string) []string {
+	names := make([]string, 0, 2*len(dns))
+	for _, dn := range dns {
+		names = append(names, normalizeDN(dn))
+		parsed, err := ldap.ParseDN(dn)
+		if err == nil && len(parsed.RDNs) > 0 && len(parsed.RDNs[0].Attributes) > 0 {
+			names = append(names, strings.ToLower(parsed.RDNs[0].Attributes[0].Value))
+		}
+	}
+	return names
+}
+
+// normalizeDN returns dn in the canonical form used for comparisons; DNs
+// compare case-insensitively. Values that are not DNs are only lowercased.
+func normalizeDN(dn string) string {
+	if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 {
+		return strings.ToLower(parsed.String())
+	}
+	return strings.ToLower(dn)
+}
@@ -0,0 +1,245 @@
+package auth_test
+
+import (
+	"errors"
+	"testing"
+
+	"authgo/auth"
+	"authgo/auth/ldaptest"
+	"authgo/data"
+	"authgo/data/datatest"
+	"authgo/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var directory = []ldaptest.Entry{
+	{DN: "cn=reader,dc=example,dc=org", Password: "reader-secret"},
+	{
+		DN:       "uid=alice,ou=people,dc=example,dc=org",
+		Password: "alice-secret",
+		Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"alice"},
+			"memberOf":    {"cn=Admins,ou=groups,dc=example,dc=org"},
+		},
+	},
+	{
+		DN:       "uid=bob,ou=people,dc=example,dc=org",
+		Password: "bob-secret",
+		Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"bob"},
+		},
+	},
+	{
+		DN: "cn=staff,ou=groups,dc=example,dc=org",
+		Attributes: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"member":      {"uid=bob,ou=people,dc=example,dc=org"},
+		},
+	},
+}
+
+func newDirectory(t *testing.T) *ldaptest.Server {
+	t.Helper()
+	srv, err := ldaptest.NewServer(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newLDAPAuthenticator(t *testing.T, cfg auth.LDAPConfig, us *data.UserService) *auth.LDAPAuthenticator {
+	t.Helper()
+	a, err := auth.NewLDAPAuthenticator(cfg, us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestLDAPProvisionsAndLinksUsers(t *testing.T) {
+	srv := newDirectory(t)
+	us := datatest.UserService(datatest.Database(t))
+	a := newLDAPAuthenticator(t, auth.LDAPConfig{
+		URL:            srv.URL,
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+		GroupRoles:     map[string]string{"admins": models.RoleAdmin},
+	}, us)
+
+	u, err := a.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !models.SameRoles(u.Roles, []string{models.RoleAdmin}) {
+		t.Errorf("roles = %v, want admin from the Admins group", u.Roles)
+	}
+	if len(u.Identities) != 1 || u.Identities[0].Issuer != srv.URL || u.Identities[0].Subject != "uid=alice,ou=people,dc=example,dc=org" {
+		t.Errorf("identities = %+v, want the directory entry", u.Identities)
+	}
+
+	again, err := a.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if again.ID != u.ID {
+		t.Errorf("second login signed in to %s, want the linked user %s", again.ID.Hex(), u.ID.Hex())
+	}
+
+	bob, err := a.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !models.SameRoles(bob.Roles, []string{models.RoleUser}) {
+		t.Errorf("roles = %v, want the default role", bob.Roles)
+	}
+}
+
+func TestLDAPSyncsRolesFromGroups(t *testing.T) {
+	srv := newDirectory(t)
+	us := datatest.UserService(datatest.Database(t))
+	// an admin outside the directory, so that alice's admin role may go
+	if _, err := us.CreateUser("root", "root-password", ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg := auth.LDAPConfig{
+		URL:            srv.URL,
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+		GroupRoles:     map[string]string{"cn=admins,ou=groups,dc=example,dc=org": models.RoleAdmin},
+	}
+	u, err := newLDAPAuthenticator(t, cfg, us).Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !u.HasRole(models.RoleAdmin) {
+		t.Fatalf("roles = %v, want admin mapped by group DN", u.Roles)
+	}
+
+	cfg.GroupRoles = map[string]string{"staff": models.RoleAdmin}
+	u, err = newLDAPAuthenticator(t, cfg, us).Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !models.SameRoles(u.Roles, []string{models.RoleUser}) {
+		t.Errorf("roles = %v, want admin taken away once the group no longer maps to it", u.Roles)
+	}
+}
+
+func TestLDAPRoleSyncKeepsLastAdmin(t *testing.T) {
+	srv := newDirectory(t)
+	us := datatest.UserService(datatest.Database(t))
+	cfg := auth.LDAPConfig{
+		URL:            srv.URL,
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+		GroupRoles:     map[string]string{"admins": models.RoleAdmin},
+	}
+	if _, err := newLDAPAuthenticator(t, cfg, us).Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+
+	cfg.GroupRoles = map[string]string{"staff": models.RoleAdmin}
+	u, err := newLDAPAuthenticator(t, cfg, us).Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !u.HasRole(models.RoleAdmin) {
+		t.Errorf("roles = %v, want the last admin to keep admin", u.Roles)
+	}
+}
+
+func TestLDAPSearchWithStartTLS(t *testing.T) {
+	srv := newDirectory(t)
+	us := datatest.UserService(datatest.Database(t))
+	a := newLDAPAuthenticator(t, auth.LDAPConfig{
+		URL:          srv.URL,
+		StartTLS:     true,
+		TLS:          srv.ClientTLS(),
+		BindDN:       "cn=reader,dc=example,dc=org",
+		BindPassword: "reader-secret",
+		BaseDN:       "ou=people,dc=example,dc=org",
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+		GroupBaseDN:  "ou=groups,dc=example,dc=org",
+		GroupFilter:  "(member=%s)",
+		GroupRoles:   map[string]string{"staff": "staff"},
+		DefaultRole:  models.RoleUser,
+	}, us)
+
+	u, err := a.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !models.SameRoles(u.Roles, []string{"staff"}) {
+		t.Errorf("roles = %v, want staff from the group search", u.Roles)
+	}
+}
+
+func TestLDAPRejectsInvalidCredentials(t *testing.T) {
+	srv := newDirectory(t)
+	us := datatest.UserService(datatest.Database(t))
+	a := newLDAPAuthenticator(t, auth.LDAPConfig{
+		URL:          srv.URL,
+		BindDN:       "cn=reader,dc=example,dc=org",
+		BindPassword: "reader-secret",
+		BaseDN:       "ou=people,dc=example,dc=org",
+		UserFilter:   "(uid=%s)",
+	}, us)
+
+	for _, tc := range []struct{ name, username, password string }{
+		{"wrong password", "alice", "wrong"},
+		{"empty password", "alice", ""},
+		{"unknown user", "mallory", "alice-secret"},
+		{"filter injection", "*", "alice-secret"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := a.Authenticate(tc.username, tc.password); !errors.Is(err, data.ErrInvalidCredentials) {
+				t.Errorf("err = %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+	if n, err := us.CountWithRole(models.RoleUser); err != nil || n != 0 {
+		t.Errorf("%d users provisioned by rejected logins, err %v", n, err)
+	}
+}
+
+func TestLDAPDoesNotLinkLocalAccounts(t *testing.T) {
+	srv := newDirectory(t)
+	us := datatest.UserService(datatest.Database(t))
+	local, err := us.CreateUser("alice", "local-password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldapAuth := newLDAPAuthenticator(t, auth.LDAPConfig{
+		URL:            srv.URL,
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+	}, us)
+	if _, err := ldapAuth.Authenticate("alice", "alice-secret"); !errors.Is(err, data.ErrInvalidCredentials) {
+		t.Fatalf("err = %v, want ErrInvalidCredentials for a name taken locally", err)
+	}
+
+	// the chain still reaches the local account with its own password
+	u, err := auth.Chain{ldapAuth, us}.Authenticate("alice", "local-password")
+	if err != nil {
+		t.Fatalf("local login through the chain: %v", err)
+	}
+	if u.ID != local.ID || len(u.Identities) != 0 {
+		t.Errorf("signed in to %s with identities %v, want the unlinked local user", u.ID.Hex(), u.Identities)
+	}
+}
+
+func TestLDAPUnreachableServer(t *testing.T) {
+	us := datatest.UserService(datatest.Database(t))
+	srv := newDirectory(t)
+	url := srv.URL
+	srv.Close()
+	a := newLDAPAuthenticator(t, auth.LDAPConfig{URL: url, UserDNTemplate: "uid=%s,dc=example,dc=org"}, us)
+	_, err := a.Authenticate("alice", "alice-secret")
+	if err == nil || errors.Is(err, data.ErrInvalidCredentials) {
+		t.Fatalf("err = %v, want a connection error", err)
+	}
+	var lerr *ldap.Error
+	if !errors.As(err, &lerr) {
+		t.Errorf("err = %T, want *ldap.Error", err)
+	}
+}
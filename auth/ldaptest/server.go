@@ -0,0 +1,355 @@
+// Package ldaptest provides an in-process LDAP server for exercising the LDAP
+// authenticator, in the spirit of net/http/httptest. It implements simple
+// bind, search with and/or/not/equality/presence filters, and StartTLS; it is
+// not meant for anything but tests and local development.
+package ldaptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Entry is a directory entry. Password is checked by simple binds to DN; an
+// entry without a password cannot bind.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is an LDAP server listening on a loopback address
+type Server struct {
+	// URL is the ldap:// address of the server
+	URL string
+
+	listener net.Listener
+	entries  []Entry
+	tls      *tls.Config
+	pool     *x509.CertPool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server serving entries
+func NewServer(entries []Entry) (*Server, error) {
+	cert, pool, err := selfSigned()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		URL:      "ldap://" + l.Addr().String(),
+		listener: l,
+		entries:  entries,
+		tls:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		pool:     pool,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// ClientTLS returns a TLS configuration trusting the server's certificate,
+// for use with StartTLS
+func (s *Server) ClientTLS() *tls.Config {
+	return &tls.Config{RootCAs: s.pool, ServerName: "127.0.0.1"}
+}
+
+// Close stops the server and waits for open connections to finish
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle serves one connection until the client unbinds or disconnects
+func (s *Server) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+		p, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if s.bind(op) {
+				code = ldap.LDAPResultSuccess
+			}
+			writeResult(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			code := s.search(conn, id, op)
+			writeResult(conn, id, ldap.ApplicationSearchResultDone, code)
+		case ldap.ApplicationExtendedRequest:
+			if len(op.Children) == 0 || string(op.Children[0].Data.Bytes()) != startTLSOID {
+				writeResult(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError)
+				continue
+			}
+			if _, ok := conn.(*tls.Conn); ok {
+				writeResult(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultOperationsError)
+				continue
+			}
+			writeResult(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess)
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn = tc
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			// other operations are not supported
+			return
+		}
+	}
+}
+
+// bind checks a simple bind. An empty password is an anonymous bind, which
+// succeeds without identifying anyone, as on real servers.
+func (s *Server) bind(op *ber.Packet) bool {
+	if len(op.Children) < 3 || op.Children[2].Tag != 0 {
+		return false
+	}
+	name, _ := op.Children[1].Value.(string)
+	password := string(op.Children[2].Data.Bytes())
+	if password == "" {
+		return true
+	}
+	e := s.find(name)
+	return e != nil && e.Password != "" && e.Password == password
+}
+
+// search writes the entries matching the request and returns the result
+// code. Entries are visible to anyone, including anonymous clients.
+func (s *Server) search(w io.Writer, id int64, op *ber.Packet) uint16 {
+	if len(op.Children) < 8 {
+		return ldap.LDAPResultProtocolError
+	}
+	base := normalize(stringValue(op.Children[0]))
+	scope, _ := op.Children[1].Value.(int64)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		attrs = append(attrs, stringValue(a))
+	}
+
+	if scope == ldap.ScopeBaseObject && s.find(base) == nil {
+		return ldap.LDAPResultNoSuchObject
+	}
+	sent := 0
+	for i := range s.entries {
+		e := &s.entries[i]
+		dn := normalize(e.DN)
+		switch scope {
+		case ldap.ScopeBaseObject:
+			if dn != base {
+				continue
+			}
+		case ldap.ScopeSingleLevel:
+			if _, parent, _ := strings.Cut(dn, ","); parent != base {
+				continue
+			}
+		default:
+			if dn != base && !strings.HasSuffix(dn, ","+base) {
+				continue
+			}
+		}
+		if !matches(e, filter) {
+			continue
+		}
+		if sizeLimit > 0 && int64(sent) == sizeLimit {
+			return ldap.LDAPResultSizeLimitExceeded
+		}
+		writeEntry(w, id, e, attrs)
+		sent++
+	}
+	return ldap.LDAPResultSuccess
+}
+
+func (s *Server) find(dn string) *Entry {
+	dn = normalize(dn)
+	for i := range s.entries {
+		if normalize(s.entries[i].DN) == dn {
+			return &s.entries[i]
+		}
+	}
+	return nil
+}
+
+// matches evaluates the subset of RFC 4511 filters used by the authenticator
+func matches(e *Entry, f *ber.Packet) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matches(e, c) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if matches(e, c) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(f.Children) == 1 && !matches(e, f.Children[0])
+	case ldap.FilterEqualityMatch:
+		if len(f.Children) != 2 {
+			return false
+		}
+		attr, value := stringValue(f.Children[0]), stringValue(f.Children[1])
+		for _, v := range values(e, attr) {
+			if strings.EqualFold(v, value) || (strings.Contains(v, "=") && normalize(v) == normalize(value)) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		attr := string(f.Data.Bytes())
+		return strings.EqualFold(attr, "objectClass") || len(values(e, attr)) > 0
+	}
+	return false
+}
+
+// values returns the values of attr, matched case-insensitively
+func values(e *Entry, attr string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+func writeEntry(w io.Writer, id int64, e *Entry, attrs []string) {
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "Object Name"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for k, vs := range e.Attributes {
+		if !wanted(k, attrs) {
+			continue
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range vs {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	entry.AppendChild(list)
+	write(w, id, entry)
+}
+
+// wanted reports whether attr was requested; no attributes, or "*", means all
+func wanted(attr string, attrs []string) bool {
+	if len(attrs) == 0 {
+		return true
+	}
+	for _, a := range attrs {
+		if a == "*" || strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeResult(w io.Writer, id int64, tag ber.Tag, code uint16) {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	write(w, id, res)
+}
+
+func write(w io.Writer, id int64, op *ber.Packet) {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	msg.AppendChild(op)
+	_, _ = w.Write(msg.Bytes())
+}
+
+func stringValue(p *ber.Packet) string {
+	if s, ok := p.Value.(string); ok {
+		return s
+	}
+	return string(p.Data.Bytes())
+}
+
+func normalize(dn string) string {
+	if parsed, err := ldap.ParseDN(dn); err == nil {
+		return strings.ToLower(parsed.String())
+	}
+	return strings.ToLower(dn)
+}
+
+// selfSigned creates a certificate for 127.0.0.1 and a pool trusting it
+func selfSigned() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldaptest"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool, nil
+}
@@ -0,0 +1,376 @@
+// Package auth resolves bearer credentials to the account or client they were
+// issued for, checking revocation and the current account state
+package auth
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"authgo/cache"
+	"authgo/data"
+	"authgo/models"
+	"authgo/tokens"
+)
+
+// userCacheTTL bounds how long a cached account state is trusted
+const userCacheTTL = 30 * time.Second
+
+// Authentication methods reported in Principal.Method
+const (
+	MethodJWT               = "jwt"
+	MethodOAuth             = "oauth"
+	MethodClientCredentials = "client_credentials"
+	MethodAPIKey            = "api_key"
+	MethodSession           = "session"
+)
+
+// Browser session cookies and the header carrying the CSRF token, which must
+// repeat the value of CSRFCookie on state-changing requests
+const (
+	SessionCookie = "goauth_session"
+	CSRFCookie    = "goauth_csrf"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+var (
+	// ErrInvalidToken is returned for tokens that fail signature or type checks
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrInvalidPayload is returned for tokens missing required claims
+	ErrInvalidPayload = errors.New("invalid token payload")
+	// ErrRevoked is returned for revoked tokens and tokens of deleted users or
+	// OAuth clients
+	ErrRevoked = errors.New("token has been revoked")
+	// ErrAccountDisabled is returned when the user's account is disabled
+	ErrAccountDisabled = errors.New("account disabled")
+	// ErrOutdated is returned when the user's roles changed since the token was issued
+	ErrOutdated = errors.New("token is outdated")
+	// ErrInvalidAPIKey is returned for unknown or expired API keys and keys of deleted users
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrInvalidSession is returned for unknown, expired or ended browser sessions
+	ErrInvalidSession = errors.New("invalid session")
+)
+
+// Principal is the result of validating a credential
+type Principal struct {
+	// User is the current account state; zero for client credentials tokens
+	User models.User
+	// ClientID is set for tokens issued through the OAuth endpoints
+	ClientID string
+	// Scopes limits what the credential may access. It is ignored for
+	// first-party sessions (MethodJWT), which are not restricted.
+	Scopes []string
+	Method string
+	// JTI, IssuedAt and ExpiresAt describe JWTs
+	JTI       string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// APIKey is set when Method is MethodAPIKey
+	APIKey models.APIKey
+	// Session is the login the credential belongs to, for browser sessions
+	// and tokens from a tracked first-party login
+	Session models.Session
+	// Permissions are granted by the user's roles, or for client credentials
+	// by the scopes in models.ClientCredentialsScopes
+	Permissions []string
+}
+
+// Validator verifies access tokens, API keys and browser sessions
+type Validator struct {
+	keys        *tokens.KeyManager
+	userService *data.UserService
+	revocations *data.RevocationService
+	apiKeys     *data.APIKeyService
+	sessions    *data.SessionService
+	roleService *data.RoleService
+	clientSvc   *data.OAuthClientService
+	// users caches account state by user id so that it is not read from mongo
+	// on every request; changes take effect within userCacheTTL
+	users *cache.TTL[string, cachedUser]
+	// roles caches roles by name, likewise
+	roles *cache.TTL[string, models.Role]
+	// clients caches whether an OAuth client exists, likewise
+	clients *cache.TTL[string, bool]
+}
+
+// NewValidator constructs a Validator
+func NewValidator(keys *tokens.KeyManager, us *data.UserService, rs *data.RevocationService, aks *data.APIKeyService, ss *data.SessionService, roles *data.RoleService, clients *data.OAuthClientService) *Validator {
+	return &Validator{
+		keys:        keys,
+		userService: us,
+		revocations: rs,
+		apiKeys:     aks,
+		sessions:    ss,
+		roleService: roles,
+		clientSvc:   clients,
+		users:       cache.New[string, cachedUser](userCacheTTL),
+		roles:       cache.New[string, models.Role](userCacheTTL),
+		clients:     cache.New[string, bool](userCacheTTL),
+	}
+}
+
+// Authenticate validates an access token or API key. Tokens are rejected when
+// revoked by jti, issued before the user's current token version, when the
+// login they belong to was ended, when the account was deleted, disabled or
+// had its roles changed, or when the OAuth client they were issued to was
+// deleted.
+func (v *Validator) Authenticate(token string) (Principal, error) {
+	if data.IsAPIKey(token) {
+		return v.authenticateAPIKey(token)
+	}
+	// the verification key is selected by the token's kid header
+	claims, err := v.keys.Parse(token)
+	if err != nil || claims["token_use"] != "access" {
+		return Principal{}, ErrInvalidToken
+	}
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		return Principal{}, ErrInvalidPayload
+	}
+	p := Principal{JTI: jti, ExpiresAt: exp.Time, Method: MethodJWT}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		p.IssuedAt = iat.Time
+	}
+	if clientID, _ := claims["client_id"].(string); clientID != "" {
+		// tokens issued to OAuth clients are limited to the granted scope
+		scope, _ := claims["scope"].(string)
+		p.ClientID = clientID
+		p.Scopes = strings.Fields(scope)
+		p.Method = MethodOAuth
+	}
+
+	revoked, err := v.revocations.IsRevoked(jti)
+	if err != nil {
+		return Principal{}, err
+	}
+	if p.ClientID != "" {
+		exists, err := v.clientExists(p.ClientID)
+		if err != nil {
+			return Principal{}, err
+		}
+		if !exists {
+			return Principal{}, ErrRevoked
+		}
+	}
+	if claims["gty"] == models.GrantClientCredentials {
+		// the client acts on its own behalf, there is no user
+		if p.ClientID == "" {
+			return Principal{}, ErrInvalidPayload
+		}
+		if revoked {
+			return Principal{}, ErrRevoked
+		}
+		p.Method = MethodClientCredentials
+		for _, s := range p.Scopes {
+			if slices.Contains(models.ClientCredentialsScopes, s) {
+				p.Permissions = append(p.Permissions, s)
+			}
+		}
+		return p, nil
+	}
+
+	// the user is resolved by the stable sub claim; username and roles
+	// are taken from the current account state, not from the token
+	userID, _ := claims["sub"].(string)
+	roles := stringsClaim(claims["roles"])
+	version, okVer := claims["ver"].(float64)
+	if userID == "" || !okVer {
+		return Principal{}, ErrInvalidPayload
+	}
+	cached, err := v.cachedUser(userID)
+	if err != nil {
+		return Principal{}, err
+	}
+	u := cached.User
+	// a token issued after the account state was cached may reflect a change
+	// not seen yet; older tokens are judged by the cached state. iat has
+	// second precision.
+	if (u.TokenVersion != int(version) || !models.SameRoles(u.Roles, roles)) &&
+		!p.IssuedAt.IsZero() && !p.IssuedAt.Before(cached.loaded.Truncate(time.Second)) {
+		v.users.Delete(userID)
+		if u, err = v.lookupUser(userID); err != nil {
+			return Principal{}, err
+		}
+	}
+	if revoked || u.Username == "" || u.TokenVersion != int(version) {
+		return Principal{}, ErrRevoked
+	}
+	if u.Disabled {
+		return Principal{}, ErrAccountDisabled
+	}
+	if !models.SameRoles(u.Roles, roles) {
+		// privileges changed since the token was issued
+		return Principal{}, ErrOutdated
+	}
+	if sid, _ := claims["sid"].(string); sid != "" {
+		// the login was ended by the user or an admin
+		sess, err := v.sessions.Active(sid)
+		if errors.Is(err, data.ErrSessionInvalid) {
+			return Principal{}, ErrRevoked
+		}
+		if err != nil {
+			return Principal{}, err
+		}
+		p.Session = sess
+	}
+	p.User = u
+	if p.Permissions, err = v.permissions(u); err != nil {
+		return Principal{}, err
+	}
+	return p, nil
+}
+
+// authenticateAPIKey validates a personal access token
+func (v *Validator) authenticateAPIKey(key string) (Principal, error) {
+	k, err := v.apiKeys.Authenticate(key)
+	if err != nil {
+		if errors.Is(err, data.ErrAPIKeyInvalid) {
+			return Principal{}, ErrInvalidAPIKey
+		}
+		return Principal{}, err
+	}
+	u, err := v.lookupUser(k.UserID.Hex())
+	if err != nil {
+		return Principal{}, err
+	}
+	if u.Username == "" {
+		return Principal{}, ErrInvalidAPIKey
+	}
+	if u.Disabled {
+		return Principal{}, ErrAccountDisabled
+	}
+	p := Principal{User: u, Scopes: k.Scopes, Method: MethodAPIKey, IssuedAt: k.CreatedAt, APIKey: k}
+	if k.ExpiresAt != nil {
+		p.ExpiresAt = *k.ExpiresAt
+	}
+	if p.Permissions, err = v.permissions(u); err != nil {
+		return Principal{}, err
+	}
+	return p, nil
+}
+
+// AuthenticateSession validates a browser session token. Sessions end when
+// the user's token version changes, as it does when all sessions are revoked.
+// The caller checks the CSRF token.
+func (v *Validator) AuthenticateSession(token string) (Principal, error) {
+	sess, err := v.sessions.Authenticate(token)
+	if err != nil {
+		if errors.Is(err, data.ErrSessionInvalid) {
+			return Principal{}, ErrInvalidSession
+		}
+		return Principal{}, err
+	}
+	u, err := v.lookupUser(sess.UserID.Hex())
+	if err != nil {
+		return Principal{}, err
+	}
+	if u.Username == "" || u.TokenVersion != sess.TokenVersion {
+		return Principal{}, ErrInvalidSession
+	}
+	if u.Disabled {
+		return Principal{}, ErrAccountDisabled
+	}
+	perms, err := v.permissions(u)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{
+		User:        u,
+		Method:      MethodSession,
+		IssuedAt:    sess.CreatedAt,
+		ExpiresAt:   sess.ExpiresAt,
+		Session:     sess,
+		Permissions: perms,
+	}, nil
+}
+
+// permissions returns the permissions granted by u's roles. Roles that no
+// longer exist grant nothing.
+func (v *Validator) permissions(u models.User) ([]string, error) {
+	var perms []string
+	for _, name := range u.Roles {
+		r, ok := v.roles.Get(name)
+		if !ok {
+			var err error
+			if r, err = v.roleService.Find(name); err != nil {
+				return nil, err
+			}
+			v.roles.Set(name, r)
+		}
+		perms = append(perms, r.Permissions...)
+	}
+	slices.Sort(perms)
+	return slices.Compact(perms), nil
+}
+
+// stringsClaim converts a JSON array claim to strings
+func stringsClaim(v any) []string {
+	items, _ := v.([]any)
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// cachedUser is an account state and when it was read
+type cachedUser struct {
+	models.User
+	loaded time.Time
+}
+
+// lookupUser returns the user with the given hex id, served from cache when
+// possible. Missing users are cached too, as a zero User.
+func (v *Validator) lookupUser(userID string) (models.User, error) {
+	cached, err := v.cachedUser(userID)
+	return cached.User, err
+}
+
+func (v *Validator) cachedUser(userID string) (cachedUser, error) {
+	if cached, ok := v.users.Get(userID); ok {
+		return cached, nil
+	}
+	loaded := time.Now()
+	u, err := v.userService.GetByID(userID)
+	if err != nil {
+		return cachedUser{}, err
+	}
+	cached := cachedUser{User: u, loaded: loaded}
+	v.users.Set(userID, cached)
+	return cached, nil
+}
+
+// clientExists reports whether the OAuth client clientID exists, served from
+// cache when possible
+func (v *Validator) clientExists(clientID string) (bool, error) {
+	if exists, ok := v.clients.Get(clientID); ok {
+		return exists, nil
+	}
+	c, err := v.clientSvc.Find(clientID)
+	if err != nil {
+		return false, err
+	}
+	v.clients.Set(clientID, c.ClientID != "")
+	return c.ClientID != "", nil
+}
+
+// ForgetClient drops the cached state of the OAuth client clientID, so that
+// this instance sees its deletion at once
+func (v *Validator) ForgetClient(clientID string) {
+	v.clients.Delete(clientID)
+}
+
+// IsRejected reports whether err means the credential was rejected, as opposed
+// to an internal failure while validating it
+func IsRejected(err error) bool {
+	for _, e := range []error{ErrInvalidToken, ErrInvalidPayload, ErrRevoked, ErrAccountDisabled, ErrOutdated, ErrInvalidAPIKey, ErrInvalidSession} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
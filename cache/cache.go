@@ -0,0 +1,68 @@
+// Package cache provides a small in-process cache with per-entry expiry
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+type entry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// TTL is a concurrency-safe map whose entries expire after a fixed duration
+type TTL[K comparable, V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[K]entry[V]
+}
+
+// New constructs a TTL cache whose entries live for ttl
+func New[K comparable, V any](ttl time.Duration) *TTL[K, V] {
+	return &TTL[K, V]{ttl: ttl, entries: make(map[K]entry[V])}
+}
+
+// Get returns the cached value for key if present and not expired
+func (c *TTL[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Set stores value under key for the cache's default TTL
+func (c *TTL[K, V]) Set(key K, value V) {
+	c.SetUntil(key, value, time.Now().Add(c.ttl))
+}
+
+// SetUntil stores value under key until the given time
+func (c *TTL[K, V]) SetUntil(key K, value V, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// drop expired entries once the map grows so it cannot leak
+	if len(c.entries) >= 10000 {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = entry[V]{value: value, expires: expires}
+}
+
+// Delete removes key from the cache
+func (c *TTL[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
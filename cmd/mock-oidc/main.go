@@ -0,0 +1,33 @@
+// Command mock-oidc is a minimal OpenID Connect provider for testing federated
+// login locally. The authorization page signs in any username with the groups
+// entered; no password is checked.
+//
+//	go run ./cmd/mock-oidc -client-id authgo -client-secret secret
+//
+// with a FEDERATION_PROVIDERS_FILE entry such as
+//
+//	[{"name": "mock", "issuer": "http://127.0.0.1:9999", "client_id": "authgo",
+//	  "client_secret": "secret", "provision": true, "group_roles": {"admins": "admin"}}]
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"authgo/federation/oidctest"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:9999", "listen address")
+	clientID := flag.String("client-id", "authgo", "accepted client id")
+	clientSecret := flag.String("client-secret", "secret", "accepted client secret, empty for a public client")
+	flag.Parse()
+
+	p, err := oidctest.NewProvider("http://"+*listen, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("mock OpenID provider at %s", p.Issuer)
+	log.Fatal(http.ListenAndServe(*listen, p))
+}
@@ -0,0 +1,76 @@
+// Command oidc-rp is a minimal OpenID Connect relying party for testing the
+// provider end to end. It runs the authorization code flow with PKCE against
+// the issuer, verifies the ID token and prints the token and userinfo claims.
+//
+//	go run ./cmd/oidc-rp -client-id <id> -client-secret <secret>
+//
+// The client must be registered with redirect URI http://127.0.0.1:9090/callback
+// and the openid scope.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+
+	"authgo/federation/oidctest"
+)
+
+func main() {
+	issuer := flag.String("issuer", "http://localhost:8080", "OpenID provider issuer URL")
+	clientID := flag.String("client-id", "", "registered client id")
+	clientSecret := flag.String("client-secret", "", "client secret, empty for public clients")
+	scope := flag.String("scope", "openid profile", "requested scope")
+	listen := flag.String("listen", "127.0.0.1:9090", "address for the callback server")
+	flag.Parse()
+	if *clientID == "" {
+		log.Fatal("-client-id is required")
+	}
+
+	rp, err := oidctest.NewRelyingParty(*issuer, *clientID, *clientSecret, "http://"+*listen+"/callback", *scope)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	requests := map[string]oidctest.Request{}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		req, err := rp.AuthCodeURL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		requests[req.State] = req
+		mu.Unlock()
+		http.Redirect(w, r, req.URL, http.StatusFound)
+	})
+
+	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		state := r.URL.Query().Get("state")
+		mu.Lock()
+		req, ok := requests[state]
+		delete(requests, state)
+		mu.Unlock()
+		if !ok {
+			http.Error(w, "unknown state", http.StatusBadRequest)
+			return
+		}
+		login, err := rp.Callback(req, r.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(map[string]any{"id_token": login.IDToken, "userinfo": login.Userinfo})
+	})
+
+	log.Printf("open http://%s/ to sign in", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
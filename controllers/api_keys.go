@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func toAPIKeyResponse(k models.APIKey) models.APIKeyResponse {
+	return models.APIKeyResponse{
+		ID:         k.ID.Hex(),
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     k.Scopes,
+		CreatedAt:  k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+	}
+}
+
+// CreateAPIKey handles POST /me/tokens (authenticated). The key itself is only
+// returned in this response.
+func (ctl *Controller) CreateAPIKey(c *gin.Context) {
+	var input struct {
+		Name          string   `json:"name" binding:"required"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name required"})
+		return
+	}
+	if len(input.Scopes) == 0 {
+		input.Scopes = []string{models.ScopeTasksRead}
+	}
+	for _, scope := range input.Scopes {
+		if !slices.Contains(models.APIKeyScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope, "allowed_scopes": models.APIKeyScopes})
+			return
+		}
+	}
+	if input.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must not be negative"})
+		return
+	}
+	var expiresAt *time.Time
+	if input.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, input.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	key, k, err := ctl.apiKeySvc.Create(u.ID, input.Name, slices.Compact(slices.Sorted(slices.Values(input.Scopes))), expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create api key"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"key":     key,
+		"api_key": toAPIKeyResponse(k),
+	})
+}
+
+// ListAPIKeys handles GET /me/tokens (authenticated)
+func (ctl *Controller) ListAPIKeys(c *gin.Context) {
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	keys, err := ctl.apiKeySvc.ListByUser(u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch api keys"})
+		return
+	}
+	resp := make([]models.APIKeyResponse, 0, len(keys))
+	for _, k := range keys {
+		resp = append(resp, toAPIKeyResponse(k))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// DeleteAPIKey handles DELETE /me/tokens/:id (authenticated)
+func (ctl *Controller) DeleteAPIKey(c *gin.Context) {
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	deleted, err := ctl.apiKeySvc.Delete(u.ID, c.Param("id"))
+	if err != nil {
+		if err.Error() == "invalid id" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete api key"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "api key deleted"})
+}
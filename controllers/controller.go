@@ -1,42 +1,198 @@
 package controllers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"authgo/auth"
 	"authgo/data"
 	"authgo/models"
+	"authgo/notify"
+	"authgo/tokens"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Controller groups handlers for users and tasks
 type Controller struct {
-	userSvc *data.UserService
-	taskSvc *data.TaskService
-	secret  string
+	userSvc    *data.UserService
+	taskSvc    *data.TaskService
+	refreshSvc *data.RefreshTokenService
+	revokeSvc  *data.RevocationService
+	resetSvc   *data.PasswordResetService
+	verifySvc  *data.EmailVerificationService
+	attemptSvc *data.LoginAttemptService
+	apiKeySvc  *data.APIKeyService
+	sessionSvc *data.SessionService
+	roleSvc    *data.RoleService
+	// authn checks login passwords: the directory, if configured, then local accounts
+	authn      auth.Authenticator
+	keys       *tokens.KeyManager
+	notifier   notify.Notifier
+	issuer     string // public base URL of this service
+	accessTTL  time.Duration
+	resetURL   string
+	verifyURL  string
+	totpIssuer string
+	magicTTL   time.Duration
+	magicURL   string
+	// emailPolicy is EmailVerifiedForLogin, EmailVerifiedForTasks or empty
+	emailPolicy string
+	// cookieSessions makes logins set a session cookie instead of returning tokens
+	cookieSessions bool
+	cookieSameSite http.SameSite
+}
+
+// Config holds the settings of the controllers, which main reads from the
+// environment
+type Config struct {
+	// Issuer is the public base URL of this service, used as the OpenID
+	// Connect issuer and for links back to it
+	Issuer    string
+	AccessTTL time.Duration
+	// ResetURL and VerifyURL are optional frontend pages that accept ?token=
+	ResetURL   string
+	VerifyURL  string
+	TOTPIssuer string
+	MagicTTL   time.Duration
+	// MagicURL is the page magic links point to; it must pass ?token= on to
+	// GET /login/magic/verify, which it defaults to
+	MagicURL string
+	// EmailPolicy is what is blocked until the email address is verified:
+	// EmailVerifiedForLogin, EmailVerifiedForTasks or empty
+	EmailPolicy string
+	// CookieSessions makes logins set a session cookie instead of returning
+	// tokens, for the web frontend
+	CookieSessions bool
+	// CookieSameSite is the SameSite attribute of the session cookies
+	CookieSameSite string
 }
 
 // NewController constructs Controller
-func NewController(us *data.UserService, ts *data.TaskService) *Controller {
+func NewController(us *data.UserService, ts *data.TaskService, rs *data.RefreshTokenService, revs *data.RevocationService,
+	resets *data.PasswordResetService, verifications *data.EmailVerificationService,
+	attempts *data.LoginAttemptService, aks *data.APIKeyService, sessions *data.SessionService,
+	roles *data.RoleService, authn auth.Authenticator, keys *tokens.KeyManager, n notify.Notifier, cfg Config) *Controller {
+	issuer := strings.TrimSuffix(cfg.Issuer, "/")
+	magicURL := cfg.MagicURL
+	if magicURL == "" {
+		magicURL = issuer + "/login/magic/verify"
+	}
 	return &Controller{
-		userSvc: us,
-		taskSvc: ts,
-		secret:  os.Getenv("JWT_SECRET"),
+		userSvc:    us,
+		taskSvc:    ts,
+		refreshSvc: rs,
+		revokeSvc:  revs,
+		resetSvc:   resets,
+		verifySvc:  verifications,
+		attemptSvc: attempts,
+		apiKeySvc:  aks,
+		sessionSvc: sessions,
+		roleSvc:    roles,
+		authn:      authn,
+		keys:       keys,
+		notifier:   n,
+		issuer:     issuer,
+		accessTTL:  cfg.AccessTTL,
+		resetURL:   cfg.ResetURL,
+		verifyURL:  cfg.VerifyURL,
+		totpIssuer: cfg.TOTPIssuer,
+		magicTTL:   cfg.MagicTTL,
+		magicURL:   magicURL,
+		// what is blocked until the email address is verified
+		emailPolicy: cfg.EmailPolicy,
+		// browser sessions for the web frontend
+		cookieSessions: cfg.CookieSessions,
+		cookieSameSite: cookieSameSite(cfg.CookieSameSite),
+	}
+}
+
+// newJTI returns a random token identifier
+func newJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(b), nil
 }
 
-func tokenForUser(u models.User, secret string) (string, error) {
+// tokenForUser issues an access token for u. Tokens issued to an OAuth client
+// carry its client_id and the granted scope, which limits what they can reach.
+// Tokens of a tracked login carry its session id, sid, so that ending the
+// login revokes them.
+func tokenForUser(u models.User, keys *tokens.KeyManager, ttl time.Duration, clientID, scope, sid string) (string, error) {
+	jti, err := newJTI()
+	if err != nil {
+		return "", err
+	}
 	claims := jwt.MapClaims{
-		"username": u.Username,
-		"role":     u.Role,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
-		"nbf":      time.Now().Unix(),
+		"sub":       u.ID.Hex(),
+		"username":  u.Username,
+		"roles":     u.Roles,
+		"token_use": "access",
+		"jti":       jti,
+		"ver":       u.TokenVersion,
+		"exp":       time.Now().Add(ttl).Unix(),
+		"iat":       time.Now().Unix(),
+		"nbf":       time.Now().Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	if clientID != "" {
+		claims["client_id"] = clientID
+		claims["scope"] = scope
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	return keys.Sign(claims)
+}
+
+// tokenResponse builds the login response carrying a fresh access token for
+// the session sid alongside the given refresh token
+func (ctl *Controller) tokenResponse(u models.User, refreshToken, sid string) (gin.H, error) {
+	tok, err := tokenForUser(u, ctl.keys, ctl.accessTTL, "", "", sid)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"username":      u.Username,
+		"roles":         u.Roles,
+		"token":         tok,
+		"token_type":    "Bearer",
+		"expires_in":    int(ctl.accessTTL.Seconds()),
+		"refresh_token": refreshToken,
+	}, nil
+}
+
+// newSession starts a new refresh token family for u and returns the login
+// response. In cookie mode it starts a browser session instead.
+func (ctl *Controller) newSession(c *gin.Context, u models.User) (gin.H, error) {
+	if ctl.cookieSessions {
+		return ctl.newCookieSession(c, u)
+	}
+	refresh, rt, err := ctl.refreshSvc.Issue(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := ctl.sessionSvc.Track(u, rt.FamilyID, sessionClient(c), rt.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return ctl.tokenResponse(u, refresh, sess.ID.Hex())
+}
+
+// JWKS handles GET /.well-known/jwks.json, publishing the token verification keys
+func (ctl *Controller) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, ctl.keys.JWKS())
 }
 
 // Register handles POST /register
@@ -44,30 +200,46 @@ func (ctl *Controller) Register(c *gin.Context) {
 	var input struct {
 		Username string `json:"username" binding:"required"`
 		Password string `json:"password" binding:"required"`
+		Email    string `json:"email"`
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password required"})
 		return
 	}
-	u, err := ctl.userSvc.CreateUser(input.Username, input.Password)
+	if input.Email == "" && ctl.emailPolicy == EmailVerifiedForLogin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email required"})
+		return
+	}
+	u, err := ctl.userSvc.CreateUser(input.Username, input.Password, input.Email)
 	if err != nil {
+		if writePolicyError(c, err) {
+			return
+		}
+		if errors.Is(err, data.ErrEmailTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	// issue token
-	tok, err := tokenForUser(u, ctl.secret)
+	if u.Email != "" {
+		ctl.sendEmailVerification(u)
+	}
+	if ctl.emailPolicy == EmailVerifiedForLogin {
+		c.JSON(http.StatusCreated, gin.H{"message": "account created, verify your email address to log in"})
+		return
+	}
+	// issue tokens
+	resp, err := ctl.newSession(c, u)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
-	c.JSON(http.StatusCreated, gin.H{
-		"username": u.Username,
-		"role":     u.Role,
-		"token":    tok,
-	})
+	c.JSON(http.StatusCreated, resp)
 }
 
-// Login handles POST /login
+// Login handles POST /login. Users with two-factor authentication get an MFA
+// challenge to complete via POST /login/mfa instead of tokens.
 func (ctl *Controller) Login(c *gin.Context) {
 	var input struct {
 		Username string `json:"username" binding:"required"`
@@ -77,24 +249,204 @@ func (ctl *Controller) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password required"})
 		return
 	}
-	u, err := ctl.userSvc.Authenticate(input.Username, input.Password)
+	if !ctl.checkLockout(c, input.Username) {
+		return
+	}
+	u, err := ctl.authn.Authenticate(input.Username, input.Password)
+	if errors.Is(err, data.ErrUserDisabled) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "account disabled"})
+		return
+	}
 	if err != nil {
+		ctl.recordFailure(c, input.Username)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
-	tok, err := tokenForUser(u, ctl.secret)
+	ctl.completeLogin(c, u)
+}
+
+// checkLockout rejects the request with 429 while username or the client IP
+// is locked after repeated failures; it returns false if a response was written
+func (ctl *Controller) checkLockout(c *gin.Context, username string) bool {
+	wait, err := ctl.attemptSvc.LockedFor(username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return false
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed login attempts, try again later"})
+		return false
+	}
+	return true
+}
+
+// confirmPassword re-authenticates the caller with password, which may be
+// checked by the directory rather than locally. Like a login it is refused
+// while the account is locked and a wrong password counts as a failed attempt.
+// It returns false if a response was written.
+func (ctl *Controller) confirmPassword(c *gin.Context, password string) (models.User, bool) {
+	username := c.GetString("username")
+	if !ctl.checkLockout(c, username) {
+		return models.User{}, false
+	}
+	u, err := ctl.authn.Authenticate(username, password)
+	// a directory account of the same name is not the caller
+	if err == nil && u.ID.Hex() != c.GetString("user_id") {
+		err = data.ErrInvalidCredentials
+	}
+	if err != nil {
+		if !errors.Is(err, data.ErrUserDisabled) {
+			ctl.recordFailure(c, username)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "password is incorrect"})
+		return models.User{}, false
+	}
+	return u, true
+}
+
+// recordFailure counts a failed login attempt for username and the client IP
+func (ctl *Controller) recordFailure(c *gin.Context, username string) {
+	if err := ctl.attemptSvc.RecordFailure(username, c.ClientIP()); err != nil {
+		log.Printf("failed to record login failure for %s: %v", username, err)
+	}
+}
+
+// Refresh handles POST /token/refresh. The presented refresh token is rotated;
+// replaying an already used token revokes every token issued from the same login.
+func (ctl *Controller) Refresh(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token required"})
+		return
+	}
+	refresh, rt, err := ctl.refreshSvc.Rotate(input.RefreshToken, "")
+	if err != nil {
+		if errors.Is(err, data.ErrRefreshTokenInvalid) || errors.Is(err, data.ErrRefreshTokenReused) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+	u, err := ctl.userSvc.GetByID(rt.UserID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+	if u.Username == "" || u.Disabled {
+		// user no longer exists or was disabled
+		_ = ctl.refreshSvc.RevokeFamily(rt.FamilyID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+	// logins from before sessions were tracked have none
+	sess, err := ctl.sessionSvc.Refreshed(rt.FamilyID, rt.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+	sid := ""
+	if !sess.ID.IsZero() {
+		sid = sess.ID.Hex()
+	}
+	resp, err := ctl.tokenResponse(u, refresh, sid)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"username": u.Username,
-		"role":     u.Role,
-		"token":    tok,
-	})
+	c.JSON(http.StatusOK, resp)
+}
+
+// Logout handles POST /logout. The access token used for the request is revoked
+// and its login ended, as is the refresh token family of the optional
+// "refresh_token" body field. A request authenticated by session cookie ends
+// the session.
+func (ctl *Controller) Logout(c *gin.Context) {
+	if c.GetString("auth_method") == auth.MethodSession {
+		if err := ctl.endCookieSession(c); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+		return
+	}
+
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	// body is optional
+	_ = c.ShouldBindJSON(&input)
+
+	exp, _ := c.Get("token_exp")
+	expiresAt, _ := exp.(time.Time)
+	if err := ctl.revokeSvc.Revoke(c.GetString("jti"), expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
+		return
+	}
+	if input.RefreshToken != "" {
+		if err := ctl.refreshSvc.RevokeToken(input.RefreshToken, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
+			return
+		}
+	}
+	// end the login the token belongs to
+	if sid := c.GetString("session_id"); sid != "" {
+		sess, err := ctl.sessionSvc.DeleteForUser(userID, sid)
+		if err == nil && sess.FamilyID != "" {
+			err = ctl.refreshSvc.RevokeFamily(sess.FamilyID)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// RevokeUserSessions handles DELETE /users/:username/sessions (users:manage).
+// Every access and refresh token issued to the user stops working.
+func (ctl *Controller) RevokeUserSessions(c *gin.Context) {
+	username := c.Param("username")
+	updated, err := ctl.userSvc.IncrementTokenVersion(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	if updated.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err := ctl.refreshSvc.RevokeUser(updated.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	if err := ctl.sessionSvc.DeleteByUser(updated.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "sessions revoked"})
+}
+
+// Unlock handles POST /users/:username/unlock (users:manage), clearing failed
+// login attempts and any lockout of the account
+func (ctl *Controller) Unlock(c *gin.Context) {
+	username := c.Param("username")
+	if err := ctl.attemptSvc.ResetAccount(username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "user unlocked"})
 }
 
-// Promote handles POST /promote/:username (admin only)
+// Promote handles POST /promote/:username (users:promote), adding the admin role
 func (ctl *Controller) Promote(c *gin.Context) {
 	username := c.Param("username")
 	if username == "" {
@@ -110,10 +462,10 @@ func (ctl *Controller) Promote(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"username": updated.Username, "role": updated.Role})
+	c.JSON(http.StatusOK, gin.H{"username": updated.Username, "roles": updated.Roles})
 }
 
-// GetTasks handles GET /tasks (authenticated: all users)
+// GetTasks handles GET /tasks (tasks:read)
 func (ctl *Controller) GetTasks(c *gin.Context) {
 	tasks, err := ctl.taskSvc.GetAllTasks()
 	if err != nil {
@@ -137,7 +489,7 @@ func (ctl *Controller) GetTasks(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-// GetTaskByID handles GET /tasks/:id (authenticated)
+// GetTaskByID handles GET /tasks/:id (tasks:read)
 func (ctl *Controller) GetTaskByID(c *gin.Context) {
 	id := c.Param("id")
 	t, err := ctl.taskSvc.GetTaskByID(id)
@@ -159,7 +511,7 @@ func (ctl *Controller) GetTaskByID(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-// CreateTask handles POST /tasks (admin only)
+// CreateTask handles POST /tasks (tasks:write)
 func (ctl *Controller) CreateTask(c *gin.Context) {
 	var input models.Task
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -180,7 +532,7 @@ func (ctl *Controller) CreateTask(c *gin.Context) {
 	})
 }
 
-// UpdateTask handles PUT /tasks/:id (admin only)
+// UpdateTask handles PUT /tasks/:id (tasks:write)
 func (ctl *Controller) UpdateTask(c *gin.Context) {
 	id := c.Param("id")
 	var input models.Task
@@ -210,7 +562,7 @@ func (ctl *Controller) UpdateTask(c *gin.Context) {
 	})
 }
 
-// DeleteTask handles DELETE /tasks/:id (admin only)
+// DeleteTask handles DELETE /tasks/:id (tasks:write)
 func (ctl *Controller) DeleteTask(c *gin.Context) {
 	id := c.Param("id")
 	ok, err := ctl.taskSvc.DeleteTask(id)
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// devicePage is shown at the verification URI, where the user enters the code
+// displayed by the device and signs in to approve it
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Connect a device</title></head>
+<body>
+{{if .Done}}<h1>{{.Done}}</h1>
+<p>You can close this window and return to your device.</p>
+{{else}}<h1>Connect a device</h1>
+<p>Enter the code shown on your device and sign in to allow it access to your account.</p>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/device">
+<label>Code <input name="user_code" value="{{.UserCode}}" autocomplete="off" required></label>
+<label>Username <input name="username" autocomplete="username" required></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<label>Authentication code (if enabled) <input name="code" autocomplete="one-time-code"></label>
+<button type="submit" name="action" value="approve">Allow</button>
+<button type="submit" name="action" value="deny" formnovalidate>Deny</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// DeviceAuthorization handles POST /oauth/device/code (RFC 8628 section 3.1),
+// starting a device authorization for a client that cannot open a browser
+func (o *OAuthController) DeviceAuthorization(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	client, oerr := o.authenticateClient(c)
+	if oerr != nil {
+		writeOAuthError(c, oerr)
+		return
+	}
+	if !slices.Contains(client.GrantTypes, models.GrantDeviceCode) {
+		writeOAuthError(c, newOAuthError(http.StatusBadRequest, "unauthorized_client", "the client may not use the device authorization grant"))
+		return
+	}
+	scope, ok := grantScope(c.PostForm("scope"), client.Scopes)
+	if !ok {
+		writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_scope", "the requested scope is not allowed for this client"))
+		return
+	}
+	deviceCode, dc, err := o.devices.Create(client.ClientID, scope)
+	if err != nil {
+		writeOAuthError(c, newOAuthError(http.StatusInternalServerError, "server_error", "failed to start device authorization"))
+		return
+	}
+	userCode := data.FormatUserCode(dc.UserCode)
+	verificationURI := o.issuer + "/oauth/device"
+	c.JSON(http.StatusOK, gin.H{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(userCode),
+		"expires_in":                int(dc.ExpiresAt.Sub(dc.CreatedAt).Seconds()),
+		"interval":                  dc.Interval,
+	})
+}
+
+// DeviceVerify handles GET /oauth/device, the page where users enter the code
+// shown on their device
+func (o *OAuthController) DeviceVerify(c *gin.Context) {
+	renderDevicePage(c, http.StatusOK, gin.H{"UserCode": c.Query("user_code")})
+}
+
+// DeviceVerifySubmit handles POST /oauth/device. The user signs in with the
+// same checks as POST /login and approves or denies the device.
+func (o *OAuthController) DeviceVerifySubmit(c *gin.Context) {
+	userCode := c.PostForm("user_code")
+	page := func(status int, message string) {
+		renderDevicePage(c, status, gin.H{"UserCode": userCode, "Error": message})
+	}
+	dc, err := o.devices.FindPending(userCode)
+	if err != nil {
+		page(http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+	if dc.ID.IsZero() {
+		page(http.StatusBadRequest, "The code is invalid or has expired.")
+		return
+	}
+	client, err := o.clients.Find(dc.ClientID)
+	if err != nil || client.ClientID == "" {
+		page(http.StatusBadRequest, "The code is invalid or has expired.")
+		return
+	}
+	if c.PostForm("action") != "approve" {
+		if _, err := o.devices.Deny(dc.ID); err != nil {
+			page(http.StatusInternalServerError, "Something went wrong, please try again.")
+			return
+		}
+		renderDevicePage(c, http.StatusOK, gin.H{"Done": "Access denied"})
+		return
+	}
+
+	username, password := c.PostForm("username"), c.PostForm("password")
+	wait, err := o.attemptSvc.LockedFor(username, c.ClientIP())
+	if err != nil {
+		page(http.StatusInternalServerError, "Sign in failed, please try again.")
+		return
+	}
+	if wait > 0 {
+		page(http.StatusTooManyRequests, "Too many failed sign-in attempts, try again later.")
+		return
+	}
+	u, err := o.authn.Authenticate(username, password)
+	if errors.Is(err, data.ErrUserDisabled) {
+		page(http.StatusUnauthorized, "This account is disabled.")
+		return
+	}
+	if err != nil {
+		o.recordFailure(c, username)
+		page(http.StatusUnauthorized, "Invalid username or password.")
+		return
+	}
+	if status, message, ok := o.checkSecondFactor(c, u); !ok {
+		page(status, message)
+		return
+	}
+	if err := o.attemptSvc.ResetAccount(u.Username); err != nil {
+		page(http.StatusInternalServerError, "Sign in failed, please try again.")
+		return
+	}
+	if o.loginBlocked(u) {
+		page(http.StatusForbidden, "Verify your email address before signing in.")
+		return
+	}
+	approved, err := o.devices.Approve(dc.ID, u.ID)
+	if err != nil {
+		page(http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+	if !approved {
+		page(http.StatusBadRequest, "The code is invalid or has expired.")
+		return
+	}
+	renderDevicePage(c, http.StatusOK, gin.H{"Done": client.Name + " is now connected"})
+}
+
+func renderDevicePage(c *gin.Context, status int, data gin.H) {
+	// the page accepts credentials and must not be framed
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	_ = devicePage.Execute(c.Writer, data)
+}
+
+// exchangeDeviceCode answers a device polling /oauth/token. Once the user has
+// approved, the device gets the same access and refresh tokens as a login.
+func (o *OAuthController) exchangeDeviceCode(c *gin.Context, client models.OAuthClient) (gin.H, *oauthError) {
+	dc, err := o.devices.Poll(c.PostForm("device_code"), client.ClientID)
+	switch {
+	case errors.Is(err, data.ErrAuthorizationPending):
+		return nil, newOAuthError(http.StatusBadRequest, "authorization_pending", "the user has not yet approved the device")
+	case errors.Is(err, data.ErrSlowDown):
+		return nil, newOAuthError(http.StatusBadRequest, "slow_down", "polling too frequently, increase the interval by 5 seconds")
+	case errors.Is(err, data.ErrDeviceAccessDenied):
+		return nil, newOAuthError(http.StatusBadRequest, "access_denied", "the user denied the request")
+	case errors.Is(err, data.ErrDeviceCodeExpired):
+		return nil, newOAuthError(http.StatusBadRequest, "expired_token", "the device code has expired")
+	case errors.Is(err, data.ErrDeviceCodeInvalid):
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid device code")
+	case err != nil:
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to check device code")
+	}
+
+	u, err := o.userSvc.GetByID(dc.UserID.Hex())
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+	}
+	if u.Username == "" || u.Disabled {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid device code")
+	}
+	refresh := ""
+	if slices.Contains(client.GrantTypes, models.GrantRefreshToken) {
+		refresh, _, err = o.refreshSvc.IssueForClient(u.ID, client.ClientID, dc.Scope, dc.AuthTime)
+		if err != nil {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+		}
+	}
+	return o.oauthTokenResponse(u, client.ClientID, dc.Scope, refresh, "", dc.AuthTime)
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"authgo/data"
+	"authgo/models"
+	"authgo/notify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Values of EMAIL_VERIFICATION_REQUIRED
+const (
+	// EmailVerifiedForLogin refuses logins until the email address is verified
+	EmailVerifiedForLogin = "login"
+	// EmailVerifiedForTasks allows logins but denies task access until the
+	// email address is verified
+	EmailVerifiedForTasks = "tasks"
+)
+
+// sendEmailVerification mails u a token proving ownership of u.Email.
+// Delivery failures are logged; the user can ask for another message.
+func (ctl *Controller) sendEmailVerification(u models.User) {
+	token, err := ctl.verifySvc.Create(u.ID, u.Email)
+	if err != nil {
+		log.Printf("failed to create email verification for %s: %v", u.Username, err)
+		return
+	}
+	body := fmt.Sprintf("Use this token to verify your email address within %s:\n\n%s\n", ctl.verifySvc.TTL(), token)
+	if ctl.verifyURL != "" {
+		body += fmt.Sprintf("\nOr open %s?token=%s\n", ctl.verifyURL, url.QueryEscape(token))
+	}
+	msg := notify.Message{To: u.Email, Subject: "Verify your email address", Body: body}
+	if err := ctl.notifier.Send(msg); err != nil {
+		log.Printf("failed to deliver email verification for %s: %v", u.Username, err)
+	}
+}
+
+// loginBlocked reports whether the policy refuses u a login until an email
+// address is verified. A fresh verification message is sent if u has an address.
+func (ctl *Controller) loginBlocked(u models.User) bool {
+	if ctl.emailPolicy != EmailVerifiedForLogin || (u.Email != "" && u.EmailVerified) {
+		return false
+	}
+	if u.Email != "" {
+		ctl.sendEmailVerification(u)
+	}
+	return true
+}
+
+// blockUnverified refuses the login with 403 when loginBlocked; it returns
+// true if a response was written
+func (ctl *Controller) blockUnverified(c *gin.Context, u models.User) bool {
+	if !ctl.loginBlocked(u) {
+		return false
+	}
+	if u.Email == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "a verified email address is required to log in"})
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "email address not verified, a verification message has been sent"})
+	return true
+}
+
+// RequestEmailVerification handles POST /me/email/verification (authenticated),
+// sending a new verification message to the user's address
+func (ctl *Controller) RequestEmailVerification(c *gin.Context) {
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	if u.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no email address set"})
+		return
+	}
+	if u.EmailVerified {
+		c.JSON(http.StatusOK, gin.H{"email": u.Email, "email_verified": true})
+		return
+	}
+	ctl.sendEmailVerification(u)
+	c.JSON(http.StatusAccepted, gin.H{"message": "a verification message has been sent to " + u.Email})
+}
+
+// VerifyEmail handles POST /me/email/verify. The token identifies the user, so
+// no session is needed; users blocked from logging in verify this way.
+func (ctl *Controller) VerifyEmail(c *gin.Context) {
+	var input struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token required"})
+		return
+	}
+	ev, err := ctl.verifySvc.Consume(input.Token)
+	if err != nil {
+		if errors.Is(err, data.ErrVerificationTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email"})
+		return
+	}
+	u, err := ctl.userSvc.MarkEmailVerified(ev.UserID, ev.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email"})
+		return
+	}
+	if u.Username == "" {
+		// the address was changed after the token was sent
+		c.JSON(http.StatusBadRequest, gin.H{"error": data.ErrVerificationTokenInvalid.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, toUserResponse(u))
+}
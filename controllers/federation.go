@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"authgo/data"
+	"authgo/federation"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// federationCookie carries the signed state of a login in progress
+	federationCookie = "goauth_federation"
+	federationTTL    = 10 * time.Minute
+)
+
+// usernameUnsafe matches characters not kept in usernames derived from IdP claims
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._@-]+`)
+
+// FederationController signs users in through external OpenID Connect providers
+type FederationController struct {
+	*Controller
+	providers *federation.Registry
+}
+
+// NewFederationController constructs FederationController
+func NewFederationController(ctl *Controller, providers *federation.Registry) *FederationController {
+	return &FederationController{
+		Controller: ctl,
+		providers:  providers,
+	}
+}
+
+func (f *FederationController) callbackURL(provider string) string {
+	return f.issuer + "/auth/" + provider + "/callback"
+}
+
+// Start handles GET /auth/:provider/start, redirecting to the identity provider
+func (f *FederationController) Start(c *gin.Context) {
+	p, ok := f.providers.Get(c.Param("provider"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown identity provider"})
+		return
+	}
+	state, err1 := randomString()
+	nonce, err2 := randomString()
+	verifier, err3 := randomString()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+		return
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	target, err := p.AuthCodeURL(c.Request.Context(), f.callbackURL(p.Name), state, nonce, base64.RawURLEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		log.Printf("identity provider %s unavailable: %v", p.Name, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+
+	// the login state is kept client side, signed, so that any replica can
+	// handle the callback
+	cookie, err := f.keys.Sign(jwt.MapClaims{
+		"token_use": "federation",
+		"provider":  p.Name,
+		"state":     state,
+		"nonce":     nonce,
+		"verifier":  verifier,
+		"exp":       time.Now().Add(federationTTL).Unix(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+		return
+	}
+	f.setStateCookie(c, cookie, int(federationTTL.Seconds()))
+	c.Redirect(http.StatusFound, target)
+}
+
+// Callback handles GET /auth/:provider/callback. The user linked to the
+// external identity is signed in, or provisioned when the provider allows it;
+// the response is the same as for POST /login.
+func (f *FederationController) Callback(c *gin.Context) {
+	p, ok := f.providers.Get(c.Param("provider"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown identity provider"})
+		return
+	}
+	raw, _ := c.Cookie(federationCookie)
+	f.setStateCookie(c, "", -1)
+	claims, err := f.keys.Parse(raw)
+	if err != nil || claims["token_use"] != "federation" || claims["provider"] != p.Name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login expired, please start again"})
+		return
+	}
+	state, _ := claims["state"].(string)
+	if subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid state"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "identity provider returned " + e})
+		return
+	}
+	nonce, _ := claims["nonce"].(string)
+	verifier, _ := claims["verifier"].(string)
+	id, err := p.Exchange(c.Request.Context(), c.Query("code"), f.callbackURL(p.Name), verifier, nonce)
+	if err != nil {
+		log.Printf("federated login via %s failed: %v", p.Name, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "login with identity provider failed"})
+		return
+	}
+
+	u, err := f.userSvc.FindByIdentity(id.Issuer, id.Subject)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return
+	}
+	if u.Username == "" {
+		if !p.Provision {
+			c.JSON(http.StatusForbidden, gin.H{"error": "no account is linked to this identity"})
+			return
+		}
+		if u, err = f.provision(p, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create account"})
+			return
+		}
+	} else if roles := p.RolesFor(id.Groups); p.SyncsRoles() && !models.SameRoles(roles, u.Roles) {
+		updated, err := f.userSvc.SetRoles(u.ID, roles)
+		if errors.Is(err, data.ErrLastAdmin) {
+			// the identity provider cannot lock everyone out of administration
+			log.Printf("%s user %s keeps the admin role: no other admin remains", p.Name, u.Username)
+			updated, err = f.userSvc.SetRoles(u.ID, append(roles, models.RoleAdmin))
+		}
+		if u = updated; err != nil || u.Username == "" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+			return
+		}
+	}
+	if u.Disabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "account disabled"})
+		return
+	}
+	f.completeLogin(c, u)
+}
+
+// provision creates a user for an external identity. The username is taken
+// from the IdP claims; if it is in use, a suffix derived from the identity is
+// added rather than linking to the existing local account.
+func (f *FederationController) provision(p *federation.Provider, id federation.Identity) (models.User, error) {
+	identity := models.FederatedIdentity{Provider: p.Name, Issuer: id.Issuer, Subject: id.Subject}
+	sum := sha256.Sum256([]byte(id.Issuer + "|" + id.Subject))
+	suffix := hex.EncodeToString(sum[:3])
+
+	username := usernameUnsafe.ReplaceAllString(id.Username, "")
+	if username == "" {
+		username = p.Name + "-" + suffix
+	}
+	u, err := f.userSvc.CreateFederatedUser(username, p.RolesFor(id.Groups), identity)
+	if errors.Is(err, data.ErrUsernameTaken) {
+		u, err = f.userSvc.CreateFederatedUser(username+"-"+suffix, p.RolesFor(id.Groups), identity)
+	}
+	return u, err
+}
+
+func (f *FederationController) setStateCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(federationCookie, value, maxAge, "/auth/", "", strings.HasPrefix(f.issuer, "https://"), true)
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
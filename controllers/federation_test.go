@@ -0,0 +1,223 @@
+package controllers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"authgo/federation"
+	"authgo/federation/oidctest"
+	"authgo/models"
+)
+
+func newIdentityProvider(t *testing.T) *oidctest.Server {
+	t.Helper()
+	idp, err := oidctest.NewServer("authgo", "client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// mockProvider configures idp as the provider called name
+func mockProvider(name string, idp *oidctest.Server, provision bool, groupRoles map[string]string) federation.ProviderConfig {
+	return federation.ProviderConfig{
+		Name:         name,
+		Issuer:       idp.Issuer,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		GroupRoles:   groupRoles,
+		Provision:    provision,
+	}
+}
+
+// get sends a GET with the browser and decodes the JSON response into out,
+// if given
+func get(t *testing.T, client *http.Client, target string, out any) *http.Response {
+	t.Helper()
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("GET %s: decode %s response: %v", target, resp.Status, err)
+		}
+	}
+	return resp
+}
+
+// authorize starts a login through provider and signs username in at idp. It
+// returns the callback URL the browser is sent back to.
+func (s *testServer) authorize(t *testing.T, client *http.Client, idp *oidctest.Server, provider, username string, groups ...string) *url.URL {
+	t.Helper()
+	resp := get(t, client, s.URL+"/auth/"+provider+"/start", nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("start: %s", resp.Status)
+	}
+	callback, err := idp.SignIn(resp.Header.Get("Location"), username, groups...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback
+}
+
+// federatedLogin signs username in through provider and returns the callback
+// response
+func (s *testServer) federatedLogin(t *testing.T, idp *oidctest.Server, provider, username string, groups ...string) (int, tokenResponse) {
+	t.Helper()
+	client := browser(t)
+	var tok tokenResponse
+	resp := get(t, client, s.authorize(t, client, idp, provider, username, groups...).String(), &tok)
+	return resp.StatusCode, tok
+}
+
+// me returns the user signed in with token
+func (s *testServer) me(t *testing.T, token string) models.UserResponse {
+	t.Helper()
+	var u models.UserResponse
+	if status := s.call(t, http.MethodGet, "/me", token, nil, &u); status != http.StatusOK {
+		t.Fatalf("GET /me: %d", status)
+	}
+	return u
+}
+
+// mustFederatedLogin signs username in and returns the user
+func (s *testServer) mustFederatedLogin(t *testing.T, idp *oidctest.Server, username string, groups ...string) models.UserResponse {
+	t.Helper()
+	status, tok := s.federatedLogin(t, idp, "mock", username, groups...)
+	if status != http.StatusOK || tok.AccessToken == "" {
+		t.Fatalf("federated login as %s: %d %s", username, status, tok.Error)
+	}
+	return s.me(t, tok.AccessToken)
+}
+
+func TestFederatedLoginProvisionsAndLinks(t *testing.T) {
+	idp := newIdentityProvider(t)
+	s := newTestServer(t, mockProvider("mock", idp, true, map[string]string{"admins": models.RoleAdmin}))
+
+	alice := s.mustFederatedLogin(t, idp, "alice", "admins", "staff")
+	if alice.Username != "alice" || !models.SameRoles(alice.Roles, []string{models.RoleAdmin}) {
+		t.Errorf("provisioned %s with roles %v, want alice with admin from the admins group", alice.Username, alice.Roles)
+	}
+	linked, err := s.users.FindByIdentity(idp.Issuer, "mock|alice")
+	if err != nil || linked.ID.Hex() != alice.ID {
+		t.Fatalf("identity linked to %s, err %v, want %s", linked.ID.Hex(), err, alice.ID)
+	}
+
+	again := s.mustFederatedLogin(t, idp, "alice", "admins")
+	if again.ID != alice.ID {
+		t.Errorf("second login signed in to %s, want the linked user %s", again.ID, alice.ID)
+	}
+
+	bob := s.mustFederatedLogin(t, idp, "bob")
+	if !models.SameRoles(bob.Roles, []string{models.RoleUser}) {
+		t.Errorf("roles = %v, want the default role", bob.Roles)
+	}
+}
+
+func TestFederatedLoginSyncsRolesFromGroups(t *testing.T) {
+	idp := newIdentityProvider(t)
+	s := newTestServer(t, mockProvider("mock", idp, true, map[string]string{"admins": models.RoleAdmin}))
+	// a local admin, so that alice's admin role may go
+	s.register(t, "root", "correct horse battery staple")
+
+	if alice := s.mustFederatedLogin(t, idp, "alice", "admins"); !models.SameRoles(alice.Roles, []string{models.RoleAdmin}) {
+		t.Fatalf("roles = %v, want admin", alice.Roles)
+	}
+	if alice := s.mustFederatedLogin(t, idp, "alice", "staff"); !models.SameRoles(alice.Roles, []string{models.RoleUser}) {
+		t.Errorf("roles = %v, want admin taken away once alice left the admins group", alice.Roles)
+	}
+}
+
+func TestFederatedRoleSyncKeepsLastAdmin(t *testing.T) {
+	idp := newIdentityProvider(t)
+	s := newTestServer(t, mockProvider("mock", idp, true, map[string]string{"admins": models.RoleAdmin}))
+
+	s.mustFederatedLogin(t, idp, "alice", "admins")
+	if alice := s.mustFederatedLogin(t, idp, "alice"); !models.SameRoles(alice.Roles, []string{models.RoleAdmin, models.RoleUser}) {
+		t.Errorf("roles = %v, want the last admin to keep admin", alice.Roles)
+	}
+}
+
+func TestFederatedLoginDoesNotLinkLocalAccounts(t *testing.T) {
+	idp := newIdentityProvider(t)
+	s := newTestServer(t, mockProvider("mock", idp, true, nil))
+	local := s.me(t, s.register(t, "alice", "correct horse battery staple"))
+
+	alice := s.mustFederatedLogin(t, idp, "alice")
+	if alice.ID == local.ID || !strings.HasPrefix(alice.Username, "alice-") {
+		t.Errorf("signed in to %s (%s), want a new account beside the local alice", alice.Username, alice.ID)
+	}
+	if u, err := s.users.FindByUsername("alice"); err != nil || len(u.Identities) != 0 {
+		t.Errorf("local alice has identities %v, err %v, want none", u.Identities, err)
+	}
+}
+
+func TestFederatedLoginRejects(t *testing.T) {
+	idp := newIdentityProvider(t)
+	misconfigured := mockProvider("misconfigured", idp, true, nil)
+	misconfigured.ClientSecret = "wrong-secret"
+	s := newTestServer(t,
+		mockProvider("mock", idp, true, nil),
+		mockProvider("invite-only", idp, false, nil),
+		misconfigured)
+
+	t.Run("wrong client secret", func(t *testing.T) {
+		if status, tok := s.federatedLogin(t, idp, "misconfigured", "mallory"); status != http.StatusUnauthorized {
+			t.Errorf("status = %d (%s), want 401", status, tok.Error)
+		}
+	})
+	t.Run("unlinked identity without provisioning", func(t *testing.T) {
+		if status, tok := s.federatedLogin(t, idp, "invite-only", "mallory"); status != http.StatusForbidden {
+			t.Errorf("status = %d (%s), want 403", status, tok.Error)
+		}
+	})
+	t.Run("tampered state", func(t *testing.T) {
+		client := browser(t)
+		callback := s.authorize(t, client, idp, "mock", "mallory")
+		q := callback.Query()
+		q.Set("state", "forged")
+		callback.RawQuery = q.Encode()
+		if resp := get(t, client, callback.String(), nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status = %s, want 400", resp.Status)
+		}
+	})
+	t.Run("callback in another browser", func(t *testing.T) {
+		callback := s.authorize(t, browser(t), idp, "mock", "mallory")
+		if resp := get(t, browser(t), callback.String(), nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status = %s, want 400", resp.Status)
+		}
+	})
+	t.Run("replayed callback", func(t *testing.T) {
+		client := browser(t)
+		callback := s.authorize(t, client, idp, "mock", "carol")
+		if resp := get(t, client, callback.String(), nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %s, want 200", resp.Status)
+		}
+		if resp := get(t, client, callback.String(), nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("replay status = %s, want 400", resp.Status)
+		}
+	})
+	t.Run("disabled account", func(t *testing.T) {
+		dave := s.mustFederatedLogin(t, idp, "dave")
+		u, err := s.users.FindByUsername(dave.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.users.SetDisabled(u.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if status, tok := s.federatedLogin(t, idp, "mock", "dave"); status != http.StatusUnauthorized || tok.AccessToken != "" {
+			t.Errorf("status = %d (%s), want 401", status, tok.Error)
+		}
+	})
+
+	if u, err := s.users.FindByUsername("mallory"); err != nil || u.Username != "" {
+		t.Errorf("rejected logins provisioned %q, err %v", u.Username, err)
+	}
+}
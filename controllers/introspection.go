@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"authgo/auth"
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isJWT reports whether token has the shape of a compact JWS
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Introspect handles POST /oauth/introspect (RFC 7662). Confidential clients,
+// such as resource servers, learn whether a token is active and what it grants.
+// Refresh tokens are only described to the client they were issued to.
+func (o *OAuthController) Introspect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	client, oerr := o.authenticateClient(c)
+	if oerr != nil {
+		writeOAuthError(c, oerr)
+		return
+	}
+	if client.Public {
+		writeOAuthError(c, newOAuthError(http.StatusUnauthorized, "invalid_client", "public clients may not introspect tokens"))
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_request", "token required"))
+		return
+	}
+
+	var (
+		resp gin.H
+		err  error
+	)
+	if data.IsAPIKey(token) || isJWT(token) {
+		resp, err = o.introspectAccessToken(token)
+	} else {
+		resp, err = o.introspectRefreshToken(client, token)
+	}
+	if err != nil {
+		writeOAuthError(c, newOAuthError(http.StatusInternalServerError, "server_error", "failed to introspect token"))
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// introspectAccessToken describes an access token or API key, applying the
+// same checks as requests authenticated with it
+func (o *OAuthController) introspectAccessToken(token string) (gin.H, error) {
+	p, err := o.validator.Authenticate(token)
+	if err != nil {
+		if auth.IsRejected(err) {
+			return gin.H{"active": false}, nil
+		}
+		return nil, err
+	}
+	resp := gin.H{
+		"active":     true,
+		"token_type": "Bearer",
+		"iss":        o.issuer,
+	}
+	if p.Method == auth.MethodClientCredentials {
+		resp["sub"] = p.ClientID
+	} else {
+		resp["sub"] = p.User.ID.Hex()
+		resp["username"] = p.User.Username
+		resp["roles"] = p.User.Roles
+	}
+	if p.ClientID != "" {
+		resp["client_id"] = p.ClientID
+	}
+	if p.Method != auth.MethodJWT {
+		resp["scope"] = strings.Join(p.Scopes, " ")
+	}
+	if p.JTI != "" {
+		resp["jti"] = p.JTI
+	}
+	if !p.ExpiresAt.IsZero() {
+		resp["exp"] = p.ExpiresAt.Unix()
+	}
+	if !p.IssuedAt.IsZero() {
+		resp["iat"] = p.IssuedAt.Unix()
+	}
+	return resp, nil
+}
+
+// introspectRefreshToken describes a refresh token issued to client
+func (o *OAuthController) introspectRefreshToken(client models.OAuthClient, token string) (gin.H, error) {
+	inactive := gin.H{"active": false}
+	rt, err := o.refreshSvc.Find(token)
+	if err != nil {
+		return nil, err
+	}
+	if rt.ClientID == "" || rt.ClientID != client.ClientID || rt.UsedAt != nil || rt.RevokedAt != nil || !rt.ExpiresAt.After(time.Now()) {
+		return inactive, nil
+	}
+	u, err := o.userSvc.GetByID(rt.UserID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if u.Username == "" || u.Disabled {
+		return inactive, nil
+	}
+	return gin.H{
+		"active":     true,
+		"token_type": "refresh_token",
+		"iss":        o.issuer,
+		"sub":        u.ID.Hex(),
+		"username":   u.Username,
+		"client_id":  rt.ClientID,
+		"scope":      rt.Scope,
+		"exp":        rt.ExpiresAt.Unix(),
+		"iat":        rt.CreatedAt.Unix(),
+	}, nil
+}
+
+// Revoke handles POST /oauth/revoke (RFC 7009). Clients can revoke access and
+// refresh tokens issued to them; revoking a refresh token revokes its whole
+// family. Unknown tokens and tokens of other clients are ignored.
+func (o *OAuthController) Revoke(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	client, oerr := o.authenticateClient(c)
+	if oerr != nil {
+		writeOAuthError(c, oerr)
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		writeOAuthError(c, newOAuthError(http.StatusBadRequest, "invalid_request", "token required"))
+		return
+	}
+	if data.IsAPIKey(token) {
+		writeOAuthError(c, newOAuthError(http.StatusBadRequest, "unsupported_token_type", "api keys are managed under /me/tokens"))
+		return
+	}
+
+	var err error
+	if isJWT(token) {
+		err = o.revokeAccessToken(client, token)
+	} else {
+		var rt models.RefreshToken
+		rt, err = o.refreshSvc.Find(token)
+		if err == nil && rt.ClientID != "" && rt.ClientID == client.ClientID {
+			err = o.refreshSvc.RevokeFamily(rt.FamilyID)
+		}
+	}
+	if err != nil {
+		writeOAuthError(c, newOAuthError(http.StatusInternalServerError, "server_error", "failed to revoke token"))
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// revokeAccessToken adds the jti of an access token issued to client to the
+// revocation list. Only the signature is checked, so tokens of since disabled
+// users can still be revoked.
+func (o *OAuthController) revokeAccessToken(client models.OAuthClient, token string) error {
+	claims, err := o.keys.Parse(token)
+	if err != nil || claims["token_use"] != "access" || claims["client_id"] != client.ClientID {
+		return nil
+	}
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		return nil
+	}
+	return o.revokeSvc.Revoke(jti, exp.Time)
+}
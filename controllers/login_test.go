@@ -0,0 +1,64 @@
+package controllers_test
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"authgo/models"
+)
+
+func TestLoginAfterRoleChange(t *testing.T) {
+	s := newTestServer(t)
+	s.register(t, "root", "correct horse battery staple")
+	old := s.register(t, "bob", "bob's long password")
+	s.me(t, old) // caches bob's account state
+
+	if _, err := s.users.PromoteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	tok := s.login(t, "bob", "bob's long password")
+	if u := s.me(t, tok.AccessToken); !slices.Contains(u.Roles, models.RoleAdmin) {
+		t.Errorf("roles = %v, want admin", u.Roles)
+	}
+	if status := s.call(t, http.MethodGet, "/me", old, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("token issued before the role change: %d, want 401", status)
+	}
+}
+
+func TestLogoutEndsTokensOfTheSameLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.register(t, "alice", "correct horse battery staple")
+	first := s.login(t, "alice", "correct horse battery staple")
+	var refreshed tokenResponse
+	if status := s.call(t, http.MethodPost, "/token/refresh", "", map[string]string{"refresh_token": first.RefreshToken}, &refreshed); status != http.StatusOK {
+		t.Fatalf("refresh: %d %s", status, refreshed.Error)
+	}
+	s.me(t, refreshed.AccessToken) // caches the session
+
+	if status := s.call(t, http.MethodPost, "/logout", first.AccessToken, nil, nil); status != http.StatusOK {
+		t.Fatalf("logout: %d", status)
+	}
+	if status := s.call(t, http.MethodGet, "/me", refreshed.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("token of the ended login: %d, want 401", status)
+	}
+}
+
+func TestPasswordConfirmationCountsTowardLockout(t *testing.T) {
+	s := newTestServer(t)
+	token := s.register(t, "alice", "correct horse battery staple")
+
+	for i := 0; i < 5; i++ {
+		change := map[string]string{"current_password": "guess", "new_password": "another long passphrase"}
+		if status := s.call(t, http.MethodPost, "/me/password", token, change, nil); status != http.StatusUnauthorized {
+			t.Fatalf("wrong current password %d: %d, want 401", i+1, status)
+		}
+	}
+	if status := s.call(t, http.MethodDelete, "/me", token, map[string]string{"password": "correct horse battery staple"}, nil); status != http.StatusTooManyRequests {
+		t.Errorf("delete with the right password while locked: %d, want 429", status)
+	}
+	body := map[string]string{"username": "alice", "password": "correct horse battery staple"}
+	if status := s.call(t, http.MethodPost, "/login", "", body, nil); status != http.StatusTooManyRequests {
+		t.Errorf("login while locked: %d, want 429", status)
+	}
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"authgo/notify"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RequestMagicLink handles POST /login/magic, sending a single-use sign-in
+// link to the user's email address. The response is the same whether or not
+// the address belongs to an account.
+func (ctl *Controller) RequestMagicLink(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email required"})
+		return
+	}
+	accepted := gin.H{"message": "if an account uses this address, a sign-in link has been sent"}
+
+	u, err := ctl.userSvc.FindByEmail(input.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send sign-in link"})
+		return
+	}
+	if u.Username == "" || u.Disabled {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+	jti, err := newJTI()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send sign-in link"})
+		return
+	}
+	// ver ties the link to the current token version, so revoking all
+	// sessions also invalidates outstanding links
+	now := time.Now()
+	token, err := ctl.keys.Sign(jwt.MapClaims{
+		"sub":       u.ID.Hex(),
+		"token_use": "magic",
+		"jti":       jti,
+		"ver":       u.TokenVersion,
+		"email":     u.Email,
+		"iat":       now.Unix(),
+		"exp":       now.Add(ctl.magicTTL).Unix(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send sign-in link"})
+		return
+	}
+	link := ctl.magicURL + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Open this link within %s to sign in as %s:\n\n%s\n\nIf you did not ask to sign in, ignore this message.\n", ctl.magicTTL, u.Username, link)
+	msg := notify.Message{To: u.Email, Subject: "Your sign-in link", Body: body}
+	if err := ctl.notifier.Send(msg); err != nil {
+		log.Printf("failed to deliver sign-in link for %s: %v", u.Username, err)
+	}
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+// VerifyMagicLink handles GET /login/magic/verify?token=, exchanging a sign-in
+// link for the same response as POST /login. Each link works once.
+func (ctl *Controller) VerifyMagicLink(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	invalid := gin.H{"error": "invalid or expired sign-in link"}
+
+	claims, err := ctl.keys.Parse(c.Query("token"))
+	if err != nil || claims["token_use"] != "magic" {
+		c.JSON(http.StatusUnauthorized, invalid)
+		return
+	}
+	jti, _ := claims["jti"].(string)
+	sub, _ := claims["sub"].(string)
+	version, okVer := claims["ver"].(float64)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || sub == "" || !okVer || err != nil || exp == nil {
+		c.JSON(http.StatusUnauthorized, invalid)
+		return
+	}
+	u, err := ctl.userSvc.GetByID(sub)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return
+	}
+	if u.Username == "" || u.Disabled || u.TokenVersion != int(version) {
+		c.JSON(http.StatusUnauthorized, invalid)
+		return
+	}
+	first, err := ctl.revokeSvc.RevokeOnce(jti, exp.Time)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return
+	}
+	if !first {
+		c.JSON(http.StatusUnauthorized, invalid)
+		return
+	}
+	// the link was delivered to the address, which proves the user owns it
+	if email, _ := claims["email"].(string); email != "" && email == u.Email && !u.EmailVerified {
+		verified, err := ctl.userSvc.MarkEmailVerified(u.ID, email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+			return
+		}
+		if verified.Username != "" {
+			u = verified
+		}
+	}
+	ctl.completeLogin(c, u)
+}
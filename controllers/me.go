@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func toUserResponse(u models.User) models.UserResponse {
+	return models.UserResponse{
+		ID:       u.ID.Hex(),
+		Username: u.Username,
+		Email:    u.Email,
+		Roles:    u.Roles,
+		Disabled: u.Disabled,
+
+		EmailVerified: u.EmailVerified,
+		MFAEnabled:    u.MFAEnabled,
+	}
+}
+
+// currentUser loads the authenticated user named by the "username" context
+// value; it writes the error response and returns false on failure
+func (ctl *Controller) currentUser(c *gin.Context) (models.User, bool) {
+	u, err := ctl.userSvc.FindByUsername(c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return models.User{}, false
+	}
+	if u.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return models.User{}, false
+	}
+	return u, true
+}
+
+// GetMe handles GET /me (authenticated)
+func (ctl *Controller) GetMe(c *gin.Context) {
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toUserResponse(u))
+}
+
+// UpdateMe handles PATCH /me (authenticated). An empty email removes the address.
+func (ctl *Controller) UpdateMe(c *gin.Context) {
+	var input struct {
+		Username string  `json:"username"`
+		Email    *string `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json"})
+		return
+	}
+	if input.Username == "" && input.Email == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
+		return
+	}
+	if input.Email != nil && *input.Email != "" {
+		if _, err := data.NormalizeEmail(*input.Email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	updated := u
+	var err error
+	if input.Username != "" {
+		updated, err = ctl.userSvc.UpdateUsername(u.ID, input.Username)
+		if err != nil {
+			if errors.Is(err, data.ErrUsernameTaken) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+			return
+		}
+	}
+	if input.Email != nil && updated.Username != "" && !sameEmail(*input.Email, u.Email) {
+		updated, err = ctl.userSvc.UpdateEmail(u.ID, *input.Email)
+		if err != nil {
+			if errors.Is(err, data.ErrEmailTaken) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+			return
+		}
+		// a new address has to be verified again
+		if updated.Email != "" {
+			ctl.sendEmailVerification(updated)
+		}
+	}
+	if updated.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	c.JSON(http.StatusOK, toUserResponse(updated))
+}
+
+// sameEmail reports whether the requested address equals the current one,
+// which keeps its verified state
+func sameEmail(requested, current string) bool {
+	if requested == "" {
+		return current == ""
+	}
+	normalized, err := data.NormalizeEmail(requested)
+	return err == nil && normalized == current
+}
+
+// ChangePassword handles POST /me/password (authenticated). All existing
+// sessions are revoked and a fresh token pair is returned for the caller. A
+// wrong current password counts toward the login lockout.
+func (ctl *Controller) ChangePassword(c *gin.Context) {
+	var input struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "current_password and new_password required"})
+		return
+	}
+	username := c.GetString("username")
+	if !ctl.checkLockout(c, username) {
+		return
+	}
+	u, err := ctl.userSvc.Authenticate(username, input.CurrentPassword)
+	if err != nil {
+		if !errors.Is(err, data.ErrUserDisabled) {
+			ctl.recordFailure(c, username)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+		return
+	}
+	updated, err := ctl.userSvc.SetPassword(u.ID, input.NewPassword)
+	if err != nil {
+		if writePolicyError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change password"})
+		return
+	}
+	if updated.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err := ctl.refreshSvc.RevokeUser(updated.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	resp, err := ctl.newSession(c, updated)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// DeleteMe handles DELETE /me (authenticated); the password must be confirmed.
+// The last active admin cannot delete their account.
+func (ctl *Controller) DeleteMe(c *gin.Context) {
+	var input struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password required"})
+		return
+	}
+	u, ok := ctl.confirmPassword(c, input.Password)
+	if !ok {
+		return
+	}
+	ok, err := ctl.userSvc.DeleteUser(u.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrLastAdmin) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete account"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err := ctl.refreshSvc.RevokeUser(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	if err := ctl.apiKeySvc.DeleteByUser(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete api keys"})
+		return
+	}
+	if err := ctl.sessionSvc.DeleteByUser(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "account deleted"})
+}
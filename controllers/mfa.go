@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"authgo/models"
+	"authgo/totp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// mfaChallengeTTL is how long a user has to complete the second login step
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// completeLogin responds to a successful primary authentication: with an MFA
+// challenge when the user has TOTP or a passkey, otherwise with a new session.
+// Users who must verify their email first are refused. Failed attempts are
+// only forgiven once a session is issued, so that the second factor stays
+// under the lockout.
+func (ctl *Controller) completeLogin(c *gin.Context, u models.User) {
+	if ctl.blockUnverified(c, u) {
+		return
+	}
+	if u.HasSecondFactor() {
+		challenge, err := ctl.mfaChallenge(u)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+			return
+		}
+		var methods []string
+		if u.MFAEnabled {
+			methods = append(methods, "totp")
+		}
+		if len(u.WebAuthnCredentials) > 0 {
+			methods = append(methods, "webauthn")
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"mfa_methods":  methods,
+			"expires_in":   int(mfaChallengeTTL.Seconds()),
+		})
+		return
+	}
+	if err := ctl.attemptSvc.ResetAccount(u.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return
+	}
+	resp, err := ctl.newSession(c, u)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// mfaChallenge returns a short-lived, single-use token proving that u passed
+// the first login step. It cannot be used as an access token.
+func (ctl *Controller) mfaChallenge(u models.User) (string, error) {
+	jti, err := newJTI()
+	if err != nil {
+		return "", err
+	}
+	return ctl.keys.Sign(jwt.MapClaims{
+		"sub":       u.ID.Hex(),
+		"token_use": "mfa",
+		"jti":       jti,
+		"exp":       time.Now().Add(mfaChallengeTTL).Unix(),
+		"nbf":       time.Now().Unix(),
+	})
+}
+
+// parseMFAChallenge returns the user an unused MFA challenge token was issued
+// to, with the token's jti and expiry, or a zero user if the token is invalid
+// or the user can no longer log in with a second factor
+func (ctl *Controller) parseMFAChallenge(token string) (models.User, string, time.Time, error) {
+	claims, err := ctl.keys.Parse(token)
+	if err != nil || claims["token_use"] != "mfa" {
+		return models.User{}, "", time.Time{}, nil
+	}
+	jti, _ := claims["jti"].(string)
+	sub, _ := claims["sub"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || sub == "" || err != nil || exp == nil {
+		return models.User{}, "", time.Time{}, nil
+	}
+	revoked, err := ctl.revokeSvc.IsRevoked(jti)
+	if err != nil {
+		return models.User{}, "", time.Time{}, err
+	}
+	u, err := ctl.userSvc.GetByID(sub)
+	if err != nil {
+		return models.User{}, "", time.Time{}, err
+	}
+	if revoked || u.Username == "" || u.Disabled || !u.HasSecondFactor() {
+		return models.User{}, "", time.Time{}, nil
+	}
+	return u, jti, exp.Time, nil
+}
+
+// LoginMFA handles POST /login/mfa, exchanging an MFA challenge token and a
+// TOTP or recovery code for the regular login response
+func (ctl *Controller) LoginMFA(c *gin.Context) {
+	var input struct {
+		MFAToken     string `json:"mfa_token" binding:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Code == "" && input.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mfa_token and code or recovery_code required"})
+		return
+	}
+	u, jti, exp, err := ctl.parseMFAChallenge(input.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	if u.Username == "" || !u.MFAEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid mfa token"})
+		return
+	}
+	// wrong codes count towards the same lockout as wrong passwords
+	if !ctl.checkLockout(c, u.Username) {
+		return
+	}
+
+	ok := false
+	if input.Code != "" {
+		if step, valid := totp.Validate(u.TOTPSecret, input.Code, time.Now(), 1); valid {
+			ok, err = ctl.userSvc.UseTOTPStep(u.ID, step)
+		}
+	} else {
+		ok, err = ctl.userSvc.UseRecoveryCode(u.ID, normalizeRecoveryCode(input.RecoveryCode))
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	if !ok {
+		ctl.recordFailure(c, u.Username)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+	if err := ctl.attemptSvc.ResetAccount(u.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+
+	// the challenge is single-use
+	if err := ctl.revokeSvc.Revoke(jti, exp); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	u.PasswordHash = ""
+	resp, err := ctl.newSession(c, u)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// EnrollTOTP handles POST /me/mfa/totp/enroll (authenticated). It returns a new
+// secret that only becomes active once confirmed with a valid code.
+func (ctl *Controller) EnrollTOTP(c *gin.Context) {
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	if u.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication already enabled"})
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+		return
+	}
+	if err := ctl.userSvc.SetPendingTOTP(u.ID, secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start enrollment"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(ctl.totpIssuer, u.Username, secret),
+	})
+}
+
+// ConfirmTOTP handles POST /me/mfa/totp/confirm (authenticated). A valid code
+// for the pending secret enables two-factor authentication; the recovery codes
+// are returned only in this response.
+func (ctl *Controller) ConfirmTOTP(c *gin.Context) {
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code required"})
+		return
+	}
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	if u.TOTPPendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no pending enrollment"})
+		return
+	}
+	step, valid := totp.Validate(u.TOTPPendingSecret, input.Code, time.Now(), 1)
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+		return
+	}
+	codes, stored, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+	enabled, err := ctl.userSvc.EnableTOTP(u.ID, u.TOTPPendingSecret, step, stored)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable two-factor authentication"})
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "enrollment changed, start again"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mfa_enabled": true, "recovery_codes": codes})
+}
+
+// DisableTOTP handles DELETE /me/mfa/totp (authenticated); the password must be confirmed
+func (ctl *Controller) DisableTOTP(c *gin.Context) {
+	var input struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password required"})
+		return
+	}
+	u, ok := ctl.confirmPassword(c, input.Password)
+	if !ok {
+		return
+	}
+	if err := ctl.userSvc.DisableMFA(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mfa_enabled": false})
+}
+
+// newRecoveryCodes returns codes formatted for display and their normalized
+// form to be stored
+func newRecoveryCodes() ([]string, []string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	display := make([]string, 0, recoveryCodeCount)
+	stored := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(enc.EncodeToString(b))
+		display = append(display, code[:4]+"-"+code[4:])
+		stored = append(stored, code)
+	}
+	return display, stored, nil
+}
+
+// normalizeRecoveryCode strips formatting so "ABCD-EFGH" matches "abcdefgh"
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
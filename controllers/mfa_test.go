@@ -0,0 +1,49 @@
+package controllers_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"authgo/totp"
+)
+
+// enrollTOTP turns on two-factor authentication for the account signed in
+// with token and returns the secret
+func (s *testServer) enrollTOTP(t *testing.T, token string) string {
+	t.Helper()
+	var enroll struct {
+		Secret string `json:"secret"`
+	}
+	if status := s.call(t, http.MethodPost, "/me/mfa/totp/enroll", token, nil, &enroll); status != http.StatusOK {
+		t.Fatalf("enroll: %d", status)
+	}
+	code, err := totp.Code(enroll.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := s.call(t, http.MethodPost, "/me/mfa/totp/confirm", token, map[string]string{"code": code}, nil); status != http.StatusOK {
+		t.Fatalf("confirm: %d", status)
+	}
+	return enroll.Secret
+}
+
+func TestWrongCodesLockAccountDespitePasswordLogins(t *testing.T) {
+	s := newTestServer(t)
+	s.enrollTOTP(t, s.register(t, "alice", "correct horse battery staple"))
+
+	for i := 0; i < 5; i++ {
+		challenge := s.login(t, "alice", "correct horse battery staple")
+		if challenge.MFAToken == "" {
+			t.Fatalf("login %d: want an MFA challenge", i+1)
+		}
+		body := map[string]string{"mfa_token": challenge.MFAToken, "code": "000000"}
+		if status := s.call(t, http.MethodPost, "/login/mfa", "", body, nil); status != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: %d, want 401", i+1, status)
+		}
+	}
+	body := map[string]string{"username": "alice", "password": "correct horse battery staple"}
+	if status := s.call(t, http.MethodPost, "/login", "", body, nil); status != http.StatusTooManyRequests {
+		t.Errorf("login after repeated wrong codes: %d, want 429", status)
+	}
+}
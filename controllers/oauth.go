@@ -0,0 +1,684 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"authgo/auth"
+	"authgo/data"
+	"authgo/models"
+	"authgo/totp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OAuthController implements the OAuth 2.0 authorization server endpoints on
+// top of the regular user login
+type OAuthController struct {
+	*Controller
+	clients *data.OAuthClientService
+	codes   *data.AuthorizationCodeService
+	devices *data.DeviceCodeService
+	// validator checks access tokens presented for introspection, and is told
+	// about deleted clients
+	validator *auth.Validator
+}
+
+// NewOAuthController constructs OAuthController
+func NewOAuthController(ctl *Controller, clients *data.OAuthClientService, codes *data.AuthorizationCodeService,
+	devices *data.DeviceCodeService, v *auth.Validator) *OAuthController {
+	return &OAuthController{
+		Controller: ctl,
+		clients:    clients,
+		codes:      codes,
+		devices:    devices,
+		validator:  v,
+	}
+}
+
+// oauthError is an RFC 6749 error response
+type oauthError struct {
+	status      int
+	code        string
+	description string
+}
+
+func newOAuthError(status int, code, description string) *oauthError {
+	return &oauthError{status: status, code: code, description: description}
+}
+
+// writeOAuthError responds with the JSON error body defined by RFC 6749 section 5.2
+func writeOAuthError(c *gin.Context, err *oauthError) {
+	c.JSON(err.status, gin.H{"error": err.code, "error_description": err.description})
+}
+
+// authorizeRequest holds the parameters of an authorization request, sent as
+// query parameters to GET /oauth/authorize and echoed by the consent form
+type authorizeRequest struct {
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	ResponseType        string `form:"response_type"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+	Nonce               string `form:"nonce"`
+}
+
+// consentPage is rendered by /oauth/authorize. The user signs in and approves
+// the client in one step.
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in to {{.Client.Name}}</title></head>
+<body>
+<h1>{{.Client.Name}} wants to access your account</h1>
+{{if .Scopes}}<p>It is requesting:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<label>Username <input name="username" autocomplete="username" required></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<label>Authentication code (if enabled) <input name="code" autocomplete="one-time-code"></label>
+<button type="submit" name="action" value="approve">Allow</button>
+<button type="submit" name="action" value="deny" formnovalidate>Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// errorPage is shown when the request cannot safely be redirected back to the client
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorization error</title></head>
+<body><h1>Authorization error</h1><p>{{.}}</p></body>
+</html>
+`))
+
+// authorization is a validated authorization request
+type authorization struct {
+	client      models.OAuthClient
+	redirectURI string
+	scope       string
+}
+
+// Authorize handles GET /oauth/authorize, showing the sign-in and consent page
+func (o *OAuthController) Authorize(c *gin.Context) {
+	var req authorizeRequest
+	_ = c.ShouldBindQuery(&req)
+	az, ok := o.validateAuthorize(c, req)
+	if !ok {
+		return
+	}
+	o.renderConsent(c, http.StatusOK, req, az, "")
+}
+
+// AuthorizeSubmit handles POST /oauth/authorize. On approval with valid
+// credentials the user agent is redirected back to the client with a code.
+func (o *OAuthController) AuthorizeSubmit(c *gin.Context) {
+	var req authorizeRequest
+	_ = c.ShouldBind(&req)
+	az, ok := o.validateAuthorize(c, req)
+	if !ok {
+		return
+	}
+	if c.PostForm("action") != "approve" {
+		redirectWithParams(c, az.redirectURI, url.Values{
+			"error":             {"access_denied"},
+			"error_description": {"the user denied the request"},
+			"state":             {req.State},
+		})
+		return
+	}
+
+	username, password := c.PostForm("username"), c.PostForm("password")
+	wait, err := o.attemptSvc.LockedFor(username, c.ClientIP())
+	if err != nil {
+		o.renderConsent(c, http.StatusInternalServerError, req, az, "Sign in failed, please try again.")
+		return
+	}
+	if wait > 0 {
+		o.renderConsent(c, http.StatusTooManyRequests, req, az, "Too many failed sign-in attempts, try again later.")
+		return
+	}
+	u, err := o.authn.Authenticate(username, password)
+	if errors.Is(err, data.ErrUserDisabled) {
+		o.renderConsent(c, http.StatusUnauthorized, req, az, "This account is disabled.")
+		return
+	}
+	if err != nil {
+		o.recordFailure(c, username)
+		o.renderConsent(c, http.StatusUnauthorized, req, az, "Invalid username or password.")
+		return
+	}
+	if status, message, ok := o.checkSecondFactor(c, u); !ok {
+		o.renderConsent(c, status, req, az, message)
+		return
+	}
+	if err := o.attemptSvc.ResetAccount(u.Username); err != nil {
+		o.renderConsent(c, http.StatusInternalServerError, req, az, "Sign in failed, please try again.")
+		return
+	}
+	if o.loginBlocked(u) {
+		o.renderConsent(c, http.StatusForbidden, req, az, "Verify your email address before signing in.")
+		return
+	}
+
+	code, err := o.codes.Create(models.AuthorizationCode{
+		ClientID:            az.client.ClientID,
+		UserID:              u.ID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               az.scope,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		Nonce:               req.Nonce,
+		AuthTime:            time.Now(),
+	})
+	if err != nil {
+		redirectWithParams(c, az.redirectURI, url.Values{"error": {"server_error"}, "state": {req.State}})
+		return
+	}
+	redirectWithParams(c, az.redirectURI, url.Values{"code": {code}, "state": {req.State}})
+}
+
+// checkSecondFactor checks the authentication code posted with a consent or
+// device approval. Passkeys cannot be used on these pages, so accounts whose
+// only second factor is a passkey are refused rather than signed in with the
+// password alone. On failure it returns the status and message to show.
+func (o *OAuthController) checkSecondFactor(c *gin.Context, u models.User) (int, string, bool) {
+	if !u.HasSecondFactor() {
+		return 0, "", true
+	}
+	if !u.MFAEnabled {
+		return http.StatusForbidden, "This account requires a passkey, which cannot be used here. Set up an authenticator app to sign in on this page.", false
+	}
+	ok, err := o.verifySecondFactor(u, c.PostForm("code"))
+	if err != nil {
+		return http.StatusInternalServerError, "Sign in failed, please try again.", false
+	}
+	if !ok {
+		o.recordFailure(c, u.Username)
+		return http.StatusUnauthorized, "Invalid authentication code.", false
+	}
+	return 0, "", true
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code, for u
+func (o *OAuthController) verifySecondFactor(u models.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if step, valid := totp.Validate(u.TOTPSecret, code, time.Now(), 1); valid {
+		return o.userSvc.UseTOTPStep(u.ID, step)
+	}
+	return o.userSvc.UseRecoveryCode(u.ID, normalizeRecoveryCode(code))
+}
+
+// validateAuthorize checks an authorization request. Errors about the client
+// or redirect URI are shown to the user; anything else is sent back to the
+// client. It returns false if a response was written.
+func (o *OAuthController) validateAuthorize(c *gin.Context, req authorizeRequest) (authorization, bool) {
+	client, err := o.clients.Find(req.ClientID)
+	if err != nil {
+		renderErrorPage(c, http.StatusInternalServerError, "The request could not be processed, please try again.")
+		return authorization{}, false
+	}
+	if client.ClientID == "" {
+		renderErrorPage(c, http.StatusBadRequest, "Unknown client.")
+		return authorization{}, false
+	}
+	// redirect URIs must match a registered one exactly; the parameter may
+	// only be omitted when the client has registered a single URI
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		renderErrorPage(c, http.StatusBadRequest, "The redirect URI is not registered for this client.")
+		return authorization{}, false
+	}
+
+	fail := func(code, description string) (authorization, bool) {
+		redirectWithParams(c, redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {req.State},
+		})
+		return authorization{}, false
+	}
+	if req.ResponseType != "code" {
+		return fail("unsupported_response_type", "response_type must be code")
+	}
+	if !slices.Contains(client.GrantTypes, models.GrantAuthorizationCode) {
+		return fail("unauthorized_client", "the client may not use the authorization code grant")
+	}
+	scope, ok := grantScope(req.Scope, client.Scopes)
+	if !ok {
+		return fail("invalid_scope", "the requested scope is not allowed for this client")
+	}
+	// the plain method would send the verifier itself through the browser
+	if req.CodeChallengeMethod != "" && req.CodeChallengeMethod != "S256" {
+		return fail("invalid_request", "unsupported code_challenge_method, only S256 is allowed")
+	}
+	if req.CodeChallenge == "" && (client.Public || req.CodeChallengeMethod != "") {
+		return fail("invalid_request", "code_challenge required")
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod == "" {
+		return fail("invalid_request", "code_challenge_method S256 required")
+	}
+	return authorization{client: client, redirectURI: redirectURI, scope: scope}, true
+}
+
+// renderConsent shows the sign-in and consent page, optionally with an error
+func (o *OAuthController) renderConsent(c *gin.Context, status int, req authorizeRequest, az authorization, message string) {
+	// the page accepts credentials and must not be framed
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	_ = consentPage.Execute(c.Writer, gin.H{
+		"Client":  az.client,
+		"Scopes":  strings.Fields(az.scope),
+		"Request": req,
+		"Error":   message,
+	})
+}
+
+func renderErrorPage(c *gin.Context, status int, message string) {
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	_ = errorPage.Execute(c.Writer, message)
+}
+
+// redirectWithParams redirects to a registered client URI with params added
+// to its query, dropping empty values
+func redirectWithParams(c *gin.Context, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		renderErrorPage(c, http.StatusBadRequest, "Invalid redirect URI.")
+		return
+	}
+	q := u.Query()
+	for k, vs := range params {
+		if len(vs) > 0 && vs[0] != "" {
+			q.Set(k, vs[0])
+		}
+	}
+	u.RawQuery = q.Encode()
+	c.Redirect(http.StatusSeeOther, u.String())
+}
+
+// grantScope resolves a space-separated requested scope against the scopes
+// allowed for a client. An empty request grants everything allowed.
+func grantScope(requested string, allowed []string) (string, bool) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return strings.Join(allowed, " "), true
+	}
+	for _, s := range scopes {
+		if !slices.Contains(allowed, s) {
+			return "", false
+		}
+	}
+	return strings.Join(slices.Compact(slices.Sorted(slices.Values(scopes))), " "), true
+}
+
+// Token handles POST /oauth/token for the authorization_code, refresh_token,
+// client_credentials and device_code grants
+func (o *OAuthController) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, oerr := o.authenticateClient(c)
+	if oerr != nil {
+		writeOAuthError(c, oerr)
+		return
+	}
+	grant := c.PostForm("grant_type")
+	if !slices.Contains(models.OAuthGrantTypes, grant) {
+		writeOAuthError(c, newOAuthError(http.StatusBadRequest, "unsupported_grant_type", "unsupported grant_type"))
+		return
+	}
+	if !slices.Contains(client.GrantTypes, grant) {
+		writeOAuthError(c, newOAuthError(http.StatusBadRequest, "unauthorized_client", "the client may not use this grant type"))
+		return
+	}
+
+	var resp gin.H
+	switch grant {
+	case models.GrantAuthorizationCode:
+		resp, oerr = o.exchangeCode(c, client)
+	case models.GrantRefreshToken:
+		resp, oerr = o.exchangeRefreshToken(c, client)
+	case models.GrantClientCredentials:
+		resp, oerr = o.clientCredentials(c, client)
+	case models.GrantDeviceCode:
+		resp, oerr = o.exchangeDeviceCode(c, client)
+	}
+	if oerr != nil {
+		writeOAuthError(c, oerr)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// authenticateClient reads client credentials from HTTP Basic authentication
+// or the client_id and client_secret form fields
+func (o *OAuthController) authenticateClient(c *gin.Context) (models.OAuthClient, *oauthError) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// credentials are form-encoded before being put in the header
+		var err1, err2 error
+		clientID, err1 = url.QueryUnescape(clientID)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return models.OAuthClient{}, newOAuthError(http.StatusBadRequest, "invalid_request", "malformed client credentials")
+		}
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	if clientID == "" {
+		return models.OAuthClient{}, newOAuthError(http.StatusUnauthorized, "invalid_client", "client authentication required")
+	}
+	client, err := o.clients.Authenticate(clientID, secret)
+	if err != nil {
+		if errors.Is(err, data.ErrClientInvalid) {
+			if basic {
+				c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+			}
+			return models.OAuthClient{}, newOAuthError(http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		}
+		return models.OAuthClient{}, newOAuthError(http.StatusInternalServerError, "server_error", "failed to authenticate client")
+	}
+	return client, nil
+}
+
+// exchangeCode redeems an authorization code. A code presented twice revokes
+// the refresh tokens issued for it.
+func (o *OAuthController) exchangeCode(c *gin.Context, client models.OAuthClient) (gin.H, *oauthError) {
+	invalid := newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+	ac, err := o.codes.Consume(c.PostForm("code"))
+	if err != nil {
+		if errors.Is(err, data.ErrCodeReused) {
+			if ac.FamilyID != "" {
+				_ = o.refreshSvc.RevokeFamily(ac.FamilyID)
+			}
+			return nil, invalid
+		}
+		if errors.Is(err, data.ErrCodeInvalid) {
+			return nil, invalid
+		}
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to redeem code")
+	}
+	if ac.ClientID != client.ClientID || ac.RedirectURI != c.PostForm("redirect_uri") {
+		return nil, invalid
+	}
+	if !verifyPKCE(ac.CodeChallenge, ac.CodeChallengeMethod, c.PostForm("code_verifier")) {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code challenge")
+	}
+
+	u, err := o.userSvc.GetByID(ac.UserID.Hex())
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to redeem code")
+	}
+	if u.Username == "" || u.Disabled {
+		return nil, invalid
+	}
+	refresh := ""
+	if slices.Contains(strings.Fields(ac.Scope), models.ScopeOfflineAccess) && slices.Contains(client.GrantTypes, models.GrantRefreshToken) {
+		token, rt, err := o.refreshSvc.IssueForClient(u.ID, client.ClientID, ac.Scope, ac.AuthTime)
+		if err != nil {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+		}
+		if err := o.codes.SetFamily(ac.ID, rt.FamilyID); err != nil {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+		}
+		refresh = token
+	}
+	return o.oauthTokenResponse(u, client.ClientID, ac.Scope, refresh, ac.Nonce, ac.AuthTime)
+}
+
+// verifyPKCE checks the code verifier against the S256 challenge sent to
+// /oauth/authorize (RFC 7636)
+func verifyPKCE(challenge, method, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	if method != "S256" || len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// exchangeRefreshToken rotates a refresh token issued to the client. The
+// optional scope parameter narrows the scope of the new access token.
+func (o *OAuthController) exchangeRefreshToken(c *gin.Context, client models.OAuthClient) (gin.H, *oauthError) {
+	invalid := newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+	refresh, rt, err := o.refreshSvc.Rotate(c.PostForm("refresh_token"), client.ClientID)
+	if err != nil {
+		if errors.Is(err, data.ErrRefreshTokenInvalid) || errors.Is(err, data.ErrRefreshTokenReused) {
+			return nil, invalid
+		}
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to refresh token")
+	}
+	scope, ok := grantScope(c.PostForm("scope"), strings.Fields(rt.Scope))
+	if !ok {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_scope", "scope exceeds the original grant")
+	}
+	u, err := o.userSvc.GetByID(rt.UserID.Hex())
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to refresh token")
+	}
+	if u.Username == "" || u.Disabled {
+		_ = o.refreshSvc.RevokeFamily(rt.FamilyID)
+		return nil, invalid
+	}
+	return o.oauthTokenResponse(u, client.ClientID, scope, refresh, "", rt.AuthTime)
+}
+
+// clientCredentials issues a token to a confidential client acting on its own
+// behalf. Such tokens have no user and no refresh token.
+func (o *OAuthController) clientCredentials(c *gin.Context, client models.OAuthClient) (gin.H, *oauthError) {
+	if client.Public {
+		return nil, newOAuthError(http.StatusBadRequest, "unauthorized_client", "public clients may not use client_credentials")
+	}
+	// clients registered before scopes were limited may hold others
+	allowed := slices.DeleteFunc(slices.Clone(client.Scopes), func(s string) bool {
+		return !slices.Contains(models.ClientCredentialsScopes, s)
+	})
+	scope, ok := grantScope(c.PostForm("scope"), allowed)
+	if !ok || scope == "" {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_scope", "the requested scope is not allowed for this client")
+	}
+	jti, err := newJTI()
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+	}
+	tok, err := o.keys.Sign(jwt.MapClaims{
+		"sub":       client.ClientID,
+		"client_id": client.ClientID,
+		"gty":       models.GrantClientCredentials,
+		"scope":     scope,
+		"token_use": "access",
+		"jti":       jti,
+		"exp":       time.Now().Add(o.accessTTL).Unix(),
+		"iat":       time.Now().Unix(),
+		"nbf":       time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+	}
+	return gin.H{
+		"access_token": tok,
+		"token_type":   "Bearer",
+		"expires_in":   int(o.accessTTL.Seconds()),
+		"scope":        scope,
+	}, nil
+}
+
+// oauthTokenResponse builds the RFC 6749 token response for a user's grant to
+// a client, with an ID token when the openid scope was granted
+func (o *OAuthController) oauthTokenResponse(u models.User, clientID, scope, refreshToken, nonce string, authTime time.Time) (gin.H, *oauthError) {
+	tok, err := tokenForUser(u, o.keys, o.accessTTL, clientID, scope, "")
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+	}
+	resp := gin.H{
+		"access_token": tok,
+		"token_type":   "Bearer",
+		"expires_in":   int(o.accessTTL.Seconds()),
+		"scope":        scope,
+	}
+	if refreshToken != "" {
+		resp["refresh_token"] = refreshToken
+	}
+	if slices.Contains(strings.Fields(scope), models.ScopeOpenID) {
+		idToken, err := o.idToken(u, clientID, scope, nonce, authTime, tok)
+		if err != nil {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", "failed to issue token")
+		}
+		resp["id_token"] = idToken
+	}
+	return resp, nil
+}
+
+// CreateClient handles POST /oauth/clients (clients:manage). The client secret is
+// only returned in this response.
+func (o *OAuthController) CreateClient(c *gin.Context) {
+	var input struct {
+		Name         string   `json:"name" binding:"required"`
+		RedirectURIs []string `json:"redirect_uris"`
+		GrantTypes   []string `json:"grant_types"`
+		Scopes       []string `json:"scopes"`
+		Public       bool     `json:"public"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name required"})
+		return
+	}
+	if len(input.GrantTypes) == 0 {
+		input.GrantTypes = []string{models.GrantAuthorizationCode, models.GrantRefreshToken}
+	}
+	if len(input.Scopes) == 0 {
+		input.Scopes = []string{models.ScopeTasksRead}
+	}
+	for _, g := range input.GrantTypes {
+		if !slices.Contains(models.OAuthGrantTypes, g) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown grant type " + g, "allowed_grant_types": models.OAuthGrantTypes})
+			return
+		}
+	}
+	for _, s := range input.Scopes {
+		if !slices.Contains(models.OAuthScopes, s) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + s, "allowed_scopes": models.OAuthScopes})
+			return
+		}
+	}
+	if input.Public && slices.Contains(input.GrantTypes, models.GrantClientCredentials) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "public clients cannot use client_credentials"})
+		return
+	}
+	if slices.Contains(input.GrantTypes, models.GrantClientCredentials) && slices.Contains(input.Scopes, models.ScopeUsersManage) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "client_credentials clients cannot have scope " + models.ScopeUsersManage})
+		return
+	}
+	if slices.Contains(input.GrantTypes, models.GrantAuthorizationCode) && len(input.RedirectURIs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect_uris required for authorization_code"})
+		return
+	}
+	for _, uri := range input.RedirectURIs {
+		if !validRedirectURI(uri) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid redirect uri " + uri})
+			return
+		}
+	}
+
+	secret, client, err := o.clients.Create(models.OAuthClient{
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		GrantTypes:   slices.Compact(slices.Sorted(slices.Values(input.GrantTypes))),
+		Scopes:       slices.Compact(slices.Sorted(slices.Values(input.Scopes))),
+		Public:       input.Public,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create client"})
+		return
+	}
+	resp := gin.H{"client": client}
+	if secret != "" {
+		resp["client_secret"] = secret
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// validRedirectURI accepts absolute https URIs without a fragment, and plain
+// http only for loopback addresses
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+// ListClients handles GET /oauth/clients (clients:manage)
+func (o *OAuthController) ListClients(c *gin.Context) {
+	clients, err := o.clients.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch clients"})
+		return
+	}
+	if clients == nil {
+		clients = []models.OAuthClient{}
+	}
+	c.JSON(http.StatusOK, clients)
+}
+
+// DeleteClient handles DELETE /oauth/clients/:client_id (clients:manage). Refresh
+// tokens issued to the client are revoked and its access tokens rejected; other
+// instances reject them once they no longer have the client cached.
+func (o *OAuthController) DeleteClient(c *gin.Context) {
+	clientID := c.Param("client_id")
+	ok, err := o.clients.Delete(clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete client"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "client not found"})
+		return
+	}
+	o.validator.ForgetClient(clientID)
+	if err := o.refreshSvc.RevokeClient(clientID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke client tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "client deleted"})
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"authgo/models"
+	"authgo/tokens"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Discovery handles GET /.well-known/openid-configuration (OpenID Connect Discovery 1.0)
+func (o *OAuthController) Discovery(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                        o.issuer,
+		"authorization_endpoint":                        o.issuer + "/oauth/authorize",
+		"token_endpoint":                                o.issuer + "/oauth/token",
+		"userinfo_endpoint":                             o.issuer + "/userinfo",
+		"introspection_endpoint":                        o.issuer + "/oauth/introspect",
+		"revocation_endpoint":                           o.issuer + "/oauth/revoke",
+		"device_authorization_endpoint":                 o.issuer + "/oauth/device/code",
+		"jwks_uri":                                      o.issuer + "/.well-known/jwks.json",
+		"scopes_supported":                              models.OAuthScopes,
+		"response_types_supported":                      []string{"code"},
+		"response_modes_supported":                      []string{"query"},
+		"grant_types_supported":                         models.OAuthGrantTypes,
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         []string{o.keys.Algorithm()},
+		"token_endpoint_auth_methods_supported":         []string{"client_secret_basic", "client_secret_post", "none"},
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":    []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":              []string{"S256"},
+		"claims_supported":                              []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "azp", "at_hash", "preferred_username", "name", "roles"},
+	})
+}
+
+// idToken issues an OpenID Connect ID token for u to the client. accessToken
+// is the access token issued alongside, bound to the ID token by at_hash.
+func (o *OAuthController) idToken(u models.User, clientID, scope, nonce string, authTime time.Time, accessToken string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       o.issuer,
+		"aud":       clientID,
+		"azp":       clientID,
+		"token_use": "id",
+		"exp":       now.Add(o.accessTTL).Unix(),
+		"iat":       now.Unix(),
+		"auth_time": authTime.Unix(),
+		"at_hash":   tokenHashClaim(o.keys.Algorithm(), accessToken),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range userClaims(u, strings.Fields(scope)) {
+		claims[k] = v
+	}
+	return o.keys.Sign(claims)
+}
+
+// tokenHashClaim computes an at_hash value: the left half of the token's
+// digest under the hash function of the signing algorithm
+func tokenHashClaim(alg, token string) string {
+	var h hash.Hash
+	switch alg {
+	case tokens.EdDSA:
+		h = sha512.New()
+	default:
+		h = sha256.New()
+	}
+	h.Write([]byte(token))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// userClaims maps u to the standard claims released for the granted scopes
+func userClaims(u models.User, scopes []string) gin.H {
+	claims := gin.H{"sub": u.ID.Hex()}
+	if slices.Contains(scopes, models.ScopeProfile) {
+		claims["preferred_username"] = u.Username
+		claims["name"] = u.Username
+		claims["roles"] = u.Roles
+	}
+	return claims
+}
+
+// UserInfo handles GET and POST /userinfo, returning the claims of the user an
+// access token with the openid scope was issued for
+func (o *OAuthController) UserInfo(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		// client credentials tokens have no user
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token", "error_description": "the token was not issued for a user"})
+		return
+	}
+	u, err := o.userSvc.FindByUsername(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+	if u.Username == "" {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token", "error_description": "user not found"})
+		return
+	}
+	// first-party sessions carry no scopes and see every claim
+	scopes := []string{models.ScopeOpenID, models.ScopeProfile}
+	if s, ok := c.Get("scopes"); ok {
+		scopes, _ = s.([]string)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, userClaims(u, scopes))
+}
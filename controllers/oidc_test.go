@@ -0,0 +1,192 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"authgo/federation/oidctest"
+	"authgo/models"
+)
+
+const rpRedirectURI = "http://127.0.0.1:9090/callback"
+
+// newRelyingParty registers a confidential client and returns a relying party
+// signing in through it
+func (s *testServer) newRelyingParty(t *testing.T) *oidctest.RelyingParty {
+	t.Helper()
+	secret, client, err := s.clients.Create(models.OAuthClient{
+		Name:         "relying party",
+		RedirectURIs: []string{rpRedirectURI},
+		GrantTypes:   []string{models.GrantAuthorizationCode},
+		Scopes:       []string{models.ScopeOpenID, models.ScopeProfile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := oidctest.NewRelyingParty(s.URL, client.ClientID, secret, rpRedirectURI, "openid profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+// approve submits the consent page for the authorization request at authURL.
+// It returns the status and, on a redirect, where the user agent is sent.
+func approve(t *testing.T, authURL, username, password string) (int, *url.URL) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := u.Query()
+	form.Set("username", username)
+	form.Set("password", password)
+	form.Set("action", "approve")
+	u.RawQuery = ""
+	resp, err := browser(t).PostForm(u.String(), form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		return resp.StatusCode, nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, location
+}
+
+// authorize runs an authorization request through the consent page
+func authorize(t *testing.T, rp *oidctest.RelyingParty, username, password string) (oidctest.Request, *url.URL) {
+	t.Helper()
+	req, err := rp.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, callback := approve(t, req.URL, username, password)
+	if callback == nil || !strings.HasPrefix(callback.String(), rpRedirectURI) {
+		t.Fatalf("authorize: %d redirecting to %v", status, callback)
+	}
+	return req, callback
+}
+
+func TestOpenIDConnectLogin(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.me(t, s.register(t, "alice", "correct horse battery staple"))
+	rp := s.newRelyingParty(t)
+
+	req, callback := authorize(t, rp, "alice", "correct horse battery staple")
+	login, err := rp.Callback(req, callback)
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	if login.IDToken["sub"] != alice.ID {
+		t.Errorf("id token sub = %v, want %s", login.IDToken["sub"], alice.ID)
+	}
+	if login.Userinfo["preferred_username"] != "alice" {
+		t.Errorf("userinfo = %v, want alice's profile", login.Userinfo)
+	}
+
+	// the code is single use
+	if _, err := rp.Callback(req, callback); err == nil {
+		t.Error("code redeemed twice")
+	}
+}
+
+func TestOpenIDConnectRejects(t *testing.T) {
+	s := newTestServer(t)
+	s.register(t, "alice", "correct horse battery staple")
+	rp := s.newRelyingParty(t)
+
+	t.Run("wrong password", func(t *testing.T) {
+		req, err := rp.AuthCodeURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, callback := approve(t, req.URL, "alice", "wrong password"); status != http.StatusUnauthorized || callback != nil {
+			t.Errorf("status = %d redirecting to %v, want 401 on the consent page", status, callback)
+		}
+	})
+	t.Run("unknown user", func(t *testing.T) {
+		req, err := rp.AuthCodeURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, callback := approve(t, req.URL, "mallory", "correct horse battery staple"); status != http.StatusUnauthorized || callback != nil {
+			t.Errorf("status = %d redirecting to %v, want 401 on the consent page", status, callback)
+		}
+	})
+	t.Run("wrong client secret", func(t *testing.T) {
+		req, callback := authorize(t, rp, "alice", "correct horse battery staple")
+		forged := *rp
+		forged.ClientSecret = "wrong-secret"
+		if _, err := forged.Callback(req, callback); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+			t.Errorf("err = %v, want invalid_client", err)
+		}
+	})
+	t.Run("wrong code verifier", func(t *testing.T) {
+		req, callback := authorize(t, rp, "alice", "correct horse battery staple")
+		req.Verifier = "guessed"
+		if _, err := rp.Callback(req, callback); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+			t.Errorf("err = %v, want invalid_grant", err)
+		}
+	})
+	t.Run("nonce of another request", func(t *testing.T) {
+		req, callback := authorize(t, rp, "alice", "correct horse battery staple")
+		req.Nonce = "replayed"
+		if _, err := rp.Callback(req, callback); err == nil || !strings.Contains(err.Error(), "nonce mismatch") {
+			t.Errorf("err = %v, want a nonce mismatch", err)
+		}
+	})
+	t.Run("plain code challenge", func(t *testing.T) {
+		req, err := rp.AuthCodeURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		q.Set("code_challenge", req.Verifier)
+		q.Set("code_challenge_method", "plain")
+		u.RawQuery = q.Encode()
+		if _, callback := approve(t, u.String(), "alice", "correct horse battery staple"); callback == nil || callback.Query().Get("error") != "invalid_request" {
+			t.Errorf("redirected to %v, want invalid_request", callback)
+		}
+	})
+	t.Run("unregistered redirect URI", func(t *testing.T) {
+		other := *rp
+		other.RedirectURI = "http://attacker.example/callback"
+		req, err := other.AuthCodeURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, callback := approve(t, req.URL, "alice", "correct horse battery staple"); status != http.StatusBadRequest || callback != nil {
+			t.Errorf("status = %d redirecting to %v, want 400 without a redirect", status, callback)
+		}
+	})
+}
+
+func TestDeletedClientTokensRejected(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.register(t, "root", "correct horse battery staple")
+	s.register(t, "alice", "correct horse battery staple")
+	rp := s.newRelyingParty(t)
+
+	req, callback := authorize(t, rp, "alice", "correct horse battery staple")
+	login, err := rp.Callback(req, callback)
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	if status := s.call(t, http.MethodDelete, "/oauth/clients/"+rp.ClientID, admin, nil, nil); status != http.StatusOK {
+		t.Fatalf("delete client: %d", status)
+	}
+	if status := s.call(t, http.MethodGet, "/userinfo", login.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("userinfo with a token of the deleted client: %d, want 401", status)
+	}
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"authgo/data"
+	"authgo/models"
+	"authgo/notify"
+	"authgo/passpolicy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ForgotPassword handles POST /password/forgot, mailing a reset token to the
+// user's verified email address. The response is the same whether or not the
+// account exists or has such an address, so that usernames cannot be probed.
+func (ctl *Controller) ForgotPassword(c *gin.Context) {
+	var input struct {
+		Username string `json:"username" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username required"})
+		return
+	}
+	accepted := gin.H{"message": "if the account exists, password reset instructions have been sent"}
+
+	u, err := ctl.userSvc.FindByUsername(input.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start password reset"})
+		return
+	}
+	if u.Username == "" || u.Disabled || u.Email == "" || !u.EmailVerified {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+	token, err := ctl.resetSvc.Create(u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start password reset"})
+		return
+	}
+	body := fmt.Sprintf("Use this token to reset your password within %s:\n\n%s\n", ctl.resetSvc.TTL(), token)
+	if ctl.resetURL != "" {
+		body += fmt.Sprintf("\nOr open %s?token=%s\n", ctl.resetURL, url.QueryEscape(token))
+	}
+	msg := notify.Message{To: u.Email, Subject: "Password reset", Body: body}
+	if err := ctl.notifier.Send(msg); err != nil {
+		log.Printf("failed to deliver password reset for %s: %v", u.Username, err)
+	}
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+// ResetPassword handles POST /password/reset. The token is consumed, the
+// password replaced and every existing session of the user revoked.
+func (ctl *Controller) ResetPassword(c *gin.Context) {
+	var input struct {
+		Token       string `json:"token" binding:"required"`
+		NewPassword string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token and new_password required"})
+		return
+	}
+	// check the new password before burning the single-use token
+	pr, err := ctl.resetSvc.Find(input.Token)
+	if err == nil {
+		var u models.User
+		u, err = ctl.userSvc.GetByID(pr.UserID.Hex())
+		if err == nil {
+			err = ctl.userSvc.ValidatePassword(u.Username, input.NewPassword)
+		}
+	}
+	if err == nil {
+		pr, err = ctl.resetSvc.Consume(input.Token)
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrResetTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if writePolicyError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+	u, err := ctl.userSvc.SetPassword(pr.UserID, input.NewPassword)
+	if err != nil {
+		if writePolicyError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+	if u.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": data.ErrResetTokenInvalid.Error()})
+		return
+	}
+	if err := ctl.refreshSvc.RevokeUser(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "password has been reset"})
+}
+
+// writePolicyError responds with every failed password policy rule if err is a
+// policy error; it returns false for other errors
+func writePolicyError(c *gin.Context, err error) bool {
+	var perr *passpolicy.Error
+	if !errors.As(err, &perr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":      "password does not meet policy",
+		"violations": perr.Violations,
+	})
+	return true
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validPermissions writes the error response and returns false if perms
+// names an unknown permission
+func validPermissions(c *gin.Context, perms []string) bool {
+	for _, p := range perms {
+		if !slices.Contains(models.Permissions, p) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown permission " + p, "allowed_permissions": models.Permissions})
+			return false
+		}
+	}
+	return true
+}
+
+// sortedPermissions sorts perms and drops duplicates
+func sortedPermissions(perms []string) []string {
+	out := append([]string{}, perms...)
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// ListRoles handles GET /roles (roles:manage)
+func (ctl *Controller) ListRoles(c *gin.Context) {
+	roles, err := ctl.roleSvc.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list roles"})
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+// CreateRole handles POST /roles (roles:manage)
+func (ctl *Controller) CreateRole(c *gin.Context) {
+	var input struct {
+		Name        string   `json:"name" binding:"required"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name required"})
+		return
+	}
+	if !models.ValidRoleName(input.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role names are lowercase letters, digits, - and _, starting with a letter"})
+		return
+	}
+	if !validPermissions(c, input.Permissions) {
+		return
+	}
+	role, err := ctl.roleSvc.Create(models.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: sortedPermissions(input.Permissions),
+	})
+	if err != nil {
+		if errors.Is(err, data.ErrRoleExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create role"})
+		return
+	}
+	c.JSON(http.StatusCreated, role)
+}
+
+// UpdateRole handles PUT /roles/:name (roles:manage), replacing the role's
+// description and permissions. Changes reach signed-in users within 30 seconds.
+func (ctl *Controller) UpdateRole(c *gin.Context) {
+	var input struct {
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "permissions required"})
+		return
+	}
+	if !validPermissions(c, input.Permissions) {
+		return
+	}
+	role, err := ctl.roleSvc.Update(c.Param("name"), input.Description, sortedPermissions(input.Permissions))
+	if err != nil {
+		if errors.Is(err, data.ErrBuiltInRole) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the admin role always has every permission"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update role"})
+		return
+	}
+	if role.Name == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteRole handles DELETE /roles/:name (roles:manage). Roles still assigned
+// to users cannot be deleted.
+func (ctl *Controller) DeleteRole(c *gin.Context) {
+	name := c.Param("name")
+	n, err := ctl.userSvc.CountWithRole(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete role"})
+		return
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "role is assigned to users", "users": n})
+		return
+	}
+	ok, err := ctl.roleSvc.Delete(name)
+	if err != nil {
+		if errors.Is(err, data.ErrBuiltInRole) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "built-in roles cannot be deleted"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete role"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "role deleted"})
+}
+
+// SetUserRoles handles PUT /users/:username/roles (users:promote), replacing
+// the user's roles. The user's tokens are outdated and must be renewed by
+// logging in again. The last active admin cannot lose the admin role.
+func (ctl *Controller) SetUserRoles(c *gin.Context) {
+	var input struct {
+		Roles []string `json:"roles" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "roles required"})
+		return
+	}
+	exist, err := ctl.roleSvc.AllExist(input.Roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update roles"})
+		return
+	}
+	if !exist {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role"})
+		return
+	}
+	u, ok := ctl.findUser(c, c.Param("username"))
+	if !ok {
+		return
+	}
+	updated, err := ctl.userSvc.SetRoles(u.ID, input.Roles)
+	if err != nil {
+		if errors.Is(err, data.ErrLastAdmin) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update roles"})
+		return
+	}
+	if updated.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	c.JSON(http.StatusOK, toUserResponse(updated))
+}
@@ -0,0 +1,168 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"authgo/auth"
+	"authgo/controllers"
+	"authgo/data"
+	"authgo/data/datatest"
+	"authgo/federation"
+	"authgo/middleware"
+	"authgo/notify"
+	"authgo/ratelimit"
+	"authgo/router"
+	"authgo/tokens"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// testOrigin is the web origin passkeys are used from
+const testOrigin = "https://localhost"
+
+// testServer runs the full router on a throwaway database
+type testServer struct {
+	URL      string
+	users    *data.UserService
+	attempts *data.LoginAttemptService
+	clients  *data.OAuthClientService
+}
+
+// newTestServer starts a server signing users in through providers as well
+func newTestServer(t *testing.T, providers ...federation.ProviderConfig) *testServer {
+	t.Helper()
+	db := datatest.Database(t)
+	gin.SetMode(gin.TestMode)
+	srv := httptest.NewUnstartedServer(nil)
+	t.Cleanup(srv.Close)
+	url := "http://" + srv.Listener.Addr().String()
+
+	users := datatest.UserService(db)
+	roles := data.NewRoleService(db.Collection("roles"))
+	refresh := data.NewRefreshTokenService(db.Collection("refresh_tokens"), time.Hour)
+	revocations := data.NewRevocationService(db.Collection("revoked_tokens"))
+	attempts := data.NewLoginAttemptService(db.Collection("login_attempts"), data.DefaultAccountLockout, data.DefaultIPLockout)
+	apiKeys := data.NewAPIKeyService(db.Collection("api_keys"))
+	sessions := data.NewSessionService(db.Collection("sessions"), time.Hour, time.Hour)
+	clients := data.NewOAuthClientService(db.Collection("oauth_clients"))
+	keys, err := tokens.NewKeyManager(data.NewSigningKeyService(db.Collection("signing_keys")), tokens.ES256, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl := controllers.NewController(users, data.NewTaskService(db.Collection("tasks")), refresh, revocations,
+		data.NewPasswordResetService(db.Collection("password_resets"), time.Hour),
+		data.NewEmailVerificationService(db.Collection("email_verifications"), time.Hour),
+		attempts, apiKeys, sessions, roles, users, keys, notify.LogNotifier{},
+		controllers.Config{Issuer: url, AccessTTL: 15 * time.Minute, TOTPIssuer: "goauth", MagicTTL: 15 * time.Minute})
+	validator := auth.NewValidator(keys, users, revocations, apiKeys, sessions, roles, clients)
+	oauth := controllers.NewOAuthController(ctl, clients,
+		data.NewAuthorizationCodeService(db.Collection("authorization_codes"), time.Minute),
+		data.NewDeviceCodeService(db.Collection("device_codes"), time.Minute, time.Second), validator)
+
+	path := filepath.Join(t.TempDir(), "providers.json")
+	raw, err := json.Marshal(append([]federation.ProviderConfig{}, providers...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := federation.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := webauthn.New(&webauthn.Config{RPID: "localhost", RPDisplayName: "authgo", RPOrigins: []string{testOrigin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlimited := ratelimit.Limit{Requests: 1000, Period: time.Second}
+	srv.Config.Handler = router.SetupRouter(ctl, oauth, controllers.NewFederationController(ctl, registry),
+		controllers.NewWebAuthnController(ctl, rp), middleware.NewAuthMiddleware(validator, apiKeys, false, false),
+		ratelimit.New(ratelimit.NewMemoryStore()), router.RateLimits{Auth: unlimited, API: unlimited})
+	srv.Start()
+	return &testServer{URL: url, users: users, attempts: attempts, clients: clients}
+}
+
+// browser returns a client keeping cookies and not following redirects
+func browser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+}
+
+// call sends body as JSON with an optional bearer token and decodes the JSON
+// response into out, if given
+func (s *testServer) call(t *testing.T, method, path, token string, body, out any) int {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, s.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode %s response: %v", method, path, resp.Status, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// tokenResponse is the response of a completed login
+type tokenResponse struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	MFAToken     string `json:"mfa_token"`
+	Error        string `json:"error"`
+}
+
+// register creates a local user and returns its access token
+func (s *testServer) register(t *testing.T, username, password string) string {
+	t.Helper()
+	var tok tokenResponse
+	body := map[string]string{"username": username, "password": password}
+	if status := s.call(t, http.MethodPost, "/register", "", body, &tok); status != http.StatusCreated || tok.AccessToken == "" {
+		t.Fatalf("register %s: %d %s", username, status, tok.Error)
+	}
+	return tok.AccessToken
+}
+
+// login signs a local user in with a password
+func (s *testServer) login(t *testing.T, username, password string) tokenResponse {
+	t.Helper()
+	var tok tokenResponse
+	body := map[string]string{"username": username, "password": password}
+	if status := s.call(t, http.MethodPost, "/login", "", body, &tok); status != http.StatusOK {
+		t.Fatalf("login %s: %d %s", username, status, tok.Error)
+	}
+	return tok
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"authgo/auth"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxUserAgentLength bounds the user agent stored with a session
+const maxUserAgentLength = 256
+
+// SessionModeCookie makes logins start a server-side session held in an
+// HttpOnly cookie instead of returning tokens to the client
+const SessionModeCookie = "cookie"
+
+// cookieSameSite parses the SameSite setting of session cookies, Lax by default
+func cookieSameSite(v string) http.SameSite {
+	switch strings.ToLower(v) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// sessionClient describes the client a login request came from
+func sessionClient(c *gin.Context) models.SessionClient {
+	ua := c.Request.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	return models.SessionClient{IP: c.ClientIP(), UserAgent: ua}
+}
+
+func toSessionResponse(s models.Session, currentID string) models.SessionResponse {
+	typ := models.SessionTypeToken
+	if s.TokenHash != "" {
+		typ = models.SessionTypeCookie
+	}
+	return models.SessionResponse{
+		ID:         s.ID.Hex(),
+		Type:       typ,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		CreatedAt:  s.CreatedAt,
+		LastSeenAt: s.LastSeenAt,
+		ExpiresAt:  s.ExpiresAt,
+		Current:    s.ID.Hex() == currentID,
+	}
+}
+
+// ListMySessions handles GET /me/sessions (authenticated)
+func (ctl *Controller) ListMySessions(c *gin.Context) {
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	ctl.listSessions(c, u)
+}
+
+// DeleteMySession handles DELETE /me/sessions/:id (authenticated), logging
+// out the session wherever it is used
+func (ctl *Controller) DeleteMySession(c *gin.Context) {
+	u, ok := ctl.currentUser(c)
+	if !ok {
+		return
+	}
+	ctl.deleteSession(c, u.ID, c.Param("id"))
+}
+
+// ListUserSessions handles GET /users/:username/sessions (users:manage)
+func (ctl *Controller) ListUserSessions(c *gin.Context) {
+	u, err := ctl.userSvc.FindByUsername(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+	if u.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	ctl.listSessions(c, u)
+}
+
+// DeleteUserSession handles DELETE /users/:username/sessions/:id (users:manage)
+func (ctl *Controller) DeleteUserSession(c *gin.Context) {
+	u, err := ctl.userSvc.FindByUsername(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+	if u.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	ctl.deleteSession(c, u.ID, c.Param("id"))
+}
+
+func (ctl *Controller) listSessions(c *gin.Context, u models.User) {
+	sessions, err := ctl.sessionSvc.ListByUser(u.ID, u.TokenVersion)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list sessions"})
+		return
+	}
+	resp := make([]models.SessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		resp = append(resp, toSessionResponse(s, c.GetString("session_id")))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// deleteSession ends one of the user's sessions. Its refresh tokens are
+// revoked; its access tokens and cookie stop working as the session is gone.
+func (ctl *Controller) deleteSession(c *gin.Context, userID primitive.ObjectID, id string) {
+	sess, err := ctl.sessionSvc.DeleteForUser(userID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	}
+	if sess.ID.IsZero() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if sess.FamilyID != "" {
+		if err := ctl.refreshSvc.RevokeFamily(sess.FamilyID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+			return
+		}
+	}
+	if sess.ID.Hex() == c.GetString("session_id") && c.GetString("auth_method") == auth.MethodSession {
+		ctl.setSessionCookies(c, "", "", -1)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// newCookieSession starts a browser session for u, setting the session and
+// CSRF cookies, and returns the login response. The CSRF token is also in the
+// response so that the frontend need not read it from the cookie.
+func (ctl *Controller) newCookieSession(c *gin.Context, u models.User) (gin.H, error) {
+	token, csrf, sess, err := ctl.sessionSvc.Create(u, sessionClient(c))
+	if err != nil {
+		return nil, err
+	}
+	maxAge := int(ctl.sessionSvc.AbsoluteTTL().Seconds())
+	ctl.setSessionCookies(c, token, csrf, maxAge)
+	return gin.H{
+		"username":   u.Username,
+		"roles":      u.Roles,
+		"csrf_token": csrf,
+		"expires_at": sess.AbsoluteExpiresAt,
+	}, nil
+}
+
+// setSessionCookies sets, or with maxAge -1 clears, the session cookie and
+// the CSRF cookie, which scripts must be able to read
+func (ctl *Controller) setSessionCookies(c *gin.Context, token, csrf string, maxAge int) {
+	c.SetSameSite(ctl.cookieSameSite)
+	c.SetCookie(auth.SessionCookie, token, maxAge, "/", "", true, true)
+	c.SetCookie(auth.CSRFCookie, csrf, maxAge, "/", "", true, false)
+}
+
+// endCookieSession ends the session the request was authenticated with
+func (ctl *Controller) endCookieSession(c *gin.Context) error {
+	token, _ := c.Cookie(auth.SessionCookie)
+	if err := ctl.sessionSvc.Delete(token); err != nil {
+		return err
+	}
+	ctl.setSessionCookies(c, "", "", -1)
+	return nil
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// findUser loads the user with username, writing the error response if there
+// is none
+func (ctl *Controller) findUser(c *gin.Context, username string) (models.User, bool) {
+	u, err := ctl.userSvc.FindByUsername(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return models.User{}, false
+	}
+	if u.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return models.User{}, false
+	}
+	return u, true
+}
+
+// Demote handles POST /users/:username/demote (users:promote), taking the
+// admin role from the user. The last active admin cannot be demoted.
+func (ctl *Controller) Demote(c *gin.Context) {
+	u, ok := ctl.findUser(c, c.Param("username"))
+	if !ok {
+		return
+	}
+	updated, err := ctl.userSvc.DemoteUser(u.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrLastAdmin) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to demote user"})
+		return
+	}
+	if updated.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": updated.Username, "roles": updated.Roles})
+}
+
+// DisableUser handles POST /users/:username/disable (users:manage). The user
+// can no longer log in and every session is ended. The last active admin
+// cannot be disabled.
+func (ctl *Controller) DisableUser(c *gin.Context) {
+	u, ok := ctl.findUser(c, c.Param("username"))
+	if !ok {
+		return
+	}
+	updated, err := ctl.userSvc.SetDisabled(u.ID, true)
+	if err != nil {
+		if errors.Is(err, data.ErrLastAdmin) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable user"})
+		return
+	}
+	if updated.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err := ctl.refreshSvc.RevokeUser(updated.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	if err := ctl.sessionSvc.DeleteByUser(updated.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, toUserResponse(updated))
+}
+
+// EnableUser handles POST /users/:username/enable (users:manage)
+func (ctl *Controller) EnableUser(c *gin.Context) {
+	u, ok := ctl.findUser(c, c.Param("username"))
+	if !ok {
+		return
+	}
+	updated, err := ctl.userSvc.SetDisabled(u.ID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable user"})
+		return
+	}
+	if updated.Username == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	c.JSON(http.StatusOK, toUserResponse(updated))
+}
+
+// DeleteUser handles DELETE /users/:username (users:manage), removing the
+// account with its tokens, API keys and sessions. The last active admin cannot
+// be deleted.
+func (ctl *Controller) DeleteUser(c *gin.Context) {
+	u, ok := ctl.findUser(c, c.Param("username"))
+	if !ok {
+		return
+	}
+	deleted, err := ctl.userSvc.DeleteUser(u.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrLastAdmin) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete user"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err := ctl.refreshSvc.RevokeUser(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	if err := ctl.apiKeySvc.DeleteByUser(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete api keys"})
+		return
+	}
+	if err := ctl.sessionSvc.DeleteByUser(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
+}
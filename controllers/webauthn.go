@@ -0,0 +1,509 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// webAuthnCeremonyTTL is how long the user has to answer a begin response
+const webAuthnCeremonyTTL = 5 * time.Minute
+
+// WebAuthn ceremonies, recorded in the session token between begin and finish
+const (
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+	ceremonyMFA      = "mfa"
+)
+
+// WebAuthnController registers passkeys and security keys and signs users in
+// with them. A passkey may replace the password, or complete a password login
+// in place of a TOTP code.
+type WebAuthnController struct {
+	*Controller
+	wa *webauthn.WebAuthn
+}
+
+// NewWebAuthnController constructs WebAuthnController for the relying party wa
+func NewWebAuthnController(ctl *Controller, wa *webauthn.WebAuthn) *WebAuthnController {
+	return &WebAuthnController{Controller: ctl, wa: wa}
+}
+
+// webAuthnUser adapts models.User to webauthn.User. The user handle is the
+// user's ObjectID, which identifies the account of a discoverable credential.
+type webAuthnUser struct {
+	models.User
+}
+
+func (w webAuthnUser) WebAuthnID() []byte {
+	id := w.ID
+	return id[:]
+}
+
+func (w webAuthnUser) WebAuthnName() string { return w.Username }
+
+func (w webAuthnUser) WebAuthnDisplayName() string { return w.Username }
+
+func (w webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(w.User.WebAuthnCredentials))
+	for _, sc := range w.User.WebAuthnCredentials {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(sc.Transports))
+		for _, t := range sc.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+		creds = append(creds, webauthn.Credential{
+			ID:              sc.ID,
+			PublicKey:       sc.PublicKey,
+			AttestationType: sc.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserPresent:    true,
+				UserVerified:   sc.UserVerified,
+				BackupEligible: sc.BackupEligible,
+				BackupState:    sc.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{AAGUID: sc.AAGUID, SignCount: sc.SignCount},
+		})
+	}
+	return creds
+}
+
+// storableCredential converts a newly registered credential for storage
+func storableCredential(cred *webauthn.Credential, name string) models.WebAuthnCredential {
+	transports := make([]string, 0, len(cred.Transport))
+	for _, t := range cred.Transport {
+		transports = append(transports, string(t))
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+	return models.WebAuthnCredential{
+		ID:              cred.ID,
+		Name:            name,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		Transports:      transports,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		UserVerified:    cred.Flags.UserVerified,
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+		CreatedAt:       time.Now(),
+	}
+}
+
+// storedCredential returns the user's credential with the given id
+func storedCredential(u models.User, id []byte) (models.WebAuthnCredential, bool) {
+	for _, sc := range u.WebAuthnCredentials {
+		if bytes.Equal(sc.ID, id) {
+			return sc, true
+		}
+	}
+	return models.WebAuthnCredential{}, false
+}
+
+func webAuthnCredentialResponse(sc models.WebAuthnCredential) models.WebAuthnCredentialResponse {
+	return models.WebAuthnCredentialResponse{
+		ID:         base64.RawURLEncoding.EncodeToString(sc.ID),
+		Name:       sc.Name,
+		Transports: sc.Transports,
+		Synced:     sc.BackupState,
+		CreatedAt:  sc.CreatedAt,
+		LastUsedAt: sc.LastUsedAt,
+	}
+}
+
+// ceremonyToken signs the state of a ceremony, with extra claims, for the
+// client to return with its finish request
+func (w *WebAuthnController) ceremonyToken(ceremony string, session *webauthn.SessionData, extra jwt.MapClaims) (string, error) {
+	jti, err := newJTI()
+	if err != nil {
+		return "", err
+	}
+	state, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	claims := jwt.MapClaims{
+		"token_use": "webauthn",
+		"ceremony":  ceremony,
+		"jti":       jti,
+		"session":   string(state),
+		"exp":       time.Now().Add(webAuthnCeremonyTTL).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return w.keys.Sign(claims)
+}
+
+// ceremony is the state of a ceremony recovered from its session token
+type ceremony struct {
+	kind    string
+	sub     string
+	session webauthn.SessionData
+	// the MFA challenge answered by a second factor ceremony
+	mfaJTI string
+	mfaExp time.Time
+}
+
+// parseCeremony checks a session token and consumes it, so that every
+// challenge is answered once. ok is false for invalid or used tokens.
+func (w *WebAuthnController) parseCeremony(token string) (ceremony, bool, error) {
+	claims, err := w.keys.Parse(token)
+	if err != nil || claims["token_use"] != "webauthn" {
+		return ceremony{}, false, nil
+	}
+	var cer ceremony
+	cer.kind, _ = claims["ceremony"].(string)
+	cer.sub, _ = claims["sub"].(string)
+	cer.mfaJTI, _ = claims["mfa_jti"].(string)
+	if mfaExp, ok := claims["mfa_exp"].(float64); ok {
+		cer.mfaExp = time.Unix(int64(mfaExp), 0)
+	}
+	jti, _ := claims["jti"].(string)
+	state, _ := claims["session"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil || json.Unmarshal([]byte(state), &cer.session) != nil {
+		return ceremony{}, false, nil
+	}
+	first, err := w.revokeSvc.RevokeOnce(jti, exp.Time)
+	if err != nil {
+		return ceremony{}, false, err
+	}
+	return cer, first, nil
+}
+
+// BeginRegistration handles POST /webauthn/register/begin (authenticated),
+// returning credential creation options for navigator.credentials.create
+func (w *WebAuthnController) BeginRegistration(c *gin.Context) {
+	u, ok := w.currentUser(c)
+	if !ok {
+		return
+	}
+	wu := webAuthnUser{u}
+	// passkeys must be discoverable to sign in without a username
+	creation, session, err := w.wa.BeginRegistration(wu,
+		webauthn.WithExclusions(webauthn.Credentials(wu.WebAuthnCredentials()).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start registration"})
+		return
+	}
+	token, err := w.ceremonyToken(ceremonyRegister, session, jwt.MapClaims{"sub": u.ID.Hex()})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start registration"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"options": creation, "session_token": token})
+}
+
+// FinishRegistration handles POST /webauthn/register/finish (authenticated),
+// verifying the authenticator's response and storing the new credential
+func (w *WebAuthnController) FinishRegistration(c *gin.Context) {
+	var input struct {
+		SessionToken string          `json:"session_token" binding:"required"`
+		Credential   json.RawMessage `json:"credential" binding:"required"`
+		Name         string          `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session_token and credential required"})
+		return
+	}
+	cer, ok, err := w.parseCeremony(input.SessionToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register credential"})
+		return
+	}
+	if !ok || cer.kind != ceremonyRegister || cer.sub != c.GetString("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired session_token"})
+		return
+	}
+	u, ok := w.currentUser(c)
+	if !ok {
+		return
+	}
+	if u.ID.Hex() != cer.sub {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired session_token"})
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(input.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid credential"})
+		return
+	}
+	cred, err := w.wa.CreateCredential(webAuthnUser{u}, cer.session, parsed)
+	if err != nil {
+		log.Printf("webauthn registration for %s rejected: %v", u.Username, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "credential verification failed"})
+		return
+	}
+
+	sc := storableCredential(cred, input.Name)
+	added, err := w.userSvc.AddWebAuthnCredential(u.ID, sc)
+	if err != nil {
+		if errors.Is(err, data.ErrCredentialExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register credential"})
+		return
+	}
+	if !added {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	c.JSON(http.StatusCreated, webAuthnCredentialResponse(sc))
+}
+
+// BeginLogin handles POST /webauthn/login/begin. Without a body it starts a
+// passkey login for any account; with the mfa_token of a password login it
+// asks for one of that user's credentials as the second factor.
+func (w *WebAuthnController) BeginLogin(c *gin.Context) {
+	var input struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	// body is optional
+	_ = c.ShouldBindJSON(&input)
+
+	if input.MFAToken == "" {
+		// the passkey replaces both factors, so the authenticator must
+		// verify the user with a PIN or biometric
+		assertion, session, err := w.wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+		token, err := w.ceremonyToken(ceremonyLogin, session, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"options": assertion, "session_token": token})
+		return
+	}
+
+	u, mfaJTI, mfaExp, err := w.parseMFAChallenge(input.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+		return
+	}
+	if u.Username == "" || len(u.WebAuthnCredentials) == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid mfa token"})
+		return
+	}
+	assertion, session, err := w.wa.BeginLogin(webAuthnUser{u})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+		return
+	}
+	token, err := w.ceremonyToken(ceremonyMFA, session, jwt.MapClaims{
+		"sub":     u.ID.Hex(),
+		"mfa_jti": mfaJTI,
+		"mfa_exp": mfaExp.Unix(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"options": assertion, "session_token": token})
+}
+
+// FinishLogin handles POST /webauthn/login/finish, verifying the assertion and
+// returning the same response as a completed POST /login. A stored signature
+// counter that does not increase marks the credential as possibly cloned and
+// the login is refused.
+func (w *WebAuthnController) FinishLogin(c *gin.Context) {
+	var input struct {
+		SessionToken string          `json:"session_token" binding:"required"`
+		Credential   json.RawMessage `json:"credential" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session_token and credential required"})
+		return
+	}
+	invalid := gin.H{"error": "invalid credential"}
+	cer, ok, err := w.parseCeremony(input.SessionToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return
+	}
+	if !ok || (cer.kind != ceremonyLogin && cer.kind != ceremonyMFA) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired session_token"})
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(input.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+
+	var u models.User
+	var cred *webauthn.Credential
+	if cer.kind == ceremonyLogin {
+		var lookupErr error
+		cred, err = w.wa.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			if len(userHandle) != len(primitive.NilObjectID) {
+				return nil, errors.New("unknown user handle")
+			}
+			u, lookupErr = w.userSvc.GetByID(primitive.ObjectID(userHandle).Hex())
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			if u.Username == "" {
+				return nil, errors.New("unknown user handle")
+			}
+			return webAuthnUser{u}, nil
+		}, cer.session, parsed)
+		if lookupErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+			return
+		}
+		// the account is only known once the user handle resolved
+		if u.Username != "" {
+			if !w.checkLockout(c, u.Username) {
+				return
+			}
+			if err != nil {
+				w.recordFailure(c, u.Username)
+			}
+		}
+	} else {
+		// the MFA challenge must still be unused when the assertion arrives
+		u, err = w.userSvc.GetByID(cer.sub)
+		var revoked bool
+		if err == nil && u.Username != "" {
+			revoked, err = w.revokeSvc.IsRevoked(cer.mfaJTI)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+			return
+		}
+		if u.Username == "" || revoked || cer.mfaJTI == "" {
+			c.JSON(http.StatusUnauthorized, invalid)
+			return
+		}
+		if !w.checkLockout(c, u.Username) {
+			return
+		}
+		cred, err = w.wa.ValidateLogin(webAuthnUser{u}, cer.session, parsed)
+		if err == nil {
+			// the challenge is single-use
+			if err := w.revokeSvc.Revoke(cer.mfaJTI, cer.mfaExp); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+				return
+			}
+		} else {
+			w.recordFailure(c, u.Username)
+		}
+	}
+	if err != nil {
+		log.Printf("webauthn login rejected: %v", err)
+		c.JSON(http.StatusUnauthorized, invalid)
+		return
+	}
+	if u.Disabled {
+		c.JSON(http.StatusUnauthorized, invalid)
+		return
+	}
+	if !w.useCredential(c, u, cred) {
+		return
+	}
+	if err := w.attemptSvc.ResetAccount(u.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return
+	}
+	if w.blockUnverified(c, u) {
+		return
+	}
+	resp, err := w.newSession(c, u)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// useCredential enforces the signature counter of a verified assertion and
+// stores the new value; it returns false if a response was written
+func (w *WebAuthnController) useCredential(c *gin.Context, u models.User, cred *webauthn.Credential) bool {
+	sc, ok := storedCredential(u, cred.ID)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credential"})
+		return false
+	}
+	if cred.Authenticator.CloneWarning {
+		log.Printf("webauthn credential of %s reused signature counter %d, possibly cloned", u.Username, sc.SignCount)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credential"})
+		return false
+	}
+	// a concurrent login with the same counter value loses
+	updated, err := w.userSvc.UseWebAuthnCredential(u.ID, sc.ID, sc.SignCount, cred.Authenticator.SignCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to login"})
+		return false
+	}
+	if !updated {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credential"})
+		return false
+	}
+	return true
+}
+
+// ListWebAuthnCredentials handles GET /me/webauthn/credentials (authenticated)
+func (w *WebAuthnController) ListWebAuthnCredentials(c *gin.Context) {
+	u, ok := w.currentUser(c)
+	if !ok {
+		return
+	}
+	resp := make([]models.WebAuthnCredentialResponse, 0, len(u.WebAuthnCredentials))
+	for _, sc := range u.WebAuthnCredentials {
+		resp = append(resp, webAuthnCredentialResponse(sc))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// DeleteWebAuthnCredential handles DELETE /me/webauthn/credentials/:id
+// (authenticated). Like disabling TOTP, it requires the current password.
+func (w *WebAuthnController) DeleteWebAuthnCredential(c *gin.Context) {
+	var input struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password required"})
+		return
+	}
+	id, err := base64.RawURLEncoding.DecodeString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	u, ok := w.confirmPassword(c, input.Password)
+	if !ok {
+		return
+	}
+	deleted, err := w.userSvc.DeleteWebAuthnCredential(u.ID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete credential"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "credential deleted"})
+}
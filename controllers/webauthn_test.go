@@ -0,0 +1,338 @@
+package controllers_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"authgo/models"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// authenticator is a software passkey holding one ES256 credential, with
+// "none" attestation. It verifies the user on every ceremony.
+type authenticator struct {
+	credentialID []byte
+	key          *ecdsa.PrivateKey
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &authenticator{credentialID: id, key: key}
+}
+
+// ceremonyOptions is the part of a begin response the authenticator answers
+type ceremonyOptions struct {
+	Options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	} `json:"options"`
+	SessionToken string `json:"session_token"`
+	Error        string `json:"error"`
+}
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// clientData returns the clientDataJSON a browser at testOrigin sends
+func clientData(t *testing.T, typ, challenge string) []byte {
+	t.Helper()
+	raw, err := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// authData returns authenticator data for the relying party at localhost
+func (a *authenticator) authData(flags byte, extra []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	out := append(rpIDHash[:], flags)
+	out = binary.BigEndian.AppendUint32(out, a.signCount)
+	return append(out, extra...)
+}
+
+// create answers a registration ceremony
+func (a *authenticator) create(t *testing.T, opts ceremonyOptions) map[string]any {
+	t.Helper()
+	userHandle, err := base64.RawURLEncoding.DecodeString(opts.Options.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = userHandle
+
+	// the public key in COSE form: EC2 key type, ES256, P-256 curve
+	publicKey, err := cbor.Marshal(map[int]any{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), publicKey...)
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(flagUserPresent|flagUserVerified|flagAttested, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData(t, "webauthn.create", opts.Options.PublicKey.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"transports":        []string{"internal"},
+		},
+	}
+}
+
+// get answers a login ceremony, signing with key
+func (a *authenticator) get(t *testing.T, opts ceremonyOptions, key *ecdsa.PrivateKey) map[string]any {
+	t.Helper()
+	a.signCount++
+	authData := a.authData(flagUserPresent|flagUserVerified, nil)
+	client := clientData(t, "webauthn.get", opts.Options.PublicKey.Challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(authData, clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(client),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(sig),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+// registerPasskey adds a's credential to the account signed in with token
+func (s *testServer) registerPasskey(t *testing.T, token string, a *authenticator) {
+	t.Helper()
+	var opts ceremonyOptions
+	if status := s.call(t, http.MethodPost, "/webauthn/register/begin", token, nil, &opts); status != http.StatusOK {
+		t.Fatalf("begin registration: %d %s", status, opts.Error)
+	}
+	body := map[string]any{"session_token": opts.SessionToken, "credential": a.create(t, opts), "name": "laptop"}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if status := s.call(t, http.MethodPost, "/webauthn/register/finish", token, body, &resp); status != http.StatusCreated {
+		t.Fatalf("finish registration: %d %s", status, resp.Error)
+	}
+}
+
+// beginLogin starts a passkey login, or the second factor of the password
+// login that returned mfaToken
+func (s *testServer) beginLogin(t *testing.T, mfaToken string) ceremonyOptions {
+	t.Helper()
+	var body any
+	if mfaToken != "" {
+		body = map[string]string{"mfa_token": mfaToken}
+	}
+	var opts ceremonyOptions
+	if status := s.call(t, http.MethodPost, "/webauthn/login/begin", "", body, &opts); status != http.StatusOK {
+		t.Fatalf("begin login: %d %s", status, opts.Error)
+	}
+	return opts
+}
+
+// finishLogin answers opts with credential
+func (s *testServer) finishLogin(t *testing.T, opts ceremonyOptions, credential map[string]any) (int, tokenResponse) {
+	t.Helper()
+	var tok tokenResponse
+	status := s.call(t, http.MethodPost, "/webauthn/login/finish", "", map[string]any{"session_token": opts.SessionToken, "credential": credential}, &tok)
+	return status, tok
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	s := newTestServer(t)
+	token := s.register(t, "alice", "correct horse battery staple")
+	alice := s.me(t, token)
+	a := newAuthenticator(t)
+	s.registerPasskey(t, token, a)
+
+	opts := s.beginLogin(t, "")
+	assertion := a.get(t, opts, a.key)
+	status, tok := s.finishLogin(t, opts, assertion)
+	if status != http.StatusOK || tok.AccessToken == "" {
+		t.Fatalf("passkey login: %d %s", status, tok.Error)
+	}
+	if u := s.me(t, tok.AccessToken); u.ID != alice.ID {
+		t.Errorf("signed in as %s, want alice", u.Username)
+	}
+
+	// every challenge is answered once
+	if status, _ := s.finishLogin(t, opts, assertion); status != http.StatusBadRequest {
+		t.Errorf("replayed assertion: %d, want 400", status)
+	}
+}
+
+func TestPasskeyAsSecondFactor(t *testing.T) {
+	s := newTestServer(t)
+	a := newAuthenticator(t)
+	s.registerPasskey(t, s.register(t, "alice", "correct horse battery staple"), a)
+
+	challenge := s.login(t, "alice", "correct horse battery staple")
+	if challenge.AccessToken != "" || challenge.MFAToken == "" {
+		t.Fatalf("password login with a passkey registered: want an MFA challenge, got %+v", challenge)
+	}
+	opts := s.beginLogin(t, challenge.MFAToken)
+	if status, tok := s.finishLogin(t, opts, a.get(t, opts, a.key)); status != http.StatusOK || tok.AccessToken == "" {
+		t.Fatalf("second factor: %d %s", status, tok.Error)
+	}
+
+	// the MFA challenge is used up by the login
+	body := map[string]string{"mfa_token": challenge.MFAToken}
+	if status := s.call(t, http.MethodPost, "/webauthn/login/begin", "", body, nil); status != http.StatusUnauthorized {
+		t.Errorf("reused mfa_token: %d, want 401", status)
+	}
+}
+
+func TestPasskeyRejectsClonedAuthenticator(t *testing.T) {
+	s := newTestServer(t)
+	a := newAuthenticator(t)
+	s.registerPasskey(t, s.register(t, "alice", "correct horse battery staple"), a)
+
+	clone := *a
+	opts := s.beginLogin(t, "")
+	if status, tok := s.finishLogin(t, opts, a.get(t, opts, a.key)); status != http.StatusOK {
+		t.Fatalf("passkey login: %d %s", status, tok.Error)
+	}
+	// the copy signs with the counter value the original already used
+	opts = s.beginLogin(t, "")
+	if status, tok := s.finishLogin(t, opts, clone.get(t, opts, clone.key)); status != http.StatusUnauthorized || tok.AccessToken != "" {
+		t.Errorf("cloned authenticator: %d, want 401", status)
+	}
+}
+
+func TestPasskeyRejectsInvalidAssertions(t *testing.T) {
+	s := newTestServer(t)
+	a := newAuthenticator(t)
+	s.registerPasskey(t, s.register(t, "alice", "correct horse battery staple"), a)
+
+	forger := newAuthenticator(t)
+	t.Run("wrong key", func(t *testing.T) {
+		opts := s.beginLogin(t, "")
+		if status, _ := s.finishLogin(t, opts, a.get(t, opts, forger.key)); status != http.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", status)
+		}
+	})
+	t.Run("unregistered credential", func(t *testing.T) {
+		forger.userHandle = a.userHandle
+		opts := s.beginLogin(t, "")
+		if status, _ := s.finishLogin(t, opts, forger.get(t, opts, forger.key)); status != http.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", status)
+		}
+	})
+	t.Run("other challenge", func(t *testing.T) {
+		opts, other := s.beginLogin(t, ""), s.beginLogin(t, "")
+		if status, _ := s.finishLogin(t, opts, a.get(t, other, a.key)); status != http.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", status)
+		}
+	})
+}
+
+func TestPasskeyLoginLockout(t *testing.T) {
+	s := newTestServer(t)
+	a := newAuthenticator(t)
+	s.registerPasskey(t, s.register(t, "alice", "correct horse battery staple"), a)
+
+	forger := newAuthenticator(t)
+	for i := 0; i < 5; i++ {
+		opts := s.beginLogin(t, "")
+		if status, _ := s.finishLogin(t, opts, a.get(t, opts, forger.key)); status != http.StatusUnauthorized {
+			t.Fatalf("forged assertion %d: %d, want 401", i+1, status)
+		}
+	}
+	opts := s.beginLogin(t, "")
+	if status, tok := s.finishLogin(t, opts, a.get(t, opts, a.key)); status != http.StatusTooManyRequests || tok.AccessToken != "" {
+		t.Errorf("valid assertion on a locked account: %d, want 429", status)
+	}
+}
+
+func TestPasskeyOnlyAccountCannotApproveWithPassword(t *testing.T) {
+	s := newTestServer(t)
+	s.registerPasskey(t, s.register(t, "alice", "correct horse battery staple"), newAuthenticator(t))
+
+	req, err := s.newRelyingParty(t).AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, callback := approve(t, req.URL, "alice", "correct horse battery staple"); status != http.StatusForbidden || callback != nil {
+		t.Errorf("consent: %d redirecting to %v, want 403", status, callback)
+	}
+
+	secret, client, err := s.clients.Create(models.OAuthClient{
+		Name:       "television",
+		GrantTypes: []string{models.GrantDeviceCode},
+		Scopes:     []string{models.ScopeOpenID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.PostForm(s.URL+"/oauth/device/code", url.Values{"client_id": {client.ClientID}, "client_secret": {secret}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var device struct {
+		UserCode string `json:"user_code"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&device)
+	resp.Body.Close()
+	if err != nil || device.UserCode == "" {
+		t.Fatalf("device authorization: %s, %v", resp.Status, err)
+	}
+	resp, err = http.PostForm(s.URL+"/oauth/device", url.Values{
+		"user_code": {device.UserCode},
+		"username":  {"alice"},
+		"password":  {"correct horse battery staple"},
+		"action":    {"approve"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("device approval: %s, want 403", resp.Status)
+	}
+}
@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"authgo/cache"
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeyPrefix starts every API key so that it can be told apart from a JWT
+const APIKeyPrefix = "gat_"
+
+// ErrAPIKeyInvalid is returned for unknown or expired API keys
+var ErrAPIKeyInvalid = errors.New("invalid api key")
+
+// lastUsedGranularity limits how often last-used timestamps are written
+const lastUsedGranularity = time.Minute
+
+// APIKeyService manages personal access tokens. Key lookups are cached
+// in-process for a short time, so a key deleted on another instance stops
+// working there within that time.
+type APIKeyService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	keys       *cache.TTL[string, models.APIKey]
+	touched    *cache.TTL[primitive.ObjectID, bool]
+}
+
+// NewAPIKeyService constructs an APIKeyService
+func NewAPIKeyService(coll *mongo.Collection) *APIKeyService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	})
+	return &APIKeyService{
+		collection: coll,
+		timeout:    5 * time.Second,
+		keys:       cache.New[string, models.APIKey](30 * time.Second),
+		touched:    cache.New[primitive.ObjectID, bool](lastUsedGranularity),
+	}
+}
+
+// IsAPIKey reports whether token looks like an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// Create issues a new key for the user and returns its plaintext, which is
+// not retrievable afterwards
+func (s *APIKeyService) Create(userID primitive.ObjectID, name string, scopes []string, expiresAt *time.Time) (string, models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+	key := APIKeyPrefix + secret
+	k := models.APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    key[:len(APIKeyPrefix)+8],
+		KeyHash:   hashToken(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	res, err := s.collection.InsertOne(ctx, k)
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		k.ID = oid
+	}
+	return key, k, nil
+}
+
+// ListByUser returns the user's keys, newest first
+func (s *APIKeyService) ListByUser(userID primitive.ObjectID) ([]models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cur, err := s.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var keys []models.APIKey
+	if err := cur.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Delete removes one of the user's keys; returns false if no key matched
+func (s *APIKeyService) Delete(userID primitive.ObjectID, hexID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	oid, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return false, errors.New("invalid id")
+	}
+	var deleted models.APIKey
+	if err := s.collection.FindOneAndDelete(ctx, bson.M{"_id": oid, "user_id": userID}).Decode(&deleted); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+	s.keys.Delete(deleted.KeyHash)
+	return true, nil
+}
+
+// DeleteByUser removes every key of the user
+func (s *APIKeyService) DeleteByUser(userID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.collection.DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
+
+// Authenticate returns the key matching the plaintext key if it has not expired
+func (s *APIKeyService) Authenticate(key string) (models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	hash := hashToken(key)
+	k, ok := s.keys.Get(hash)
+	if !ok {
+		if err := s.collection.FindOne(ctx, bson.M{"key_hash": hash}).Decode(&k); err != nil && err != mongo.ErrNoDocuments {
+			return models.APIKey{}, err
+		}
+		// unknown keys are cached too, as a zero APIKey
+		s.keys.Set(hash, k)
+	}
+	if k.ID.IsZero() || (k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)) {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+	return k, nil
+}
+
+// TouchLastUsed records that the key was used, writing at most once per minute
+func (s *APIKeyService) TouchLastUsed(id primitive.ObjectID) error {
+	if _, ok := s.touched.Get(id); ok {
+		return nil
+	}
+	s.touched.Set(id, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"_id": id, "$or": bson.A{
+		bson.M{"last_used_at": nil},
+		bson.M{"last_used_at": bson.M{"$lt": now.Add(-lastUsedGranularity)}},
+	}}
+	_, err := s.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"last_used_at": now}})
+	return err
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrCodeInvalid is returned for unknown or expired authorization codes
+	ErrCodeInvalid = errors.New("invalid authorization code")
+	// ErrCodeReused is returned when an authorization code is presented a second time
+	ErrCodeReused = errors.New("authorization code already used")
+)
+
+// AuthorizationCodeService stores single-use OAuth authorization codes
+type AuthorizationCodeService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	ttl        time.Duration
+}
+
+// NewAuthorizationCodeService constructs an AuthorizationCodeService issuing codes valid for ttl
+func NewAuthorizationCodeService(coll *mongo.Collection, ttl time.Duration) *AuthorizationCodeService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "code_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// keep used codes for a while so replays can be detected
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32((24 * time.Hour).Seconds())),
+		},
+	})
+	return &AuthorizationCodeService{collection: coll, timeout: 5 * time.Second, ttl: ttl}
+}
+
+// Create stores the grant described by ac and returns the code to hand to the client
+func (s *AuthorizationCodeService) Create(ac models.AuthorizationCode) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	code, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	ac.CodeHash = hashToken(code)
+	ac.CreatedAt = now
+	ac.ExpiresAt = now.Add(s.ttl)
+	if _, err := s.collection.InsertOne(ctx, ac); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Consume marks the code as used and returns its grant. A replayed code
+// returns ErrCodeReused along with the stored grant, so that tokens issued
+// from it can be revoked.
+func (s *AuthorizationCodeService) Consume(code string) (models.AuthorizationCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	hash := hashToken(code)
+	filter := bson.M{"code_hash": hash, "used_at": nil, "expires_at": bson.M{"$gt": now}}
+	var ac models.AuthorizationCode
+	err := s.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}).Decode(&ac)
+	if err == nil {
+		return ac, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return models.AuthorizationCode{}, err
+	}
+	if err := s.collection.FindOne(ctx, bson.M{"code_hash": hash}).Decode(&ac); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.AuthorizationCode{}, ErrCodeInvalid
+		}
+		return models.AuthorizationCode{}, err
+	}
+	if ac.UsedAt != nil {
+		return ac, ErrCodeReused
+	}
+	return models.AuthorizationCode{}, ErrCodeInvalid
+}
+
+// SetFamily records the refresh token family issued for a code
+func (s *AuthorizationCodeService) SetFamily(id primitive.ObjectID, familyID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"family_id": familyID}})
+	return err
+}
@@ -0,0 +1,55 @@
+// Package datatest provides throwaway MongoDB databases for tests. Tests using
+// it are skipped unless MONGODB_TEST_URI names a server to create them on.
+package datatest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"authgo/data"
+	"authgo/passhash"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Database returns an empty database on the server at MONGODB_TEST_URI, which
+// is dropped when the test ends. The test is skipped if the variable is unset.
+func Database(t testing.TB) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	client, err := data.NewMongoClient(ctx, uri)
+	if err != nil {
+		t.Fatalf("connect to %s: %v", uri, err)
+	}
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("authgo_test_" + hex.EncodeToString(b))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+	return db
+}
+
+// Hasher hashes passwords quickly, for tests only
+var Hasher = passhash.NewManager(passhash.Bcrypt{Cost: 4})
+
+// UserService returns a UserService on db, with the built-in roles seeded and
+// no password policy
+func UserService(db *mongo.Database) *data.UserService {
+	roles := data.NewRoleService(db.Collection("roles"))
+	return data.NewUserService(db.Collection("users"), roles, Hasher, nil)
+}
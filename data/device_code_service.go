@@ -0,0 +1,243 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Polling outcomes of the device authorization grant (RFC 8628 section 3.5)
+var (
+	ErrDeviceCodeInvalid    = errors.New("invalid device code")
+	ErrDeviceCodeExpired    = errors.New("device code expired")
+	ErrAuthorizationPending = errors.New("authorization pending")
+	ErrSlowDown             = errors.New("polling too fast")
+	ErrDeviceAccessDenied   = errors.New("authorization denied")
+)
+
+const (
+	// userCodeAlphabet avoids vowels, so codes do not spell words, and
+	// characters that are easily confused
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	// slowDownStep is added to the polling interval of a device polling too fast
+	slowDownStep = 5
+)
+
+// DeviceCodeService stores pending device authorizations
+type DeviceCodeService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	ttl        time.Duration
+	interval   int
+}
+
+// NewDeviceCodeService constructs a DeviceCodeService issuing codes valid for
+// ttl, polled at most every interval
+func NewDeviceCodeService(coll *mongo.Collection, ttl, interval time.Duration) *DeviceCodeService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "device_code_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_code", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return &DeviceCodeService{collection: coll, timeout: 5 * time.Second, ttl: ttl, interval: int(interval.Seconds())}
+}
+
+// Create starts a device authorization for the client and returns the device
+// code for the device to poll with
+func (s *DeviceCodeService) Create(clientID, scope string) (string, models.DeviceCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	deviceCode, err := newOpaqueToken()
+	if err != nil {
+		return "", models.DeviceCode{}, err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return "", models.DeviceCode{}, err
+	}
+	now := time.Now()
+	dc := models.DeviceCode{
+		DeviceCodeHash: hashToken(deviceCode),
+		UserCode:       userCode,
+		ClientID:       clientID,
+		Scope:          scope,
+		Status:         models.DeviceStatusPending,
+		Interval:       s.interval,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(s.ttl),
+	}
+	res, err := s.collection.InsertOne(ctx, dc)
+	if err != nil {
+		return "", models.DeviceCode{}, err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		dc.ID = oid
+	}
+	return deviceCode, dc, nil
+}
+
+// FindPending returns the unexpired pending authorization for a user code as
+// typed by the user, or a zero DeviceCode if none exists
+func (s *DeviceCodeService) FindPending(userCode string) (models.DeviceCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var dc models.DeviceCode
+	filter := bson.M{
+		"user_code":  NormalizeUserCode(userCode),
+		"status":     models.DeviceStatusPending,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	if err := s.collection.FindOne(ctx, filter).Decode(&dc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.DeviceCode{}, nil
+		}
+		return models.DeviceCode{}, err
+	}
+	return dc, nil
+}
+
+// Approve grants a pending authorization to the user; returns false if it is
+// no longer pending
+func (s *DeviceCodeService) Approve(id, userID primitive.ObjectID) (bool, error) {
+	return s.decide(id, bson.M{"status": models.DeviceStatusApproved, "user_id": userID, "auth_time": time.Now()})
+}
+
+// Deny rejects a pending authorization; returns false if it is no longer pending
+func (s *DeviceCodeService) Deny(id primitive.ObjectID) (bool, error) {
+	return s.decide(id, bson.M{"status": models.DeviceStatusDenied})
+}
+
+func (s *DeviceCodeService) decide(id primitive.ObjectID, set bson.M) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": models.DeviceStatusPending, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// Poll is called by the device with its device code. It returns the approved
+// authorization exactly once; otherwise one of ErrAuthorizationPending,
+// ErrSlowDown, ErrDeviceAccessDenied, ErrDeviceCodeExpired or ErrDeviceCodeInvalid.
+func (s *DeviceCodeService) Poll(deviceCode, clientID string) (models.DeviceCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	var dc models.DeviceCode
+	err := s.collection.FindOne(ctx, bson.M{"device_code_hash": hashToken(deviceCode), "client_id": clientID}).Decode(&dc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.DeviceCode{}, ErrDeviceCodeInvalid
+		}
+		return models.DeviceCode{}, err
+	}
+	if !dc.ExpiresAt.After(now) {
+		return models.DeviceCode{}, ErrDeviceCodeExpired
+	}
+
+	// record the poll unless the previous one was less than an interval ago,
+	// in which case the device has to back off further
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": dc.ID, "$or": bson.A{
+			bson.M{"last_polled_at": nil},
+			bson.M{"last_polled_at": bson.M{"$lte": now.Add(-time.Duration(dc.Interval) * time.Second)}},
+		}},
+		bson.M{"$set": bson.M{"last_polled_at": now}},
+	)
+	if err != nil {
+		return models.DeviceCode{}, err
+	}
+	if res.MatchedCount == 0 {
+		_, err := s.collection.UpdateOne(ctx,
+			bson.M{"_id": dc.ID},
+			bson.M{"$set": bson.M{"last_polled_at": now}, "$inc": bson.M{"interval": slowDownStep}},
+		)
+		if err != nil {
+			return models.DeviceCode{}, err
+		}
+		return models.DeviceCode{}, ErrSlowDown
+	}
+
+	switch dc.Status {
+	case models.DeviceStatusPending:
+		return models.DeviceCode{}, ErrAuthorizationPending
+	case models.DeviceStatusDenied:
+		return models.DeviceCode{}, ErrDeviceAccessDenied
+	case models.DeviceStatusApproved:
+		// tokens are handed out once
+		err := s.collection.FindOneAndUpdate(ctx,
+			bson.M{"_id": dc.ID, "status": models.DeviceStatusApproved},
+			bson.M{"$set": bson.M{"status": models.DeviceStatusUsed}},
+		).Decode(&dc)
+		if err == mongo.ErrNoDocuments {
+			return models.DeviceCode{}, ErrDeviceCodeInvalid
+		}
+		if err != nil {
+			return models.DeviceCode{}, err
+		}
+		return dc, nil
+	}
+	return models.DeviceCode{}, ErrDeviceCodeInvalid
+}
+
+// NormalizeUserCode strips separators and case from a user code as typed
+func NormalizeUserCode(code string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// FormatUserCode renders a user code for display, as XXXX-XXXX
+func FormatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+func newUserCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	limit := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrVerificationTokenInvalid is returned for unknown, expired or already used verification tokens
+var ErrVerificationTokenInvalid = errors.New("invalid or expired verification token")
+
+// EmailVerificationService stores single-use, expiring email verification tokens
+type EmailVerificationService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	ttl        time.Duration
+}
+
+// NewEmailVerificationService constructs an EmailVerificationService issuing tokens valid for ttl
+func NewEmailVerificationService(coll *mongo.Collection, ttl time.Duration) *EmailVerificationService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return &EmailVerificationService{collection: coll, timeout: 5 * time.Second, ttl: ttl}
+}
+
+// TTL returns how long issued verification tokens stay valid
+func (s *EmailVerificationService) TTL() time.Duration {
+	return s.ttl
+}
+
+// Create issues a token verifying email for the user, replacing any outstanding one
+func (s *EmailVerificationService) Create(userID primitive.ObjectID, email string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if _, err := s.collection.DeleteMany(ctx, bson.M{"user_id": userID}); err != nil {
+		return "", err
+	}
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	ev := models.EmailVerification{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	if _, err := s.collection.InsertOne(ctx, ev); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Consume marks the token as used and returns it; a token can only be consumed once
+func (s *EmailVerificationService) Consume(token string) (models.EmailVerification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"token_hash": hashToken(token),
+		"used_at":    nil,
+		"expires_at": bson.M{"$gt": now},
+	}
+	var ev models.EmailVerification
+	if err := s.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}).Decode(&ev); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.EmailVerification{}, ErrVerificationTokenInvalid
+		}
+		return models.EmailVerification{}, err
+	}
+	return ev, nil
+}
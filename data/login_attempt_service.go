@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LockoutPolicy controls when repeated failures lock a key. Once Threshold
+// failures are counted the key is locked for BaseDelay, doubling with every
+// further failure up to MaxDelay. Failures are forgotten Window after the last
+// one, or with FixedWindow, Window after the first one however many follow.
+type LockoutPolicy struct {
+	Threshold   int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Window      time.Duration
+	FixedWindow bool
+}
+
+var (
+	// DefaultAccountLockout applies to failures against a single username
+	DefaultAccountLockout = LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute, Window: 24 * time.Hour}
+	// DefaultIPLockout applies to failures from a single client IP across
+	// usernames. Busy networks share an IP, so the count starts over every hour
+	// rather than growing for as long as someone there keeps mistyping.
+	DefaultIPLockout = LockoutPolicy{Threshold: 50, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour, FixedWindow: true}
+)
+
+// delay returns the lock duration after the given number of counted failures
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := p.Threshold; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// LoginAttemptService tracks failed logins per account and per client IP. An
+// account's failures are cleared once it signs in; those of an IP are not, so
+// that signing in to an account of one's own does not clear them.
+type LoginAttemptService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	account    LockoutPolicy
+	ip         LockoutPolicy
+}
+
+// NewLoginAttemptService constructs a LoginAttemptService
+func NewLoginAttemptService(coll *mongo.Collection, account, ip LockoutPolicy) *LoginAttemptService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return &LoginAttemptService{collection: coll, timeout: 5 * time.Second, account: account, ip: ip}
+}
+
+func accountKey(username string) string { return "user:" + username }
+func ipKey(ip string) string            { return "ip:" + ip }
+
+// LockedFor returns how long logins for username from ip are still locked, or 0
+func (s *LoginAttemptService) LockedFor(username, ip string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"_id":          bson.M{"$in": bson.A{accountKey(username), ipKey(ip)}},
+		"locked_until": bson.M{"$gt": now},
+	}
+	cur, err := s.collection.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var locked []models.LoginAttempt
+	if err := cur.All(ctx, &locked); err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	for _, a := range locked {
+		if d := a.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// RecordFailure counts a failed login for username and ip, locking them when
+// their policy threshold is reached
+func (s *LoginAttemptService) RecordFailure(username, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if err := s.recordFailure(ctx, accountKey(username), s.account); err != nil {
+		return err
+	}
+	return s.recordFailure(ctx, ipKey(ip), s.ip)
+}
+
+func (s *LoginAttemptService) recordFailure(ctx context.Context, key string, policy LockoutPolicy) error {
+	now := time.Now()
+	// the TTL monitor may not have removed an expired count yet
+	if _, err := s.collection.DeleteOne(ctx, bson.M{"_id": key, "expires_at": bson.M{"$lte": now}}); err != nil {
+		return err
+	}
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"last_failure": now, "expires_at": now.Add(policy.Window)},
+	}
+	if policy.FixedWindow {
+		update["$set"] = bson.M{"last_failure": now}
+		update["$setOnInsert"] = bson.M{"expires_at": now.Add(policy.Window)}
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var attempt models.LoginAttempt
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&attempt); err != nil {
+		return err
+	}
+	if d := policy.delay(attempt.Failures); d > 0 {
+		// the count is kept at least as long as the lock
+		update := bson.M{
+			"$set": bson.M{"locked_until": now.Add(d)},
+			"$max": bson.M{"expires_at": now.Add(d)},
+		}
+		_, err := s.collection.UpdateOne(ctx, bson.M{"_id": key}, update)
+		return err
+	}
+	return nil
+}
+
+// ResetAccount clears failures and any lock for username
+func (s *LoginAttemptService) ResetAccount(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": accountKey(username)})
+	return err
+}
@@ -0,0 +1,50 @@
+package data_test
+
+import (
+	"testing"
+	"time"
+
+	"authgo/data"
+	"authgo/data/datatest"
+)
+
+func TestIPFailuresCountInFixedWindows(t *testing.T) {
+	db := datatest.Database(t)
+	ip := data.LockoutPolicy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: time.Minute, Window: time.Second, FixedWindow: true}
+	attempts := data.NewLoginAttemptService(db.Collection("login_attempts"), data.DefaultAccountLockout, ip)
+
+	// failures against different accounts, kept apart by a window
+	for _, username := range []string{"alice", "bob"} {
+		if err := attempts.RecordFailure(username, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := attempts.RecordFailure("carol", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := attempts.LockedFor("dave", "192.0.2.1"); err != nil || wait != 0 {
+		t.Fatalf("locked for %v, err %v, want failures of the last window forgotten", wait, err)
+	}
+
+	// a sign-in does not clear the count of its IP
+	for _, username := range []string{"erin", "frank"} {
+		if err := attempts.RecordFailure(username, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := attempts.ResetAccount("frank"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := attempts.LockedFor("dave", "192.0.2.1"); err != nil || wait <= 0 {
+		t.Fatalf("locked for %v, err %v, want the IP locked after 3 failures in a window", wait, err)
+	}
+	// the lock outlasts the window it was counted in
+	time.Sleep(1100 * time.Millisecond)
+	if err := attempts.RecordFailure("grace", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := attempts.LockedFor("dave", "192.0.2.1"); err != nil || wait <= 0 {
+		t.Errorf("locked for %v, err %v, want the lock kept after the window", wait, err)
+	}
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrClientInvalid is returned when client authentication fails
+var ErrClientInvalid = errors.New("invalid client")
+
+// OAuthClientService manages registered OAuth clients
+type OAuthClientService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+}
+
+// NewOAuthClientService constructs an OAuthClientService
+func NewOAuthClientService(coll *mongo.Collection) *OAuthClientService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "client_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return &OAuthClientService{collection: coll, timeout: 5 * time.Second}
+}
+
+// Create registers a client. Confidential clients get a secret, returned only here.
+func (s *OAuthClientService) Create(c models.OAuthClient) (string, models.OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	clientID, err := newOpaqueToken()
+	if err != nil {
+		return "", models.OAuthClient{}, err
+	}
+	c.ClientID = clientID[:24]
+	c.CreatedAt = time.Now()
+
+	secret := ""
+	if !c.Public {
+		if secret, err = newOpaqueToken(); err != nil {
+			return "", models.OAuthClient{}, err
+		}
+		c.SecretHash = hashToken(secret)
+	}
+	res, err := s.collection.InsertOne(ctx, c)
+	if err != nil {
+		return "", models.OAuthClient{}, err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		c.ID = oid
+	}
+	return secret, c, nil
+}
+
+// List returns all registered clients
+func (s *OAuthClientService) List() ([]models.OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	cur, err := s.collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var clients []models.OAuthClient
+	if err := cur.All(ctx, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// Find returns the client with clientID, or a zero client if none exists
+func (s *OAuthClientService) Find(clientID string) (models.OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var c models.OAuthClient
+	if err := s.collection.FindOne(ctx, bson.M{"client_id": clientID}).Decode(&c); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.OAuthClient{}, nil
+		}
+		return models.OAuthClient{}, err
+	}
+	return c, nil
+}
+
+// Authenticate verifies the client credentials. Public clients authenticate
+// with their client id alone and must not present a secret.
+func (s *OAuthClientService) Authenticate(clientID, secret string) (models.OAuthClient, error) {
+	c, err := s.Find(clientID)
+	if err != nil {
+		return models.OAuthClient{}, err
+	}
+	if c.ClientID == "" {
+		return models.OAuthClient{}, ErrClientInvalid
+	}
+	if c.Public {
+		if secret != "" {
+			return models.OAuthClient{}, ErrClientInvalid
+		}
+		return c, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) != 1 {
+		return models.OAuthClient{}, ErrClientInvalid
+	}
+	return c, nil
+}
+
+// Delete removes a client; returns false if none matched
+func (s *OAuthClientService) Delete(clientID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res, err := s.collection.DeleteOne(ctx, bson.M{"client_id": clientID})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
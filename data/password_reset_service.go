@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrResetTokenInvalid is returned for unknown, expired or already used reset tokens
+var ErrResetTokenInvalid = errors.New("invalid or expired reset token")
+
+// PasswordResetService stores single-use, expiring password reset tokens
+type PasswordResetService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	ttl        time.Duration
+}
+
+// NewPasswordResetService constructs a PasswordResetService issuing tokens valid for ttl
+func NewPasswordResetService(coll *mongo.Collection, ttl time.Duration) *PasswordResetService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return &PasswordResetService{collection: coll, timeout: 5 * time.Second, ttl: ttl}
+}
+
+// TTL returns how long issued reset tokens stay valid
+func (s *PasswordResetService) TTL() time.Duration {
+	return s.ttl
+}
+
+// Create issues a reset token for the user, replacing any outstanding one
+func (s *PasswordResetService) Create(userID primitive.ObjectID) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if _, err := s.collection.DeleteMany(ctx, bson.M{"user_id": userID}); err != nil {
+		return "", err
+	}
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	pr := models.PasswordReset{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	if _, err := s.collection.InsertOne(ctx, pr); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Find returns the reset token if it is still valid, without consuming it
+func (s *PasswordResetService) Find(token string) (models.PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{
+		"token_hash": hashToken(token),
+		"used_at":    nil,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	var pr models.PasswordReset
+	if err := s.collection.FindOne(ctx, filter).Decode(&pr); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.PasswordReset{}, ErrResetTokenInvalid
+		}
+		return models.PasswordReset{}, err
+	}
+	return pr, nil
+}
+
+// Consume marks the token as used and returns it; a token can only be consumed once
+func (s *PasswordResetService) Consume(token string) (models.PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"token_hash": hashToken(token),
+		"used_at":    nil,
+		"expires_at": bson.M{"$gt": now},
+	}
+	var pr models.PasswordReset
+	if err := s.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}).Decode(&pr); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.PasswordReset{}, ErrResetTokenInvalid
+		}
+		return models.PasswordReset{}, err
+	}
+	return pr, nil
+}
@@ -0,0 +1,219 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned for unknown, expired or revoked refresh tokens
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is presented again
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+// RefreshTokenService stores opaque refresh tokens and rotates them on use
+type RefreshTokenService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	ttl        time.Duration
+}
+
+// NewRefreshTokenService constructs a RefreshTokenService issuing tokens valid for ttl
+func NewRefreshTokenService(coll *mongo.Collection, ttl time.Duration) *RefreshTokenService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			// expired tokens are removed by mongo
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return &RefreshTokenService{collection: coll, timeout: 5 * time.Second, ttl: ttl}
+}
+
+// TTL returns how long issued refresh tokens stay valid
+func (s *RefreshTokenService) TTL() time.Duration {
+	return s.ttl
+}
+
+// Issue starts a new token family for the user and returns the plaintext token
+func (s *RefreshTokenService) Issue(userID primitive.ObjectID) (string, models.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.insert(ctx, models.RefreshToken{UserID: userID, FamilyID: primitive.NewObjectID().Hex()})
+}
+
+// IssueForClient starts a new token family for a user's grant to an OAuth
+// client; authTime is when the user signed in to approve it
+func (s *RefreshTokenService) IssueForClient(userID primitive.ObjectID, clientID, scope string, authTime time.Time) (string, models.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.insert(ctx, models.RefreshToken{
+		UserID:   userID,
+		FamilyID: primitive.NewObjectID().Hex(),
+		ClientID: clientID,
+		Scope:    scope,
+		AuthTime: authTime,
+	})
+}
+
+// Rotate consumes a refresh token issued to clientID (empty for first-party
+// logins) and returns its successor in the same family. Presenting a token
+// that was already rotated revokes the whole family.
+func (s *RefreshTokenService) Rotate(token, clientID string) (string, models.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	hash := hashToken(token)
+	filter := bson.M{
+		"token_hash": hash,
+		"used_at":    nil,
+		"revoked_at": nil,
+		"expires_at": bson.M{"$gt": now},
+	}
+	if clientID == "" {
+		filter["client_id"] = nil
+	} else {
+		filter["client_id"] = clientID
+	}
+	var current models.RefreshToken
+	err := s.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}).Decode(&current)
+	if err == mongo.ErrNoDocuments {
+		// find out why the token could not be consumed
+		var existing models.RefreshToken
+		if err := s.collection.FindOne(ctx, bson.M{"token_hash": hash}).Decode(&existing); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return "", models.RefreshToken{}, ErrRefreshTokenInvalid
+			}
+			return "", models.RefreshToken{}, err
+		}
+		if existing.UsedAt != nil {
+			if err := s.revokeFamily(ctx, existing.FamilyID); err != nil {
+				return "", models.RefreshToken{}, err
+			}
+			return "", models.RefreshToken{}, ErrRefreshTokenReused
+		}
+		return "", models.RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return "", models.RefreshToken{}, err
+	}
+	return s.insert(ctx, current)
+}
+
+// Find returns the stored refresh token, or a zero token if none exists
+func (s *RefreshTokenService) Find(token string) (models.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var rt models.RefreshToken
+	if err := s.collection.FindOne(ctx, bson.M{"token_hash": hashToken(token)}).Decode(&rt); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.RefreshToken{}, nil
+		}
+		return models.RefreshToken{}, err
+	}
+	return rt, nil
+}
+
+// RevokeFamily revokes every token belonging to the family
+func (s *RefreshTokenService) RevokeFamily(familyID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.revokeFamily(ctx, familyID)
+}
+
+// RevokeToken revokes the family of the given token if it belongs to userID
+func (s *RefreshTokenService) RevokeToken(token string, userID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var rt models.RefreshToken
+	err := s.collection.FindOne(ctx, bson.M{"token_hash": hashToken(token), "user_id": userID}).Decode(&rt)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.revokeFamily(ctx, rt.FamilyID)
+}
+
+// RevokeClient revokes every refresh token issued to an OAuth client
+func (s *RefreshTokenService) RevokeClient(clientID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateMany(ctx,
+		bson.M{"client_id": clientID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// RevokeUser revokes every refresh token issued to the user
+func (s *RefreshTokenService) RevokeUser(userID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+func (s *RefreshTokenService) revokeFamily(ctx context.Context, familyID string) error {
+	_, err := s.collection.UpdateMany(ctx,
+		bson.M{"family_id": familyID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// insert stores a new token continuing the family, user and grant of from
+func (s *RefreshTokenService) insert(ctx context.Context, from models.RefreshToken) (string, models.RefreshToken, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", models.RefreshToken{}, err
+	}
+	now := time.Now()
+	rt := models.RefreshToken{
+		TokenHash: hashToken(token),
+		FamilyID:  from.FamilyID,
+		UserID:    from.UserID,
+		ClientID:  from.ClientID,
+		Scope:     from.Scope,
+		AuthTime:  from.AuthTime,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	res, err := s.collection.InsertOne(ctx, rt)
+	if err != nil {
+		return "", models.RefreshToken{}, err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		rt.ID = oid
+	}
+	return token, rt, nil
+}
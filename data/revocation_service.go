@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"authgo/cache"
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RevocationService keeps the list of revoked access tokens. Lookups are cached
+// in-process: revocations are remembered until the token expires, while "not
+// revoked" answers are only trusted for a short time so revocations made on other
+// instances are picked up quickly.
+type RevocationService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+	cache      *cache.TTL[string, bool]
+}
+
+// NewRevocationService constructs a RevocationService
+func NewRevocationService(coll *mongo.Collection) *RevocationService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return &RevocationService{
+		collection: coll,
+		timeout:    5 * time.Second,
+		cache:      cache.New[string, bool](30 * time.Second),
+	}
+}
+
+// Revoke marks the token identified by jti as revoked until expiresAt
+func (s *RevocationService) Revoke(jti string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	doc := models.RevokedToken{JTI: jti, RevokedAt: time.Now(), ExpiresAt: expiresAt}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := s.collection.ReplaceOne(ctx, bson.M{"_id": jti}, doc, opts); err != nil {
+		return err
+	}
+	s.cache.SetUntil(jti, true, expiresAt)
+	return nil
+}
+
+// RevokeOnce revokes jti like Revoke, but only if it was not revoked before;
+// it returns false if it already was. Single-use tokens are consumed with it.
+func (s *RevocationService) RevokeOnce(jti string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	doc := models.RevokedToken{JTI: jti, RevokedAt: time.Now(), ExpiresAt: expiresAt}
+	if _, err := s.collection.InsertOne(ctx, doc); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	s.cache.SetUntil(jti, true, expiresAt)
+	return true, nil
+}
+
+// IsRevoked reports whether the token identified by jti has been revoked
+func (s *RevocationService) IsRevoked(jti string) (bool, error) {
+	if revoked, ok := s.cache.Get(jti); ok {
+		return revoked, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var doc models.RevokedToken
+	err := s.collection.FindOne(ctx, bson.M{"_id": jti}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		s.cache.Set(jti, false)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.cache.SetUntil(jti, true, doc.ExpiresAt)
+	return true, nil
+}
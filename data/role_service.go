@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrRoleExists is returned when creating a role with an existing name
+	ErrRoleExists = errors.New("role already exists")
+	// ErrBuiltInRole is returned when deleting a built-in role or changing admin
+	ErrBuiltInRole = errors.New("built-in role cannot be changed")
+)
+
+// RoleService manages roles in MongoDB
+type RoleService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+}
+
+// NewRoleService constructs a RoleService and seeds the built-in roles. admin
+// is reset to every permission on each start so that it picks up new ones;
+// user keeps whatever permissions it was given.
+func NewRoleService(coll *mongo.Collection) *RoleService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now()
+	opts := options.Update().SetUpsert(true)
+	_, _ = coll.UpdateOne(ctx, bson.M{"_id": models.RoleAdmin}, bson.M{
+		"$set":         bson.M{"permissions": models.Permissions, "built_in": true},
+		"$setOnInsert": bson.M{"description": "Full access", "created_at": now, "updated_at": now},
+	}, opts)
+	_, _ = coll.UpdateOne(ctx, bson.M{"_id": models.RoleUser}, bson.M{
+		"$set": bson.M{"built_in": true},
+		"$setOnInsert": bson.M{
+			"description": "Default role of new users",
+			"permissions": []string{models.PermTasksRead},
+			"created_at":  now,
+			"updated_at":  now,
+		},
+	}, opts)
+	return &RoleService{collection: coll, timeout: 5 * time.Second}
+}
+
+// Create stores a new role. Returns ErrRoleExists if the name is taken.
+func (s *RoleService) Create(r models.Role) (models.Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	r.BuiltIn = false
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = r.CreatedAt
+	if _, err := s.collection.InsertOne(ctx, r); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return models.Role{}, ErrRoleExists
+		}
+		return models.Role{}, err
+	}
+	return r, nil
+}
+
+// List returns all roles by name
+func (s *RoleService) List() ([]models.Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	cur, err := s.collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	roles := []models.Role{}
+	if err := cur.All(ctx, &roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// Find returns the role with name, or a zero role if none exists
+func (s *RoleService) Find(name string) (models.Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var r models.Role
+	if err := s.collection.FindOne(ctx, bson.M{"_id": name}).Decode(&r); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.Role{}, nil
+		}
+		return models.Role{}, err
+	}
+	return r, nil
+}
+
+// AllExist reports whether every named role exists
+func (s *RoleService) AllExist(names []string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	names = models.NormalizeRoles(names)
+	n, err := s.collection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": names}})
+	if err != nil {
+		return false, err
+	}
+	return n == int64(len(names)), nil
+}
+
+// Update replaces the description and permissions of a role; returns the
+// updated role, or a zero role if none exists. The admin role cannot be
+// changed and returns ErrBuiltInRole.
+func (s *RoleService) Update(name, description string, permissions []string) (models.Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if name == models.RoleAdmin {
+		return models.Role{}, ErrBuiltInRole
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$set": bson.M{"description": description, "permissions": permissions, "updated_at": time.Now()}}
+	var r models.Role
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": name}, update, opts).Decode(&r); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.Role{}, nil
+		}
+		return models.Role{}, err
+	}
+	return r, nil
+}
+
+// Delete removes a role; returns false if none matched. Built-in roles
+// cannot be deleted and return ErrBuiltInRole.
+func (s *RoleService) Delete(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if name == models.RoleAdmin || name == models.RoleUser {
+		return false, ErrBuiltInRole
+	}
+	res, err := s.collection.DeleteOne(ctx, bson.M{"_id": name})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// initActiveAdmins stores the number of active admins on the admin role
+// unless it is already counted
+func (s *RoleService) initActiveAdmins(ctx context.Context, n int64) error {
+	filter := bson.M{"_id": models.RoleAdmin, "active_admins": bson.M{"$exists": false}}
+	_, err := s.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"active_admins": n}})
+	return err
+}
+
+// takeActiveAdmin decrements the count of active admins unless that would
+// leave none, and reports whether it did
+func (s *RoleService) takeActiveAdmin(ctx context.Context) (bool, error) {
+	filter := bson.M{"_id": models.RoleAdmin, "active_admins": bson.M{"$gt": 1}}
+	res, err := s.collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"active_admins": -1}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// addActiveAdmin increments the count of active admins
+func (s *RoleService) addActiveAdmin(ctx context.Context) error {
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": models.RoleAdmin}, bson.M{"$inc": bson.M{"active_admins": 1}})
+	return err
+}
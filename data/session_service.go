@@ -0,0 +1,304 @@
+package data
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"authgo/cache"
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrSessionInvalid is returned for unknown, expired or ended sessions
+var ErrSessionInvalid = errors.New("invalid session")
+
+// SessionService records logins. Browser sessions end after being idle for
+// idleTTL, and absoluteTTL after login regardless of activity; token logins
+// last as long as their refresh token family. Lookups by id are cached
+// in-process for a short time, so a session ended on another instance stops
+// working there within that time.
+type SessionService struct {
+	collection  *mongo.Collection
+	timeout     time.Duration
+	idleTTL     time.Duration
+	absoluteTTL time.Duration
+	live        *cache.TTL[string, models.Session]
+}
+
+// NewSessionService constructs a SessionService
+func NewSessionService(coll *mongo.Collection, idleTTL, absoluteTTL time.Duration) *SessionService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"token_hash": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			// idle and expired sessions are removed by mongo
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return &SessionService{
+		collection:  coll,
+		timeout:     5 * time.Second,
+		idleTTL:     idleTTL,
+		absoluteTTL: absoluteTTL,
+		live:        cache.New[string, models.Session](30 * time.Second),
+	}
+}
+
+// AbsoluteTTL returns the longest a session can last
+func (s *SessionService) AbsoluteTTL() time.Duration {
+	return s.absoluteTTL
+}
+
+// Create starts a browser session for u and returns the plaintext session and
+// CSRF tokens, which are not retrievable afterwards
+func (s *SessionService) Create(u models.User, client models.SessionClient) (string, string, models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", "", models.Session{}, err
+	}
+	csrf, err := newOpaqueToken()
+	if err != nil {
+		return "", "", models.Session{}, err
+	}
+	now := time.Now()
+	sess := models.Session{
+		TokenHash:         hashToken(token),
+		CSRFHash:          hashToken(csrf),
+		UserID:            u.ID,
+		TokenVersion:      u.TokenVersion,
+		IP:                client.IP,
+		UserAgent:         client.UserAgent,
+		CreatedAt:         now,
+		LastSeenAt:        now,
+		ExpiresAt:         s.idleDeadline(now, now.Add(s.absoluteTTL)),
+		AbsoluteExpiresAt: now.Add(s.absoluteTTL),
+	}
+	if err := s.insert(ctx, &sess); err != nil {
+		return "", "", models.Session{}, err
+	}
+	return token, csrf, sess, nil
+}
+
+// Track records a token login whose refresh token family expires at expiresAt
+func (s *SessionService) Track(u models.User, familyID string, client models.SessionClient, expiresAt time.Time) (models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	sess := models.Session{
+		FamilyID:          familyID,
+		UserID:            u.ID,
+		TokenVersion:      u.TokenVersion,
+		IP:                client.IP,
+		UserAgent:         client.UserAgent,
+		CreatedAt:         now,
+		LastSeenAt:        now,
+		ExpiresAt:         expiresAt,
+		AbsoluteExpiresAt: expiresAt,
+	}
+	if err := s.insert(ctx, &sess); err != nil {
+		return models.Session{}, err
+	}
+	return sess, nil
+}
+
+func (s *SessionService) insert(ctx context.Context, sess *models.Session) error {
+	res, err := s.collection.InsertOne(ctx, sess)
+	if err != nil {
+		return err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		sess.ID = oid
+	}
+	return nil
+}
+
+// Authenticate returns the browser session for token and extends its idle
+// deadline. Returns ErrSessionInvalid if the session does not exist or has
+// expired.
+func (s *SessionService) Authenticate(token string) (models.Session, error) {
+	return s.active(bson.M{"token_hash": hashToken(token)})
+}
+
+// Active returns the session with the given hex id, recording that it was
+// used. Returns ErrSessionInvalid if the session was ended or has expired.
+func (s *SessionService) Active(hexID string) (models.Session, error) {
+	sess, ok := s.live.Get(hexID)
+	if !ok {
+		oid, err := primitive.ObjectIDFromHex(hexID)
+		if err != nil {
+			return models.Session{}, ErrSessionInvalid
+		}
+		sess, err = s.active(bson.M{"_id": oid})
+		if err != nil && !errors.Is(err, ErrSessionInvalid) {
+			return models.Session{}, err
+		}
+		// ended sessions are cached too, as a zero Session
+		s.live.Set(hexID, sess)
+	}
+	if sess.ID.IsZero() || time.Now().After(sess.ExpiresAt) {
+		return models.Session{}, ErrSessionInvalid
+	}
+	return sess, nil
+}
+
+func (s *SessionService) active(filter bson.M) (models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	filter["expires_at"] = bson.M{"$gt": now}
+	var sess models.Session
+	err := s.collection.FindOne(ctx, filter).Decode(&sess)
+	if err == mongo.ErrNoDocuments {
+		return models.Session{}, ErrSessionInvalid
+	}
+	if err != nil {
+		return models.Session{}, err
+	}
+	// write activity at most once per minute
+	if now.Sub(sess.LastSeenAt) < lastUsedGranularity {
+		return sess, nil
+	}
+	set := bson.M{"last_seen_at": now}
+	if sess.TokenHash != "" {
+		// browser sessions expire when idle
+		sess.ExpiresAt = s.idleDeadline(now, sess.AbsoluteExpiresAt)
+		set["expires_at"] = sess.ExpiresAt
+	}
+	_, err = s.collection.UpdateOne(ctx, bson.M{"_id": sess.ID, "last_seen_at": sess.LastSeenAt}, bson.M{"$set": set})
+	if err != nil {
+		return models.Session{}, err
+	}
+	sess.LastSeenAt = now
+	return sess, nil
+}
+
+// Refreshed records that the refresh token family was rotated and now expires
+// at expiresAt. It returns a zero session if the family's login is not tracked.
+func (s *SessionService) Refreshed(familyID string, expiresAt time.Time) (models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"last_seen_at": time.Now(), "expires_at": expiresAt, "absolute_expires_at": expiresAt}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var sess models.Session
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"family_id": familyID}, update, opts).Decode(&sess); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.Session{}, nil
+		}
+		return models.Session{}, err
+	}
+	s.live.Set(sess.ID.Hex(), sess)
+	return sess, nil
+}
+
+// ListByUser returns the user's unexpired sessions started at tokenVersion,
+// most recently used first
+func (s *SessionService) ListByUser(userID primitive.ObjectID, tokenVersion int) ([]models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "token_version": tokenVersion, "expires_at": bson.M{"$gt": time.Now()}}
+	cur, err := s.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "last_seen_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	sessions := []models.Session{}
+	if err := cur.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteForUser ends one of the user's sessions and returns it, or a zero
+// session if the user has no such session
+func (s *SessionService) DeleteForUser(userID primitive.ObjectID, hexID string) (models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	oid, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return models.Session{}, nil
+	}
+	var sess models.Session
+	if err := s.collection.FindOneAndDelete(ctx, bson.M{"_id": oid, "user_id": userID}).Decode(&sess); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.Session{}, nil
+		}
+		return models.Session{}, err
+	}
+	s.live.Delete(hexID)
+	return sess, nil
+}
+
+// idleDeadline returns when a session used at now expires if left idle
+func (s *SessionService) idleDeadline(now, absolute time.Time) time.Time {
+	if idle := now.Add(s.idleTTL); idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+// Delete ends the browser session identified by token
+func (s *SessionService) Delete(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var sess models.Session
+	err := s.collection.FindOneAndDelete(ctx, bson.M{"token_hash": hashToken(token)}).Decode(&sess)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.live.Delete(sess.ID.Hex())
+	return nil
+}
+
+// DeleteByUser ends every session of the user
+func (s *SessionService) DeleteByUser(userID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID}
+	cur, err := s.collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var ended []models.Session
+	if err := cur.All(ctx, &ended); err != nil {
+		return err
+	}
+	if _, err := s.collection.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+	for _, sess := range ended {
+		s.live.Delete(sess.ID.Hex())
+	}
+	return nil
+}
+
+// CSRFTokenMatches reports whether token is the CSRF token issued with sess
+func CSRFTokenMatches(sess models.Session, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(sess.CSRFHash)) == 1
+}
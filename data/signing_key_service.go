@@ -0,0 +1,110 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"authgo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SigningKeyService stores JWT signing keys so that every instance signs and
+// verifies with the same key set
+type SigningKeyService struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+}
+
+// NewSigningKeyService constructs a SigningKeyService
+func NewSigningKeyService(coll *mongo.Collection) *SigningKeyService {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		// retired keys are removed once no token signed by them can still be valid
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return &SigningKeyService{collection: coll, timeout: 5 * time.Second}
+}
+
+// List returns all keys that are still published, newest first
+func (s *SigningKeyService) List() ([]models.SigningKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"expires_at": nil},
+		bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+	}}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	cur, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var keys []models.SigningKey
+	if err := cur.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Insert stores a new signing key
+func (s *SigningKeyService) Insert(k models.SigningKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.collection.InsertOne(ctx, k)
+	return err
+}
+
+// Retire retires kid if it is still active, reporting whether it was; it
+// stays published until expiresAt
+func (s *SigningKeyService) Retire(kid string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": kid, "retired_at": nil},
+		bson.M{"$set": bson.M{"retired_at": time.Now(), "expires_at": expiresAt}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// RetireOlder retires every active key older than kid, created at
+// createdAt; retired keys stay published until expiresAt
+func (s *SigningKeyService) RetireOlder(kid string, createdAt, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{"retired_at": nil, "$or": bson.A{
+		bson.M{"created_at": bson.M{"$lt": createdAt}},
+		// keys created within the same millisecond are ordered by kid
+		bson.M{"created_at": createdAt, "_id": bson.M{"$lt": kid}},
+	}}
+	_, err := s.collection.UpdateMany(ctx, filter,
+		bson.M{"$set": bson.M{"retired_at": time.Now(), "expires_at": expiresAt}},
+	)
+	return err
+}
+
+// HasNewerActive reports whether an active key is newer than kid, created at
+// createdAt
+func (s *SigningKeyService) HasNewerActive(kid string, createdAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{"retired_at": nil, "$or": bson.A{
+		bson.M{"created_at": bson.M{"$gt": createdAt}},
+		bson.M{"created_at": createdAt, "_id": bson.M{"$gt": kid}},
+	}}
+	n, err := s.collection.CountDocuments(ctx, filter)
+	return n > 0, err
+}
@@ -3,44 +3,124 @@ package data
 import (
 	"context"
 	"errors"
+	"net/mail"
+	"slices"
+	"strings"
 	"time"
 
 	"authgo/models"
+	"authgo/passhash"
+	"authgo/passpolicy"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	// ErrUsernameTaken is returned when creating a user with an existing username
+	ErrUsernameTaken = errors.New("username already exists")
+	// ErrInvalidCredentials is returned by Authenticate for an unknown user or wrong password
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrInvalidEmail is returned for malformed email addresses
+	ErrInvalidEmail = errors.New("invalid email address")
+	// ErrEmailTaken is returned when the email address belongs to another user
+	ErrEmailTaken = errors.New("email address already in use")
+	// ErrCredentialExists is returned when registering a WebAuthn credential twice
+	ErrCredentialExists = errors.New("credential already registered")
+	// ErrUserDisabled is returned by Authenticate for the correct password of
+	// a disabled account
+	ErrUserDisabled = errors.New("account disabled")
+	// ErrLastAdmin is returned by changes that would leave no enabled admin
+	ErrLastAdmin = errors.New("cannot remove the last admin")
+)
+
+// activeAdminFilter matches enabled users with the admin role
+var activeAdminFilter = bson.M{"roles": models.RoleAdmin, "disabled": bson.M{"$ne": true}}
+
 // UserService manages users in MongoDB
 type UserService struct {
 	collection *mongo.Collection
 	timeout    time.Duration
+	// roles keeps the count of active admins, see changeUser
+	roles  *RoleService
+	hasher *passhash.Manager
+	policy *passpolicy.Policy
+	// dummyHash is compared against for unknown usernames so that Authenticate
+	// takes as long as for a wrong password
+	dummyHash string
 }
 
-// NewUserService constructs a UserService
-func NewUserService(coll *mongo.Collection) *UserService {
+// NewUserService constructs a UserService hashing passwords with hasher and
+// enforcing policy on every new password. roles must have seeded the built-in
+// roles.
+func NewUserService(coll *mongo.Collection, roles *RoleService, hasher *passhash.Manager, policy *passpolicy.Policy) *UserService {
 	// ensure unique username index
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, _ = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.D{{Key: "username", Value: 1}},
-		Options: options.Index().SetUnique(true),
+	_, _ = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// email is optional but unique when set
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"email": bson.M{"$exists": true}}),
+		},
+		{
+			// an external identity links to at most one user
+			Keys: bson.D{{Key: "identities.issuer", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.issuer": bson.M{"$exists": true}}),
+		},
+		{
+			// a WebAuthn credential belongs to one user
+			Keys: bson.D{{Key: "webauthn_credentials.id", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"webauthn_credentials.id": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "roles", Value: 1}}},
 	})
-	return &UserService{collection: coll, timeout: 5 * time.Second}
+	// users from before roles were introduced have a single role
+	_, _ = coll.UpdateMany(ctx, bson.M{"role": bson.M{"$exists": true}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"roles": bson.A{"$role"}}}},
+		{{Key: "$unset", Value: "role"}},
+	})
+	if n, err := coll.CountDocuments(ctx, activeAdminFilter); err == nil {
+		_ = roles.initActiveAdmins(ctx, n)
+	}
+	dummy, _ := hasher.Hash("dummy password")
+	return &UserService{collection: coll, timeout: 5 * time.Second, roles: roles, hasher: hasher, policy: policy, dummyHash: dummy}
 }
 
-// CreateUser hashes password and creates user. If DB empty -> first user becomes admin.
-func (s *UserService) CreateUser(username, password string) (models.User, error) {
+// ValidatePassword checks password against the password policy. Violations are
+// reported as a *passpolicy.Error.
+func (s *UserService) ValidatePassword(username, password string) error {
+	return s.policy.Validate(username, password)
+}
+
+// CreateUser hashes password and creates user with an optional, unverified
+// email address. If DB empty -> first user becomes admin.
+func (s *UserService) CreateUser(username, password, email string) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
 	defer cancel()
 
 	if username == "" || password == "" {
 		return models.User{}, errors.New("username and password required")
 	}
+	if email != "" {
+		var err error
+		if email, err = NormalizeEmail(email); err != nil {
+			return models.User{}, err
+		}
+	}
+	if err := s.policy.Validate(username, password); err != nil {
+		return models.User{}, err
+	}
 	// check existing
 	count, err := s.collection.CountDocuments(ctx, bson.M{})
 	if err != nil {
@@ -48,38 +128,48 @@ func (s *UserService) CreateUser(username, password string) (models.User, error)
 	}
 
 	// hash
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
 		return models.User{}, err
 	}
 
-	role := "user"
+	roles := []string{models.RoleUser}
 	if count == 0 {
-		role = "admin" // first user is admin
+		roles = []string{models.RoleAdmin} // first user is admin
 	}
 
 	u := models.User{
 		Username:     username,
-		PasswordHash: string(hash),
-		Role:         role,
+		PasswordHash: hash,
+		Roles:        roles,
+		Email:        email,
 	}
 
 	res, err := s.collection.InsertOne(ctx, u)
 	if err != nil {
 		// duplicate user will error because index created
+		if duplicateKeyOn(err, "email") {
+			return models.User{}, ErrEmailTaken
+		}
 		if mongo.IsDuplicateKeyError(err) {
-			return models.User{}, errors.New("username already exists")
+			return models.User{}, ErrUsernameTaken
 		}
 		return models.User{}, err
 	}
 	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
 		u.ID = oid
 	}
+	if u.HasRole(models.RoleAdmin) {
+		if err := s.roles.addActiveAdmin(ctx); err != nil {
+			return models.User{}, err
+		}
+	}
 	u.PasswordHash = "" // don't return hash
 	return u, nil
 }
 
-// Authenticate validates username/password and returns user if ok
+// Authenticate validates username/password and returns user if ok. Disabled
+// accounts return ErrUserDisabled.
 func (s *UserService) Authenticate(username, password string) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
 	defer cancel()
@@ -87,13 +177,34 @@ func (s *UserService) Authenticate(username, password string) (models.User, erro
 	var u models.User
 	if err := s.collection.FindOne(ctx, bson.M{"username": username}).Decode(&u); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return models.User{}, errors.New("invalid credentials")
+			// constant time: do the same hashing work as for a known user
+			_, _, _ = s.hasher.Verify(password, s.dummyHash)
+			return models.User{}, ErrInvalidCredentials
 		}
 		return models.User{}, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
-		return models.User{}, errors.New("invalid credentials")
+	if u.PasswordHash == "" {
+		// federated accounts without a local password
+		_, _, _ = s.hasher.Verify(password, s.dummyHash)
+		return models.User{}, ErrInvalidCredentials
+	}
+	ok, needsRehash, err := s.hasher.Verify(password, u.PasswordHash)
+	if err != nil || !ok {
+		return models.User{}, ErrInvalidCredentials
+	}
+	if u.Disabled {
+		return models.User{}, ErrUserDisabled
+	}
+	if needsRehash {
+		// upgrade to the current algorithm and parameters; the filter on the old
+		// hash keeps a concurrent password change from being overwritten
+		if hash, err := s.hasher.Hash(password); err == nil {
+			_, _ = s.collection.UpdateOne(ctx,
+				bson.M{"_id": u.ID, "password_hash": u.PasswordHash},
+				bson.M{"$set": bson.M{"password_hash": hash}},
+			)
+		}
 	}
 
 	// clear hash for returning
@@ -101,6 +212,82 @@ func (s *UserService) Authenticate(username, password string) (models.User, erro
 	return u, nil
 }
 
+// CreateFederatedUser creates a user without a local password, linked to an
+// external identity. Returns ErrUsernameTaken if the username is in use.
+func (s *UserService) CreateFederatedUser(username string, roles []string, identity models.FederatedIdentity) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if username == "" {
+		return models.User{}, errors.New("username required")
+	}
+	identity.LinkedAt = time.Now()
+	u := models.User{
+		Username:   username,
+		Roles:      models.NormalizeRoles(roles),
+		Identities: []models.FederatedIdentity{identity},
+	}
+	res, err := s.collection.InsertOne(ctx, u)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			// the identity may have been linked concurrently
+			if existing, ferr := s.FindByIdentity(identity.Issuer, identity.Subject); ferr == nil && existing.Username != "" {
+				return existing, nil
+			}
+			return models.User{}, ErrUsernameTaken
+		}
+		return models.User{}, err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		u.ID = oid
+	}
+	if u.HasRole(models.RoleAdmin) {
+		if err := s.roles.addActiveAdmin(ctx); err != nil {
+			return models.User{}, err
+		}
+	}
+	return u, nil
+}
+
+// FindByIdentity returns the user linked to the external identity, or a zero
+// user if none is
+func (s *UserService) FindByIdentity(issuer, subject string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}
+	var u models.User
+	if err := s.collection.FindOne(ctx, filter).Decode(&u); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, nil
+		}
+		return models.User{}, err
+	}
+	u.PasswordHash = ""
+	return u, nil
+}
+
+// SetRoles replaces the user's roles; returns updated user. Taking the admin
+// role from the last active admin returns ErrLastAdmin.
+func (s *UserService) SetRoles(userID primitive.ObjectID, roles []string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	roles = models.NormalizeRoles(roles)
+	update := bson.M{"$set": bson.M{"roles": roles}}
+	var removes, adds bson.M
+	if slices.Contains(roles, models.RoleAdmin) {
+		adds = bson.M{"roles": bson.M{"$ne": models.RoleAdmin}, "disabled": bson.M{"$ne": true}}
+	} else {
+		removes = activeAdminFilter
+	}
+	var updated models.User
+	_, err := s.changeUser(ctx, bson.M{"_id": userID}, removes, adds, func(filter bson.M) (bool, error) {
+		return s.updateOne(ctx, filter, update, &updated)
+	})
+	return updated, err
+}
+
 // FindByUsername returns user (without password hash)
 func (s *UserService) FindByUsername(username string) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
@@ -117,13 +304,160 @@ func (s *UserService) FindByUsername(username string) (models.User, error) {
 	return u, nil
 }
 
-// PromoteUser sets role to admin; returns updated user
+// PromoteUser adds the admin role; returns updated user
 func (s *UserService) PromoteUser(username string) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
 	defer cancel()
 
+	update := bson.M{"$addToSet": bson.M{"roles": models.RoleAdmin}}
+	adds := bson.M{"roles": bson.M{"$ne": models.RoleAdmin}, "disabled": bson.M{"$ne": true}}
+	var updated models.User
+	_, err := s.changeUser(ctx, bson.M{"username": username}, nil, adds, func(filter bson.M) (bool, error) {
+		return s.updateOne(ctx, filter, update, &updated)
+	})
+	return updated, err
+}
+
+// DemoteUser takes the admin role from the user, who is left with the user
+// role if no other; returns updated user. Demoting the last active admin
+// returns ErrLastAdmin.
+func (s *UserService) DemoteUser(userID primitive.ObjectID) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	rest := bson.M{"$setDifference": bson.A{"$roles", bson.A{models.RoleAdmin}}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{"roles": bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{bson.M{"$size": rest}, 0}},
+		bson.A{models.RoleUser},
+		rest,
+	}}}}}}
+	var updated models.User
+	_, err := s.changeUser(ctx, bson.M{"_id": userID}, activeAdminFilter, nil, func(filter bson.M) (bool, error) {
+		return s.updateOne(ctx, filter, update, &updated)
+	})
+	return updated, err
+}
+
+// SetDisabled disables or enables the user; returns updated user. Disabling
+// bumps the token version so that existing sessions stay invalid after the
+// account is enabled again. Disabling the last active admin returns
+// ErrLastAdmin.
+func (s *UserService) SetDisabled(userID primitive.ObjectID, disabled bool) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"disabled": disabled}}
+	var removes, adds bson.M
+	if disabled {
+		update["$inc"] = bson.M{"token_version": 1}
+		removes = activeAdminFilter
+	} else {
+		adds = bson.M{"roles": models.RoleAdmin, "disabled": true}
+	}
+	var updated models.User
+	_, err := s.changeUser(ctx, bson.M{"_id": userID}, removes, adds, func(filter bson.M) (bool, error) {
+		return s.updateOne(ctx, filter, update, &updated)
+	})
+	return updated, err
+}
+
+// changeUser writes to the user matching base while keeping the admin role's
+// count of active admins in step, so that the last one cannot be removed even
+// by concurrent changes. removes matches the states of the user in which the
+// write takes away an active admin, adds those in which it makes one; either
+// may be nil. write applies the change to the user matching filter and
+// reports whether one matched. Returns false if no user matches base, and
+// ErrLastAdmin if the write would leave no active admin.
+//
+// The count is decremented before removing an admin and incremented after
+// adding one, so an interrupted change can only leave it too low, which
+// refuses changes rather than allowing the last admin to go.
+func (s *UserService) changeUser(ctx context.Context, base, removes, adds bson.M, write func(filter bson.M) (bool, error)) (bool, error) {
+	and := func(cond bson.M) bson.M { return bson.M{"$and": bson.A{base, cond}} }
+	var others bson.A
+	for _, f := range []bson.M{removes, adds} {
+		if f != nil {
+			others = append(others, f)
+		}
+	}
+	neutral := base
+	if len(others) > 0 {
+		neutral = and(bson.M{"$nor": others})
+	}
+	// the user may change between the attempts below, then they start over
+	for attempt := 0; attempt < 3; attempt++ {
+		if ok, err := write(neutral); err != nil || ok {
+			return ok, err
+		}
+		if adds != nil {
+			ok, err := write(and(adds))
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, s.roles.addActiveAdmin(ctx)
+			}
+		}
+		if removes != nil {
+			n, err := s.collection.CountDocuments(ctx, and(removes))
+			if err != nil {
+				return false, err
+			}
+			if n > 0 {
+				taken, err := s.roles.takeActiveAdmin(ctx)
+				if err != nil {
+					return false, err
+				}
+				if !taken {
+					return false, ErrLastAdmin
+				}
+				ok, err := write(and(removes))
+				if err != nil || ok {
+					return ok, err
+				}
+				// the user changed meanwhile, give the admin back
+				if err := s.roles.addActiveAdmin(ctx); err != nil {
+					return false, err
+				}
+			}
+		}
+		if n, err := s.collection.CountDocuments(ctx, base); err != nil || n == 0 {
+			return false, err
+		}
+	}
+	return false, errors.New("user changed concurrently")
+}
+
+// updateOne applies update to the user matching filter and decodes the
+// result into u; reports whether a user matched
+func (s *UserService) updateOne(ctx context.Context, filter, update any, u *models.User) (bool, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(u); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+	u.PasswordHash = ""
+	return true, nil
+}
+
+// CountWithRole returns how many users have the role
+func (s *UserService) CountWithRole(role string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.collection.CountDocuments(ctx, bson.M{"roles": role})
+}
+
+// IncrementTokenVersion bumps the user's token version so that every token
+// issued before is rejected; returns updated user
+func (s *UserService) IncrementTokenVersion(username string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
-	update := bson.M{"$set": bson.M{"role": "admin"}}
+	update := bson.M{"$inc": bson.M{"token_version": 1}}
 	var updated models.User
 	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"username": username}, update, opts).Decode(&updated); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -135,6 +469,317 @@ func (s *UserService) PromoteUser(username string) (models.User, error) {
 	return updated, nil
 }
 
+// SetPassword replaces the user's password and bumps the token version so that
+// existing sessions are invalidated; returns updated user. The password policy
+// is enforced.
+func (s *UserService) SetPassword(userID primitive.ObjectID, password string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if password == "" {
+		return models.User{}, errors.New("password required")
+	}
+	var current models.User
+	if err := s.collection.FindOne(ctx, bson.M{"_id": userID}).Decode(&current); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, nil
+		}
+		return models.User{}, err
+	}
+	if err := s.policy.Validate(current.Username, password); err != nil {
+		return models.User{}, err
+	}
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{
+		"$set": bson.M{"password_hash": hash},
+		"$inc": bson.M{"token_version": 1},
+	}
+	var updated models.User
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": userID}, update, opts).Decode(&updated); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, nil
+		}
+		return models.User{}, err
+	}
+	updated.PasswordHash = ""
+	return updated, nil
+}
+
+// UpdateUsername renames the user; returns updated user
+func (s *UserService) UpdateUsername(userID primitive.ObjectID, username string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if username == "" {
+		return models.User{}, errors.New("username required")
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$set": bson.M{"username": username}}
+	var updated models.User
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": userID}, update, opts).Decode(&updated); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, nil
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return models.User{}, ErrUsernameTaken
+		}
+		return models.User{}, err
+	}
+	updated.PasswordHash = ""
+	return updated, nil
+}
+
+// UpdateEmail sets the user's email address, or clears it when email is
+// empty, and marks it unverified; returns updated user
+func (s *UserService) UpdateEmail(userID primitive.ObjectID, email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	update := bson.M{"$unset": bson.M{"email": ""}, "$set": bson.M{"email_verified": false}}
+	if email != "" {
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			return models.User{}, err
+		}
+		update = bson.M{"$set": bson.M{"email": normalized, "email_verified": false}}
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated models.User
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": userID}, update, opts).Decode(&updated); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, nil
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return models.User{}, ErrEmailTaken
+		}
+		return models.User{}, err
+	}
+	updated.PasswordHash = ""
+	return updated, nil
+}
+
+// MarkEmailVerified marks email as verified if it is still the user's
+// address; returns the updated user, or a zero user if the address changed
+func (s *UserService) MarkEmailVerified(userID primitive.ObjectID, email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated models.User
+	filter := bson.M{"_id": userID, "email": email}
+	if err := s.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"email_verified": true}}, opts).Decode(&updated); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, nil
+		}
+		return models.User{}, err
+	}
+	updated.PasswordHash = ""
+	return updated, nil
+}
+
+// FindByEmail returns the user with the email address (without password
+// hash), or a zero user if none has it
+func (s *UserService) FindByEmail(email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return models.User{}, nil
+	}
+	var u models.User
+	if err := s.collection.FindOne(ctx, bson.M{"email": normalized}).Decode(&u); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.User{}, nil
+		}
+		return models.User{}, err
+	}
+	u.PasswordHash = ""
+	return u, nil
+}
+
+// duplicateKeyOn reports whether err is a duplicate key error on the
+// single-field index of field
+func duplicateKeyOn(err error, field string) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "index: "+field+"_1 ")
+}
+
+// NormalizeEmail validates a bare email address such as "ann@example.org"
+// and lowercases it
+func NormalizeEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != strings.TrimSpace(email) {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// DeleteUser removes the user; returns false if no user matched. Deleting the
+// last active admin returns ErrLastAdmin.
+func (s *UserService) DeleteUser(userID primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.changeUser(ctx, bson.M{"_id": userID}, activeAdminFilter, nil, func(filter bson.M) (bool, error) {
+		res, err := s.collection.DeleteOne(ctx, filter)
+		if err != nil {
+			return false, err
+		}
+		return res.DeletedCount > 0, nil
+	})
+}
+
+// SetPendingTOTP stores a TOTP secret awaiting confirmation by the user
+func (s *UserService) SetPendingTOTP(userID primitive.ObjectID, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"totp_pending_secret": secret}})
+	return err
+}
+
+// EnableTOTP promotes the pending secret to the active one and stores hashes of
+// the recovery codes. step is the time step of the code used for confirmation.
+func (s *UserService) EnableTOTP(userID primitive.ObjectID, secret string, step int64, recoveryCodes []string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	hashes := make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		hashes = append(hashes, hashToken(code))
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"mfa_enabled":    true,
+			"totp_secret":    secret,
+			"totp_last_step": step,
+			"recovery_codes": hashes,
+		},
+		"$unset": bson.M{"totp_pending_secret": ""},
+	}
+	res, err := s.collection.UpdateOne(ctx, bson.M{"_id": userID, "totp_pending_secret": secret}, update)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// DisableMFA removes the TOTP secret and recovery codes
+func (s *UserService) DisableMFA(userID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	update := bson.M{
+		"$set":   bson.M{"mfa_enabled": false},
+		"$unset": bson.M{"totp_secret": "", "totp_pending_secret": "", "totp_last_step": "", "recovery_codes": ""},
+	}
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	return err
+}
+
+// UseTOTPStep records step as the last accepted TOTP time step. It returns
+// false if a code from the same or a later step was already accepted.
+func (s *UserService) UseTOTPStep(userID primitive.ObjectID, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{"_id": userID, "totp_last_step": bson.M{"$lt": step}}
+	res, err := s.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp_last_step": step}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// UseRecoveryCode consumes a recovery code; returns false if it is not valid
+func (s *UserService) UseRecoveryCode(userID primitive.ObjectID, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	hash := hashToken(code)
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": userID, "recovery_codes": hash},
+		bson.M{"$pull": bson.M{"recovery_codes": hash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// AddWebAuthnCredential stores a newly registered credential for the user.
+// Returns ErrCredentialExists if the credential is already registered.
+func (s *UserService) AddWebAuthnCredential(userID primitive.ObjectID, cred models.WebAuthnCredential) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": userID, "webauthn_credentials.id": bson.M{"$ne": cred.ID}},
+		bson.M{"$push": bson.M{"webauthn_credentials": cred}},
+	)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, ErrCredentialExists
+		}
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		// either the user is gone or already has the credential
+		u, err := s.GetByID(userID.Hex())
+		if err != nil {
+			return false, err
+		}
+		if u.Username != "" {
+			return false, ErrCredentialExists
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// UseWebAuthnCredential records a successful assertion, moving the stored sign
+// counter from prev to next. It returns false if the counter changed since it
+// was read, which means the same assertion or a cloned key raced this one.
+func (s *UserService) UseWebAuthnCredential(userID primitive.ObjectID, credID []byte, prev, next uint32) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":                  userID,
+		"webauthn_credentials": bson.M{"$elemMatch": bson.M{"id": credID, "sign_count": prev}},
+	}
+	update := bson.M{"$set": bson.M{
+		"webauthn_credentials.$.sign_count":   next,
+		"webauthn_credentials.$.last_used_at": time.Now(),
+	}}
+	res, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// DeleteWebAuthnCredential removes one of the user's credentials; returns
+// false if the user has no such credential
+func (s *UserService) DeleteWebAuthnCredential(userID primitive.ObjectID, credID []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": userID, "webauthn_credentials.id": credID},
+		bson.M{"$pull": bson.M{"webauthn_credentials": bson.M{"id": credID}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
 // IsEmpty checks whether users collection is empty
 func (s *UserService) IsEmpty() (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
@@ -0,0 +1,345 @@
+// Package federation signs users in through external OpenID Connect identity
+// providers using the authorization code flow with PKCE
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"authgo/models"
+	"authgo/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksRefreshInterval bounds how often an unknown kid may trigger a refetch of
+// the provider's keys
+const jwksRefreshInterval = time.Minute
+
+// ProviderConfig configures an upstream identity provider
+type ProviderConfig struct {
+	// Name identifies the provider in /auth/{name}/start
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	// UsernameClaim names the claim used as username for new users,
+	// "preferred_username" by default
+	UsernameClaim string `json:"username_claim"`
+	// GroupsClaim names the claim listing the user's groups, "groups" by default
+	GroupsClaim string `json:"groups_claim"`
+	// GroupRoles maps IdP groups to roles. When set, the roles are synced
+	// from the groups on every login.
+	GroupRoles map[string]string `json:"group_roles"`
+	// DefaultRole is given to users in none of the mapped groups, "user" by default
+	DefaultRole string `json:"default_role"`
+	// Provision creates accounts for unknown identities on first login
+	Provision bool `json:"provision"`
+}
+
+// Identity is the verified result of an upstream login
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// discovery is the subset of the provider metadata used here
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an upstream identity provider. Its metadata and keys are
+// fetched on first use.
+type Provider struct {
+	ProviderConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *discovery
+	keys        tokens.JWKSet
+	keysFetched time.Time
+}
+
+// NewProvider returns a Provider for cfg, filling in defaults
+func NewProvider(cfg ProviderConfig) (*Provider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("provider name, issuer and client_id are required")
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if !slices.Contains(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = "user"
+	}
+	return &Provider{ProviderConfig: cfg, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Registry holds the configured providers by name
+type Registry struct {
+	providers map[string]*Provider
+}
+
+// Load reads a JSON array of provider configurations from path. An empty path
+// returns an empty registry.
+func Load(path string) (*Registry, error) {
+	r := &Registry{providers: map[string]*Provider{}}
+	if path == "" {
+		return r, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []ProviderConfig
+	if err := json.Unmarshal(raw, &cfgs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, cfg := range cfgs {
+		p, err := NewProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := r.providers[p.Name]; dup {
+			return nil, fmt.Errorf("duplicate provider %q", p.Name)
+		}
+		r.providers[p.Name] = p
+	}
+	return r, nil
+}
+
+// Get returns the provider called name
+func (r *Registry) Get(name string) (*Provider, bool) {
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// Len returns the number of configured providers
+func (r *Registry) Len() int {
+	return len(r.providers)
+}
+
+// AuthCodeURL returns the provider URL to send the user to
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, codeChallenge string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified identity
+func (p *Provider) Exchange(ctx context.Context, code, redirectURI, codeVerifier, nonce string) (Identity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	var resp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := p.do(req, &resp); err != nil {
+		return Identity{}, err
+	}
+	if resp.Error != "" {
+		return Identity{}, fmt.Errorf("token endpoint: %s %s", resp.Error, resp.ErrorDescription)
+	}
+	if resp.IDToken == "" {
+		return Identity{}, errors.New("token response has no id_token")
+	}
+	return p.verifyIDToken(ctx, resp.IDToken, nonce)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and extracts the identity
+func (p *Provider) verifyIDToken(ctx context.Context, raw, nonce string) (Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, err := p.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if k.Alg != "" && k.Alg != t.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %q", t.Method.Alg())
+		}
+		return k.PublicKey()
+	},
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", tokens.EdDSA}),
+	)
+	if err != nil {
+		return Identity{}, err
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return Identity{}, errors.New("id token nonce mismatch")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return Identity{}, errors.New("id token has no subject")
+	}
+	id := Identity{Issuer: p.Issuer, Subject: sub}
+	id.Username, _ = claims[p.UsernameClaim].(string)
+	id.Email, _ = claims["email"].(string)
+	switch groups := claims[p.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	case string:
+		id.Groups = strings.Fields(groups)
+	}
+	return id, nil
+}
+
+// RolesFor maps the user's groups to roles
+func (p *Provider) RolesFor(groups []string) []string {
+	return models.RolesForGroups(groups, p.GroupRoles, p.DefaultRole)
+}
+
+// SyncsRoles reports whether roles are managed by the provider's groups
+func (p *Provider) SyncsRoles() bool {
+	return len(p.GroupRoles) > 0
+}
+
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var meta discovery
+	if err := p.do(req, &meta); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", meta.Issuer, p.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery: incomplete provider metadata")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// key returns the provider key with the given kid, refetching the key set
+// when the kid is unknown
+func (p *Provider) key(ctx context.Context, kid string) (tokens.JWK, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return tokens.JWK{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.lookupKey(kid); ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return tokens.JWK{}, fmt.Errorf("unknown kid %q", kid)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+	if err != nil {
+		return tokens.JWK{}, err
+	}
+	var set tokens.JWKSet
+	if err := p.do(req, &set); err != nil {
+		return tokens.JWK{}, fmt.Errorf("jwks: %w", err)
+	}
+	p.keys, p.keysFetched = set, time.Now()
+	if k, ok := p.lookupKey(kid); ok {
+		return k, nil
+	}
+	return tokens.JWK{}, fmt.Errorf("unknown kid %q", kid)
+}
+
+// lookupKey finds kid in the cached key set; a token without kid matches the
+// only key of a single-key set
+func (p *Provider) lookupKey(kid string) (tokens.JWK, bool) {
+	if kid == "" && len(p.keys.Keys) == 1 {
+		return p.keys.Keys[0], true
+	}
+	return p.keys.Key(kid)
+}
+
+func (p *Provider) do(req *http.Request, v any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
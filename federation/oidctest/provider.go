@@ -0,0 +1,281 @@
+// Package oidctest provides a minimal OpenID Connect provider for exercising
+// federated login, in the spirit of net/http/httptest, and a relying party for
+// exercising authgo as a provider. The provider's authorization page signs in
+// any username with the groups entered; no password is checked. Neither is
+// meant for anything but tests and local development.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"authgo/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const kid = "mock"
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Mock identity provider</title></head>
+<body>
+<h1>Mock identity provider</h1>
+<form method="post" action="/authorize">
+{{range $k, $v := .}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}<label>Username <input name="username" required></label>
+<label>Groups (space separated) <input name="groups"></label>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// grant is an issued authorization code waiting to be redeemed
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	groups      []string
+	expires     time.Time
+}
+
+// Provider is an OpenID Connect provider for one client, served at Issuer
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for a public client
+
+	key    *rsa.PrivateKey
+	mux    *http.ServeMux
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+// NewProvider constructs a Provider with a fresh signing key. The issuer is
+// the URL the provider will be served at.
+func NewProvider(issuer, clientID, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		mux:          http.NewServeMux(),
+		grants:       map[string]grant{},
+	}
+	p.mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	p.mux.HandleFunc("/jwks", p.jwks)
+	p.mux.HandleFunc("/authorize", p.authorize)
+	p.mux.HandleFunc("/token", p.token)
+	return p, nil
+}
+
+// ServeHTTP implements http.Handler
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// Server is a Provider listening on a loopback address
+type Server struct {
+	*Provider
+	srv *httptest.Server
+}
+
+// NewServer starts a Provider for one client
+func NewServer(clientID, clientSecret string) (*Server, error) {
+	srv := httptest.NewUnstartedServer(nil)
+	p, err := NewProvider("http://"+srv.Listener.Addr().String(), clientID, clientSecret)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	srv.Config.Handler = p
+	srv.Start()
+	return &Server{Provider: p, srv: srv}, nil
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SignIn does what a user submitting the authorization page does: it signs in
+// as username, member of groups, for the authorization request at authCodeURL.
+// It returns the redirect back to the client.
+func (s *Server) SignIn(authCodeURL, username string, groups ...string) (*url.URL, error) {
+	u, err := url.Parse(authCodeURL)
+	if err != nil {
+		return nil, err
+	}
+	form := u.Query()
+	form.Set("username", username)
+	form.Set("groups", strings.Join(groups, " "))
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(s.Issuer+"/authorize", form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		return nil, fmt.Errorf("authorize returned %s", resp.Status)
+	}
+	return resp.Location()
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, tokens.JWKSet{Keys: []tokens.JWK{{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+	}}})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("client_id") != p.ClientID || r.Form.Get("redirect_uri") == "" {
+		http.Error(w, "unknown client or missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = loginPage.Execute(w, r.Form)
+		return
+	}
+	if r.Form.Get("code_challenge_method") != "S256" {
+		http.Error(w, "S256 code challenge required", http.StatusBadRequest)
+		return
+	}
+	code, err := random()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.mu.Lock()
+	p.grants[code] = grant{
+		clientID:    r.Form.Get("client_id"),
+		redirectURI: r.Form.Get("redirect_uri"),
+		challenge:   r.Form.Get("code_challenge"),
+		nonce:       r.Form.Get("nonce"),
+		username:    r.Form.Get("username"),
+		groups:      strings.Fields(r.Form.Get("groups")),
+		expires:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+	q := url.Values{"code": {code}, "state": {r.Form.Get("state")}}
+	http.Redirect(w, r, r.Form.Get("redirect_uri")+"?"+q.Encode(), http.StatusSeeOther)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostFormValue("client_id")
+	}
+	if id != p.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(p.ClientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	code := r.PostFormValue("code")
+	p.mu.Lock()
+	g, found := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || time.Now().After(g.expires) || g.clientID != id ||
+		g.redirectURI != r.PostFormValue("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                p.Issuer,
+		"aud":                id,
+		"sub":                "mock|" + g.username,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"preferred_username": g.username,
+		"email":              g.username + "@example.com",
+		"groups":             g.groups,
+	}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = kid
+	idToken, err := t.SignedString(p.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	accessToken, err := random()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,195 @@
+package oidctest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"authgo/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// metadata is the subset of the provider metadata used by RelyingParty
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// RelyingParty is an OpenID Connect client for testing a provider end to end.
+// It runs the authorization code flow with PKCE and verifies the ID token.
+type RelyingParty struct {
+	ClientID     string
+	ClientSecret string // empty for a public client
+	RedirectURI  string
+	Scope        string
+
+	meta metadata
+}
+
+// NewRelyingParty fetches the metadata of the provider at issuer and returns a
+// client for it
+func NewRelyingParty(issuer, clientID, clientSecret, redirectURI, scope string) (*RelyingParty, error) {
+	rp := &RelyingParty{ClientID: clientID, ClientSecret: clientSecret, RedirectURI: redirectURI, Scope: scope}
+	if err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", "", &rp.meta); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	return rp, nil
+}
+
+// Request is an authorization request waiting for its callback
+type Request struct {
+	// URL is where the user agent is sent to sign in
+	URL      string
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// Login is the verified result of a completed authorization request
+type Login struct {
+	AccessToken string
+	IDToken     jwt.MapClaims
+	Userinfo    map[string]any
+}
+
+// AuthCodeURL starts an authorization request
+func (rp *RelyingParty) AuthCodeURL() (Request, error) {
+	state, err1 := random()
+	nonce, err2 := random()
+	verifier, err3 := random()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return Request{}, err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.ClientID},
+		"redirect_uri":          {rp.RedirectURI},
+		"scope":                 {rp.Scope},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	return Request{
+		URL:      rp.meta.AuthorizationEndpoint + "?" + q.Encode(),
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+	}, nil
+}
+
+// Callback completes req with the redirect the provider sent the user agent
+// back with: it redeems the code, verifies the ID token and checks that the
+// userinfo is about the same subject
+func (rp *RelyingParty) Callback(req Request, callback *url.URL) (Login, error) {
+	q := callback.Query()
+	if q.Get("state") != req.State {
+		return Login{}, errors.New("state mismatch")
+	}
+	if e := q.Get("error"); e != "" {
+		return Login{}, fmt.Errorf("%s: %s", e, q.Get("error_description"))
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {rp.RedirectURI},
+		"code_verifier": {req.Verifier},
+	}
+	if rp.ClientSecret == "" {
+		form.Set("client_id", rp.ClientID)
+	}
+	tr, err := http.NewRequest(http.MethodPost, rp.meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Login{}, err
+	}
+	tr.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rp.ClientSecret != "" {
+		tr.SetBasicAuth(url.QueryEscape(rp.ClientID), url.QueryEscape(rp.ClientSecret))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+	}
+	if err := doJSON(tr, &tok); err != nil {
+		return Login{}, fmt.Errorf("token exchange: %w", err)
+	}
+	if tok.Error != "" {
+		return Login{}, fmt.Errorf("token exchange: %s", tok.Error)
+	}
+
+	claims, err := rp.verifyIDToken(req.Nonce, tok.IDToken)
+	if err != nil {
+		return Login{}, fmt.Errorf("id token: %w", err)
+	}
+	var userinfo map[string]any
+	if err := getJSON(rp.meta.UserinfoEndpoint, tok.AccessToken, &userinfo); err != nil {
+		return Login{}, fmt.Errorf("userinfo: %w", err)
+	}
+	if userinfo["sub"] != claims["sub"] {
+		return Login{}, errors.New("userinfo sub does not match the id token")
+	}
+	return Login{AccessToken: tok.AccessToken, IDToken: claims, Userinfo: userinfo}, nil
+}
+
+// verifyIDToken checks the signature against the provider's JWKS and the
+// iss, aud and nonce claims
+func (rp *RelyingParty) verifyIDToken(nonce, idToken string) (jwt.MapClaims, error) {
+	var set tokens.JWKSet
+	if err := getJSON(rp.meta.JWKSURI, "", &set); err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := set.Key(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		if k.Alg != t.Method.Alg() {
+			return nil, errors.New("algorithm mismatch")
+		}
+		return k.PublicKey()
+	}, jwt.WithIssuer(rp.meta.Issuer), jwt.WithAudience(rp.ClientID), jwt.WithValidMethods([]string{tokens.RS256, tokens.ES256, tokens.EdDSA}))
+	if err != nil {
+		return nil, err
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+func getJSON(u, bearer string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return doJSON(req, v)
+}
+
+func doJSON(req *http.Request, v any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -2,17 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"authgo/auth"
 	"authgo/controllers"
 	"authgo/data"
+	"authgo/federation"
 	"authgo/middleware"
+	"authgo/notify"
+	"authgo/passhash"
+	"authgo/passpolicy"
+	"authgo/ratelimit"
 	"authgo/router"
+	"authgo/tokens"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
@@ -23,10 +37,9 @@ func main() {
 	dbName := os.Getenv("MONGODB_DATABASE")
 	taskCollName := os.Getenv("MONGODB_TASK_COLLECTION")
 	userCollName := os.Getenv("MONGODB_USER_COLLECTION")
-	jwtSecret := os.Getenv("JWT_SECRET")
 
-	if uri == "" || dbName == "" || taskCollName == "" || userCollName == "" || jwtSecret == "" {
-		log.Fatal("MONGODB_URI, MONGODB_DATABASE, collections and JWT_SECRET must be set (see .env.example)")
+	if uri == "" || dbName == "" || taskCollName == "" || userCollName == "" {
+		log.Fatal("MONGODB_URI, MONGODB_DATABASE and collections must be set (see .env.example)")
 	}
 
 	// connect to mongo
@@ -44,19 +57,158 @@ func main() {
 	db := client.Database(dbName)
 	taskColl := db.Collection(taskCollName)
 	userColl := db.Collection(userCollName)
+	refreshColl := db.Collection(envOr("MONGODB_REFRESH_TOKEN_COLLECTION", "refresh_tokens"))
+	revokedColl := db.Collection(envOr("MONGODB_REVOKED_TOKEN_COLLECTION", "revoked_tokens"))
+	keyColl := db.Collection(envOr("MONGODB_SIGNING_KEY_COLLECTION", "signing_keys"))
+	resetColl := db.Collection(envOr("MONGODB_PASSWORD_RESET_COLLECTION", "password_resets"))
+	verifyColl := db.Collection(envOr("MONGODB_EMAIL_VERIFICATION_COLLECTION", "email_verifications"))
+	attemptColl := db.Collection(envOr("MONGODB_LOGIN_ATTEMPT_COLLECTION", "login_attempts"))
+	apiKeyColl := db.Collection(envOr("MONGODB_API_KEY_COLLECTION", "api_keys"))
+	clientColl := db.Collection(envOr("MONGODB_OAUTH_CLIENT_COLLECTION", "oauth_clients"))
+	codeColl := db.Collection(envOr("MONGODB_AUTHORIZATION_CODE_COLLECTION", "authorization_codes"))
+	deviceColl := db.Collection(envOr("MONGODB_DEVICE_CODE_COLLECTION", "device_codes"))
+	sessionColl := db.Collection(envOr("MONGODB_SESSION_COLLECTION", "sessions"))
+	roleColl := db.Collection(envOr("MONGODB_ROLE_COLLECTION", "roles"))
+
+	// password hashing; hashes of the other algorithm, or with outdated
+	// parameters, are upgraded on the next successful login
+	argon := passhash.DefaultArgon2id
+	argon.Time = uint32(envInt("ARGON2_TIME", int(argon.Time)))
+	argon.Memory = uint32(envInt("ARGON2_MEMORY_KIB", int(argon.Memory)))
+	argon.Threads = uint8(envInt("ARGON2_THREADS", int(argon.Threads)))
+	hasher, err := passhash.New(os.Getenv("PASSWORD_HASH_ALG"), argon, passhash.Bcrypt{Cost: envInt("BCRYPT_COST", bcrypt.DefaultCost)})
+	if err != nil {
+		log.Fatalf("failed to configure password hashing: %v", err)
+	}
+
+	// password policy, optionally with an offline breached-password corpus
+	policy := &passpolicy.Policy{
+		MinLength: envInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength: envInt("PASSWORD_MAX_LENGTH", 128),
+		// bcrypt cannot hash longer passwords
+		MaxBytes:         hasher.MaxPasswordBytes(),
+		MinScore:         envInt("PASSWORD_MIN_SCORE", 2),
+		DisallowUsername: os.Getenv("PASSWORD_ALLOW_USERNAME") != "true",
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		policy.Breached, err = passpolicy.LoadBreached(path)
+		if err != nil {
+			log.Fatalf("failed to load breached passwords: %v", err)
+		}
+		log.Printf("loaded %d breached password hashes", policy.Breached.Len())
+	}
 
 	// services
-	userService := data.NewUserService(userColl)
+	// roles and the permissions they grant; admin and user are built in
+	roleService := data.NewRoleService(roleColl)
+	userService := data.NewUserService(userColl, roleService, hasher, policy)
 	taskService := data.NewTaskService(taskColl)
+	refreshService := data.NewRefreshTokenService(refreshColl, envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour))
+	revocationService := data.NewRevocationService(revokedColl)
+	resetService := data.NewPasswordResetService(resetColl, envDuration("PASSWORD_RESET_TTL", time.Hour))
+	verifyService := data.NewEmailVerificationService(verifyColl, envDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour))
+	attemptService := data.NewLoginAttemptService(attemptColl, data.DefaultAccountLockout, data.DefaultIPLockout)
+	apiKeyService := data.NewAPIKeyService(apiKeyColl)
+	// browser sessions, used when SESSION_MODE=cookie
+	sessionService := data.NewSessionService(sessionColl, envDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute), envDuration("SESSION_ABSOLUTE_TIMEOUT", 12*time.Hour))
+	clientService := data.NewOAuthClientService(clientColl)
+	codeService := data.NewAuthorizationCodeService(codeColl, envDuration("AUTHORIZATION_CODE_TTL", time.Minute))
+	deviceService := data.NewDeviceCodeService(deviceColl, envDuration("DEVICE_CODE_TTL", 10*time.Minute), envDuration("DEVICE_POLL_INTERVAL", 5*time.Second))
+
+	// delivery of reset links and other user notifications
+	notifier, err := notify.New(os.Getenv("NOTIFIER"), envOr("NOTIFIER_FILE", "notifications.log"))
+	if err != nil {
+		log.Fatalf("failed to configure notifier: %v", err)
+	}
+
+	// controller settings; OIDC_ISSUER is the public base URL of the service
+	config := controllers.Config{
+		Issuer:    envOr("OIDC_ISSUER", "http://localhost:8080"),
+		AccessTTL: envDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		// optional frontend pages that accept ?token=
+		ResetURL:   os.Getenv("PASSWORD_RESET_URL"),
+		VerifyURL:  os.Getenv("EMAIL_VERIFICATION_URL"),
+		TOTPIssuer: envOr("TOTP_ISSUER", "goauth"),
+		MagicTTL:   envDuration("MAGIC_LINK_TTL", 15*time.Minute),
+		MagicURL:   os.Getenv("MAGIC_LINK_URL"),
+		// EMAIL_VERIFICATION_REQUIRED=tasks denies task access until the
+		// user's email address is verified; =login refuses logins instead
+		EmailPolicy: os.Getenv("EMAIL_VERIFICATION_REQUIRED"),
+		// SESSION_MODE=cookie signs browsers in with a session cookie
+		CookieSessions: os.Getenv("SESSION_MODE") == controllers.SessionModeCookie,
+		CookieSameSite: os.Getenv("SESSION_COOKIE_SAMESITE"),
+	}
+
+	// signing keys; retired keys stay published for JWT_KEY_RETENTION, which
+	// must be longer than the lifetime of any issued token
+	keyRetention := envDuration("JWT_KEY_RETENTION", 24*time.Hour)
+	if keyRetention < config.AccessTTL {
+		log.Fatalf("JWT_KEY_RETENTION (%s) must be at least ACCESS_TOKEN_TTL (%s)", keyRetention, config.AccessTTL)
+	}
+	keyManager, err := tokens.NewKeyManager(
+		data.NewSigningKeyService(keyColl),
+		envOr("JWT_SIGNING_ALG", tokens.RS256),
+		envDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+		keyRetention,
+	)
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
+	}
+	go keyManager.Run(context.Background())
+
+	// password checks; AUTH_BACKENDS orders the backends tried at login,
+	// "ldap,local" by default when LDAP_URL is set
+	authn, err := authenticators(userService)
+	if err != nil {
+		log.Fatalf("failed to configure authentication: %v", err)
+	}
 
 	// controller
-	controller := controllers.NewController(userService, taskService)
+	controller := controllers.NewController(userService, taskService, refreshService, revocationService, resetService, verifyService, attemptService, apiKeyService, sessionService, roleService, authn, keyManager, notifier, config)
+
+	// access token and api key validation, shared by the middleware and the
+	// introspection endpoint
+	validator := auth.NewValidator(keyManager, userService, revocationService, apiKeyService, sessionService, roleService, clientService)
+	oauthController := controllers.NewOAuthController(controller, clientService, codeService, deviceService, validator)
+
+	// external OpenID Connect providers users may sign in with, configured as
+	// a JSON array in FEDERATION_PROVIDERS_FILE
+	providers, err := federation.Load(os.Getenv("FEDERATION_PROVIDERS_FILE"))
+	if err != nil {
+		log.Fatalf("failed to load identity providers: %v", err)
+	}
+	federationController := controllers.NewFederationController(controller, providers)
+
+	// passkeys; the relying party defaults to the host of OIDC_ISSUER, and
+	// WEBAUTHN_RP_ORIGINS lists every origin the browser may call from
+	relyingParty, err := webAuthnRelyingParty(config)
+	if err != nil {
+		log.Fatalf("failed to configure webauthn: %v", err)
+	}
+	webAuthnController := controllers.NewWebAuthnController(controller, relyingParty)
 
-	// middleware with jwt secret
-	authMw := middleware.NewAuthMiddleware(jwtSecret, userService)
+	// middleware with verification keys; MFA_REQUIRED_FOR_ADMIN=true denies admin
+	// access until the admin has enrolled two-factor authentication
+	requireAdminMFA := os.Getenv("MFA_REQUIRED_FOR_ADMIN") == "true"
+	requireVerifiedEmail := config.EmailPolicy == controllers.EmailVerifiedForTasks
+	authMw := middleware.NewAuthMiddleware(validator, apiKeyService, requireAdminMFA, requireVerifiedEmail)
+
+	// rate limiting; use RATE_LIMIT_BACKEND=mongo when running several replicas
+	var limitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	switch backend := envOr("RATE_LIMIT_BACKEND", "memory"); backend {
+	case "memory":
+	case "mongo":
+		limitStore = ratelimit.NewMongoStore(db.Collection(envOr("MONGODB_RATE_LIMIT_COLLECTION", "rate_limits")))
+	default:
+		log.Fatalf("unknown RATE_LIMIT_BACKEND %q", backend)
+	}
+	limits := router.RateLimits{
+		Auth: envLimit("RATE_LIMIT_AUTH", "10/m"),
+		API:  envLimit("RATE_LIMIT_API", "300/m"),
+	}
 
 	// router
-	r := router.SetupRouter(controller, authMw)
+	r := router.SetupRouter(controller, oauthController, federationController, webAuthnController, authMw, ratelimit.New(limitStore), limits)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -67,3 +219,120 @@ func main() {
 		log.Fatalf("failed to run server: %v", err)
 	}
 }
+
+// envOr returns the environment value for key or def when unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration reads a duration such as "720h" from the environment
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// envInt reads an integer from the environment
+func envInt(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n >= 0 {
+		return n
+	}
+	return def
+}
+
+// envLimit reads a rate limit such as "10/m" from the environment
+func envLimit(key, def string) ratelimit.Limit {
+	l, err := ratelimit.ParseLimit(envOr(key, def))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return l
+}
+
+// webAuthnRelyingParty configures WebAuthn from WEBAUTHN_RP_ID,
+// WEBAUTHN_RP_NAME and the comma-separated WEBAUTHN_RP_ORIGINS, defaulting to
+// the issuer
+func webAuthnRelyingParty(config controllers.Config) (*webauthn.WebAuthn, error) {
+	issuer, err := url.Parse(config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	origins := []string{issuer.Scheme + "://" + issuer.Host}
+	if v := os.Getenv("WEBAUTHN_RP_ORIGINS"); v != "" {
+		origins = strings.Split(v, ",")
+		for i := range origins {
+			origins[i] = strings.TrimSpace(origins[i])
+		}
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          envOr("WEBAUTHN_RP_ID", issuer.Hostname()),
+		RPDisplayName: envOr("WEBAUTHN_RP_NAME", config.TOTPIssuer),
+		RPOrigins:     origins,
+	})
+}
+
+// authenticators builds the chain of password backends named in
+// AUTH_BACKENDS. The LDAP backend is configured from LDAP_* variables;
+// LDAP_GROUP_ROLES maps groups to roles as "admins=admin;staff=user", naming
+// groups by common name or DN.
+func authenticators(us *data.UserService) (auth.Authenticator, error) {
+	def := "local"
+	if os.Getenv("LDAP_URL") != "" {
+		def = "ldap,local"
+	}
+	var chain auth.Chain
+	for _, name := range strings.Split(envOr("AUTH_BACKENDS", def), ",") {
+		switch strings.TrimSpace(name) {
+		case "local":
+			chain = append(chain, us)
+		case "ldap":
+			cfg := auth.LDAPConfig{
+				URL:            os.Getenv("LDAP_URL"),
+				StartTLS:       os.Getenv("LDAP_START_TLS") == "true",
+				BindDN:         os.Getenv("LDAP_BIND_DN"),
+				BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+				UserDNTemplate: os.Getenv("LDAP_USER_DN_TEMPLATE"),
+				BaseDN:         os.Getenv("LDAP_BASE_DN"),
+				UserFilter:     os.Getenv("LDAP_USER_FILTER"),
+				GroupAttribute: os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+				GroupBaseDN:    os.Getenv("LDAP_GROUP_BASE_DN"),
+				GroupFilter:    os.Getenv("LDAP_GROUP_FILTER"),
+				GroupRoles:     map[string]string{},
+				DefaultRole:    os.Getenv("LDAP_DEFAULT_ROLE"),
+				Timeout:        envDuration("LDAP_TIMEOUT", 5*time.Second),
+			}
+			if path := os.Getenv("LDAP_CA_FILE"); path != "" {
+				pem, err := os.ReadFile(path)
+				if err != nil {
+					return nil, err
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("no certificates in %s", path)
+				}
+				cfg.TLS = &tls.Config{RootCAs: pool}
+				if u, err := url.Parse(cfg.URL); err == nil {
+					cfg.TLS.ServerName = u.Hostname()
+				}
+			}
+			for _, pair := range strings.Split(os.Getenv("LDAP_GROUP_ROLES"), ";") {
+				// group DNs contain "=", the role follows the last one
+				if i := strings.LastIndex(pair, "="); i > 0 {
+					cfg.GroupRoles[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+				}
+			}
+			a, err := auth.NewLDAPAuthenticator(cfg, us)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, a)
+		default:
+			return nil, fmt.Errorf("unknown authentication backend %q", name)
+		}
+	}
+	return chain, nil
+}
@@ -1,85 +1,220 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"errors"
+	"log"
 	"net/http"
+	"slices"
 	"strings"
-	"fmt"
 
+	"authgo/auth"
 	"authgo/data"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-// AuthMiddleware contains JWT secret and user service for lookups
+// AuthMiddleware authenticates requests and enforces access rules
 type AuthMiddleware struct {
-	secret      string
-	userService *data.UserService
+	validator *auth.Validator
+	apiKeys   *data.APIKeyService
+	// requireAdminMFA denies admin access to users without two-factor authentication
+	requireAdminMFA bool
+	// requireVerifiedEmail makes RequireVerifiedEmail deny users whose email
+	// address is not verified
+	requireVerifiedEmail bool
 }
 
 // NewAuthMiddleware constructs new AuthMiddleware
-func NewAuthMiddleware(secret string, us *data.UserService) *AuthMiddleware {
-	return &AuthMiddleware{secret: secret, userService: us}
+func NewAuthMiddleware(v *auth.Validator, aks *data.APIKeyService, requireAdminMFA, requireVerifiedEmail bool) *AuthMiddleware {
+	return &AuthMiddleware{
+		validator:            v,
+		apiKeys:              aks,
+		requireAdminMFA:      requireAdminMFA,
+		requireVerifiedEmail: requireVerifiedEmail,
+	}
 }
 
-// AuthRequired validates the Authorization header and sets "user" and "role" in context
+// AuthRequired validates the Authorization header, or else the session cookie, and sets
+// "username", "roles", "permissions" and "user_id" in context, plus "scopes" for credentials
+// limited to a scope. See auth.Validator for the checks applied to access tokens, API keys and sessions.
+// Requests authenticated by cookie other than GET, HEAD and OPTIONS must carry the CSRF
+// token in the X-CSRF-Token header.
 func (am *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		var p auth.Principal
+		var err error
 		h := c.GetHeader("Authorization")
-		if h == "" {
+		session, _ := c.Cookie(auth.SessionCookie)
+		switch {
+		case h != "":
+			parts := strings.Fields(h)
+			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authorization header"})
+				return
+			}
+			p, err = am.validator.Authenticate(parts[1])
+		case session != "":
+			p, err = am.validator.AuthenticateSession(session)
+		default:
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization header"})
 			return
 		}
-		parts := strings.Fields(h)
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authorization header"})
+		if err != nil {
+			if msg, ok := authErrorMessage(err); ok {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to validate token"})
+			return
+		}
+		if p.Method == auth.MethodSession && !validCSRF(c, p) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing or invalid CSRF token"})
 			return
 		}
-		tokenString := parts[1]
-		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-			// ensure signing method
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		if p.Method == auth.MethodAPIKey {
+			if err := am.apiKeys.TouchLastUsed(p.APIKey.ID); err != nil {
+				log.Printf("failed to record api key use: %v", err)
+			}
+		}
+
+		// set into context; client credentials tokens have no user
+		c.Set("permissions", p.Permissions)
+		if p.Method != auth.MethodClientCredentials {
+			c.Set("username", p.User.Username)
+			c.Set("roles", p.User.Roles)
+			c.Set("user_id", p.User.ID.Hex())
+			c.Set("mfa_enabled", p.User.HasSecondFactor())
+			c.Set("email_verified", p.User.Email != "" && p.User.EmailVerified)
+		}
+		if p.ClientID != "" {
+			c.Set("client_id", p.ClientID)
+		}
+		if p.Method != auth.MethodJWT && p.Method != auth.MethodSession {
+			c.Set("scopes", p.Scopes)
+		}
+		if !p.Session.ID.IsZero() {
+			c.Set("session_id", p.Session.ID.Hex())
+		}
+		if p.JTI != "" {
+			c.Set("jti", p.JTI)
+			c.Set("token_exp", p.ExpiresAt)
+		}
+		c.Set("auth_method", p.Method)
+		c.Next()
+	}
+}
+
+// validCSRF applies the double-submit check to a cookie-authenticated request:
+// unsafe methods must send the CSRF cookie's value in the CSRF header, and it
+// must be the token issued with the session
+func validCSRF(c *gin.Context, p auth.Principal) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	header := c.GetHeader(auth.CSRFHeader)
+	cookie, _ := c.Cookie(auth.CSRFCookie)
+	if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie)) != 1 {
+		return false
+	}
+	return data.CSRFTokenMatches(p.Session, header)
+}
+
+// authErrorMessage returns the client-facing message for a rejected credential,
+// or false for internal errors
+func authErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidToken):
+		return "Invalid token", true
+	case errors.Is(err, auth.ErrInvalidPayload):
+		return "Invalid token payload", true
+	case errors.Is(err, auth.ErrRevoked):
+		return "Token has been revoked", true
+	case errors.Is(err, auth.ErrAccountDisabled):
+		return "Account disabled", true
+	case errors.Is(err, auth.ErrOutdated):
+		return "Token is outdated, please log in again", true
+	case errors.Is(err, auth.ErrInvalidAPIKey):
+		return "Invalid API key", true
+	case errors.Is(err, auth.ErrInvalidSession):
+		return "Session expired, please log in again", true
+	}
+	return "", false
+}
+
+// RequirePermission ensures the principal is granted every one of perms, by
+// the user's roles or, for client credentials tokens, by their scope
+func (am *AuthMiddleware) RequirePermission(perms ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted := c.GetStringSlice("permissions")
+		for _, perm := range perms {
+			if !slices.Contains(granted, perm) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "permission denied", "required_permission": perm})
+				return
 			}
-			return []byte(am.secret), nil
-		})
-		
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			return
 		}
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		c.Next()
+	}
+}
+
+// RequireAdminMFA denies administrative routes to users without two-factor
+// authentication when the policy is on. Client credentials tokens have no
+// second factor and are denied too.
+func (am *AuthMiddleware) RequireAdminMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !am.requireAdminMFA {
+			c.Next()
 			return
 		}
-		// read username and role from claims
-		usernameI, ok1 := claims["username"]
-		roleI, ok2 := claims["role"]
-		if !ok1 || !ok2 {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token payload"})
+		if !c.GetBool("mfa_enabled") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "two-factor authentication required for admin access"})
 			return
 		}
-		username, _ := usernameI.(string)
-		role, _ := roleI.(string)
+		c.Next()
+	}
+}
 
-		// set into context
-		c.Set("username", username)
-		c.Set("role", role)
+// RequireVerifiedEmail denies users without a verified email address when
+// the policy is on. Client credentials tokens have no user and pass; what they
+// may access is limited by RequirePermission.
+func (am *AuthMiddleware) RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !am.requireVerifiedEmail || c.GetString("auth_method") == auth.MethodClientCredentials {
+			c.Next()
+			return
+		}
+		if !c.GetBool("email_verified") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "verify your email address to access this resource"})
+			return
+		}
 		c.Next()
 	}
 }
 
-// RequireAdmin ensures the authenticated user has admin role
-func (am *AuthMiddleware) RequireAdmin() gin.HandlerFunc {
+// RequireScope limits credentials that carry scopes, such as API keys, to
+// routes granted by scope. User sessions are not restricted.
+func (am *AuthMiddleware) RequireScope(scope string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		roleI, exists := c.Get("role")
-		if !exists {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		scopesI, scoped := c.Get("scopes")
+		if !scoped {
+			c.Next()
+			return
+		}
+		if scopes, _ := scopesI.([]string); !slices.Contains(scopes, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient scope", "required_scope": scope})
 			return
 		}
-		if role, _ := roleI.(string); role != "admin" {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+		c.Next()
+	}
+}
+
+// RequireSession rejects credentials that carry scopes, such as API keys, so
+// that account management is only possible from a user session
+func (am *AuthMiddleware) RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, scoped := c.Get("scopes"); scoped {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "this endpoint requires a user session"})
 			return
 		}
 		c.Next()
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GrantDeviceCode is the grant type of the device authorization grant (RFC 8628)
+const GrantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Device authorization states
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+	DeviceStatusUsed     = "used"
+)
+
+// DeviceCode is a pending device authorization. The device polls with the
+// device code, of which only the SHA-256 hash is stored, while the user enters
+// the short user code in a browser.
+type DeviceCode struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	DeviceCodeHash string             `bson:"device_code_hash" json:"-"`
+	UserCode       string             `bson:"user_code" json:"-"`
+	ClientID       string             `bson:"client_id" json:"-"`
+	Scope          string             `bson:"scope" json:"-"`
+	Status         string             `bson:"status" json:"-"`
+	UserID         primitive.ObjectID `bson:"user_id,omitempty" json:"-"`
+	AuthTime       time.Time          `bson:"auth_time,omitempty" json:"-"`
+	// Interval is the minimum number of seconds between polls
+	Interval     int        `bson:"interval" json:"-"`
+	LastPolledAt *time.Time `bson:"last_polled_at,omitempty" json:"-"`
+	CreatedAt    time.Time  `bson:"created_at" json:"-"`
+	ExpiresAt    time.Time  `bson:"expires_at" json:"-"`
+}
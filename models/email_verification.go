@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EmailVerification is a single-use token proving that a user receives mail at
+// Email. Only the SHA-256 hash of the token sent to the user is stored.
+type EmailVerification struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+	Email     string             `bson:"email" json:"email"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"-"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// LoginAttempt tracks consecutive failed logins for one account or client IP.
+// Key is "user:<username>" or "ip:<address>".
+type LoginAttempt struct {
+	Key         string    `bson:"_id" json:"key"`
+	Failures    int       `bson:"failures" json:"failures"`
+	LastFailure time.Time `bson:"last_failure" json:"last_failure"`
+	LockedUntil time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	ExpiresAt   time.Time `bson:"expires_at" json:"-"`
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OAuth grant types
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// Scopes defined by OAuth and OpenID Connect
+const (
+	// ScopeOfflineAccess lets an OAuth client obtain refresh tokens
+	ScopeOfflineAccess = "offline_access"
+	// ScopeOpenID requests an ID token and access to /userinfo
+	ScopeOpenID = "openid"
+	// ScopeProfile releases the user's profile claims
+	ScopeProfile = "profile"
+)
+
+// OAuthScopes lists the scopes OAuth clients may be registered for
+var OAuthScopes = []string{ScopeTasksRead, ScopeTasksWrite, ScopeUsersManage, ScopeOfflineAccess, ScopeOpenID, ScopeProfile}
+
+// ClientCredentialsScopes lists the scopes a client acting on its own behalf
+// may be granted. Each grants the permission of the same name; anything more
+// needs a user whose roles allow it.
+var ClientCredentialsScopes = []string{ScopeTasksRead}
+
+// OAuthGrantTypes lists the supported grant types
+var OAuthGrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials, GrantDeviceCode}
+
+// OAuthClient is an application registered to obtain tokens through the OAuth
+// endpoints. Public clients (such as SPAs and mobile apps) have no secret and
+// must use PKCE.
+type OAuthClient struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ClientID     string             `bson:"client_id" json:"client_id"`
+	SecretHash   string             `bson:"secret_hash,omitempty" json:"-"`
+	Name         string             `bson:"name" json:"name"`
+	RedirectURIs []string           `bson:"redirect_uris" json:"redirect_uris"`
+	GrantTypes   []string           `bson:"grant_types" json:"grant_types"`
+	Scopes       []string           `bson:"scopes" json:"scopes"`
+	Public       bool               `bson:"public" json:"public"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// AuthorizationCode is a short-lived, single-use code issued by /oauth/authorize.
+// Only the SHA-256 hash of the code is stored.
+type AuthorizationCode struct {
+	ID                  primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	CodeHash            string             `bson:"code_hash" json:"-"`
+	ClientID            string             `bson:"client_id" json:"-"`
+	UserID              primitive.ObjectID `bson:"user_id" json:"-"`
+	RedirectURI         string             `bson:"redirect_uri" json:"-"`
+	Scope               string             `bson:"scope" json:"-"`
+	CodeChallenge       string             `bson:"code_challenge,omitempty" json:"-"`
+	CodeChallengeMethod string             `bson:"code_challenge_method,omitempty" json:"-"`
+	Nonce               string             `bson:"nonce,omitempty" json:"-"`
+	AuthTime            time.Time          `bson:"auth_time" json:"-"`
+	CreatedAt           time.Time          `bson:"created_at" json:"-"`
+	ExpiresAt           time.Time          `bson:"expires_at" json:"-"`
+	UsedAt              *time.Time         `bson:"used_at,omitempty" json:"-"`
+	// refresh token family issued for the code, revoked if the code is replayed
+	FamilyID string `bson:"family_id,omitempty" json:"-"`
+}
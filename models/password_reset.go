@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PasswordReset is a single-use password reset token. Only the SHA-256 hash of
+// the token sent to the user is stored.
+type PasswordReset struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"-"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefreshToken is a server-stored refresh token. Only the SHA-256 hash of the
+// opaque token handed to the client is persisted. Tokens obtained from the same
+// login share a FamilyID so that a replayed token can revoke the whole chain.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	FamilyID  string             `bson:"family_id" json:"-"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"-"`
+	ClientID  string             `bson:"client_id,omitempty" json:"-"` // OAuth client the token was issued to, empty for first-party logins
+	Scope     string             `bson:"scope,omitempty" json:"-"`
+	AuthTime  time.Time          `bson:"auth_time,omitempty" json:"-"` // when the user signed in to grant an OAuth client
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"-"`
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty" json:"-"`
+}
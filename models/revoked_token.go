@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// RevokedToken records an access token (by jti) that must no longer be accepted.
+// Entries are kept until the token would have expired anyway.
+type RevokedToken struct {
+	JTI       string    `bson:"_id" json:"jti"`
+	RevokedAt time.Time `bson:"revoked_at" json:"revoked_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Permissions granted through roles
+const (
+	PermTasksRead     = "tasks:read"
+	PermTasksWrite    = "tasks:write"
+	PermUsersPromote  = "users:promote" // grant and take away roles
+	PermUsersManage   = "users:manage"  // sessions and lockouts of other users
+	PermRolesManage   = "roles:manage"
+	PermClientsManage = "clients:manage"
+)
+
+// Permissions lists every permission a role may grant
+var Permissions = []string{PermTasksRead, PermTasksWrite, PermUsersPromote, PermUsersManage, PermRolesManage, PermClientsManage}
+
+// Built-in roles. admin always has every permission; new users get user.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// Role is a named set of permissions, stored in mongodb by name
+type Role struct {
+	Name        string    `bson:"_id" json:"name"`
+	Description string    `bson:"description,omitempty" json:"description,omitempty"`
+	Permissions []string  `bson:"permissions" json:"permissions"`
+	BuiltIn     bool      `bson:"built_in" json:"built_in"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// ValidRoleName reports whether name may name a role: lowercase letters,
+// digits, "-" and "_", starting with a letter
+func ValidRoleName(name string) bool {
+	return roleNamePattern.MatchString(name)
+}
+
+// NormalizeRoles sorts roles and drops duplicates, so that role sets can be
+// compared with slices.Equal
+func NormalizeRoles(roles []string) []string {
+	out := slices.Clone(roles)
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// SameRoles reports whether a and b hold the same roles in any order
+func SameRoles(a, b []string) bool {
+	return slices.Equal(NormalizeRoles(a), NormalizeRoles(b))
+}
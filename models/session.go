@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session records a login. Browser sessions are identified by an opaque token
+// in an HttpOnly cookie; only SHA-256 hashes of it and of its CSRF token are
+// stored. Token logins are tied to their refresh token family, and their
+// access tokens carry the session id in the sid claim.
+type Session struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	TokenHash    string             `bson:"token_hash,omitempty" json:"-"`
+	CSRFHash     string             `bson:"csrf_hash,omitempty" json:"-"`
+	FamilyID     string             `bson:"family_id,omitempty" json:"-"`
+	UserID       primitive.ObjectID `bson:"user_id" json:"-"`
+	TokenVersion int                `bson:"token_version" json:"-"` // the user's token version at login; bumping it ends the session
+	IP           string             `bson:"ip" json:"ip"`
+	UserAgent    string             `bson:"user_agent" json:"user_agent"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	LastSeenAt   time.Time          `bson:"last_seen_at" json:"last_seen_at"`
+	// ExpiresAt is the idle deadline, pushed back on use but never past
+	// AbsoluteExpiresAt
+	ExpiresAt         time.Time `bson:"expires_at" json:"expires_at"`
+	AbsoluteExpiresAt time.Time `bson:"absolute_expires_at" json:"-"`
+}
+
+// Session types reported in SessionResponse
+const (
+	SessionTypeCookie = "cookie"
+	SessionTypeToken  = "token"
+)
+
+// SessionClient describes where a login came from
+type SessionClient struct {
+	IP        string
+	UserAgent string
+}
+
+// SessionResponse for API responses (id as hex string)
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session the request was made with
+	Current bool `json:"current"`
+}
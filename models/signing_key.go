@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// SigningKey is a JWT signing key pair. The private key is stored PKCS#8 PEM
+// encoded. Retired keys no longer sign tokens but stay published in the JWKS
+// until ExpiresAt, after which every token they signed has expired.
+type SigningKey struct {
+	ID         string     `bson:"_id" json:"kid"`
+	Algorithm  string     `bson:"algorithm" json:"alg"`
+	PrivateKey string     `bson:"private_key" json:"-"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	RetiredAt  *time.Time `bson:"retired_at,omitempty" json:"retired_at,omitempty"`
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
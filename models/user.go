@@ -1,11 +1,110 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // User stored in mongodb
 type User struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"-"`
 	Username     string             `bson:"username" json:"username" binding:"required"`
 	PasswordHash string             `bson:"password_hash" json:"-"`
-	Role         string             `bson:"role" json:"role"` // "admin" or "user"
+	Roles        []string           `bson:"roles" json:"roles"`     // names of models.Role, which grant permissions
+	TokenVersion int                `bson:"token_version" json:"-"` // bumped to revoke every issued token
+	Disabled     bool               `bson:"disabled" json:"disabled"`
+
+	// contact address, lowercased and unique; EmailVerified is set once the
+	// user proved to own it and cleared when it changes
+	Email         string `bson:"email,omitempty" json:"email,omitempty"`
+	EmailVerified bool   `bson:"email_verified" json:"email_verified"`
+
+	// two-factor authentication
+	MFAEnabled        bool     `bson:"mfa_enabled" json:"mfa_enabled"`
+	TOTPSecret        string   `bson:"totp_secret,omitempty" json:"-"`
+	TOTPPendingSecret string   `bson:"totp_pending_secret,omitempty" json:"-"` // awaiting confirmation
+	TOTPLastStep      int64    `bson:"totp_last_step,omitempty" json:"-"`      // last accepted time step, prevents code replay
+	RecoveryCodes     []string `bson:"recovery_codes,omitempty" json:"-"`      // SHA-256 hashes of unused codes
+
+	// passkeys and security keys, usable as either login factor
+	WebAuthnCredentials []WebAuthnCredential `bson:"webauthn_credentials,omitempty" json:"-"`
+
+	// accounts at external identity providers that sign in as this user
+	Identities []FederatedIdentity `bson:"identities,omitempty" json:"-"`
+}
+
+// FederatedIdentity links an account at an external OpenID Connect provider,
+// identified by issuer and subject, to a user
+type FederatedIdentity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Issuer   string    `bson:"issuer" json:"issuer"`
+	Subject  string    `bson:"subject" json:"subject"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+// WebAuthnCredential is a public key registered by a passkey or security key
+type WebAuthnCredential struct {
+	ID              []byte     `bson:"id" json:"-"`
+	Name            string     `bson:"name" json:"name"`
+	PublicKey       []byte     `bson:"public_key" json:"-"`
+	AttestationType string     `bson:"attestation_type" json:"-"`
+	Transports      []string   `bson:"transports,omitempty" json:"transports,omitempty"`
+	AAGUID          []byte     `bson:"aaguid,omitempty" json:"-"`
+	SignCount       uint32     `bson:"sign_count" json:"-"` // highest counter seen; a lower one suggests a cloned key
+	UserVerified    bool       `bson:"user_verified" json:"-"`
+	BackupEligible  bool       `bson:"backup_eligible" json:"backup_eligible"`
+	BackupState     bool       `bson:"backup_state" json:"backup_state"`
+	CreatedAt       time.Time  `bson:"created_at" json:"created_at"`
+	LastUsedAt      *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+}
+
+// WebAuthnCredentialResponse for API responses (id as base64url string)
+type WebAuthnCredentialResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Transports []string   `json:"transports,omitempty"`
+	Synced     bool       `json:"synced"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// HasSecondFactor reports whether the user has TOTP or a passkey to complete
+// a password login with
+func (u User) HasSecondFactor() bool {
+	return u.MFAEnabled || len(u.WebAuthnCredentials) > 0
+}
+
+// HasRole reports whether the user has the named role
+func (u User) HasRole(role string) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+// RolesForGroups maps groups at an external directory or identity provider to
+// roles, sorted and without duplicates. Users in no mapped group get
+// defaultRole.
+func RolesForGroups(groups []string, groupRoles map[string]string, defaultRole string) []string {
+	var roles []string
+	for _, g := range groups {
+		if role, ok := groupRoles[g]; ok {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		return []string{defaultRole}
+	}
+	return NormalizeRoles(roles)
+}
+
+// UserResponse for API responses (id as hex string)
+type UserResponse struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email,omitempty"`
+	Roles    []string `json:"roles"`
+	Disabled bool     `json:"disabled,omitempty"`
+
+	EmailVerified bool `json:"email_verified"`
+	MFAEnabled    bool `json:"mfa_enabled"`
 }
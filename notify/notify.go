@@ -0,0 +1,67 @@
+// Package notify delivers out-of-band messages such as password reset links to users
+package notify
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message is a notification addressed to a user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users
+type Notifier interface {
+	Send(msg Message) error
+}
+
+// LogNotifier writes messages to the standard logger; meant for local development
+type LogNotifier struct{}
+
+// Send logs the message
+func (LogNotifier) Send(msg Message) error {
+	log.Printf("notification to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileNotifier appends messages to a file; meant for local development and tests
+type FileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileNotifier constructs a FileNotifier writing to path
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+// Send appends the message to the file
+func (n *FileNotifier) Send(msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "--- %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Body)
+	return err
+}
+
+// New returns the notifier for kind ("log" or "file"); path is used by the file notifier
+func New(kind, path string) (Notifier, error) {
+	switch kind {
+	case "", "log":
+		return LogNotifier{}, nil
+	case "file":
+		return NewFileNotifier(path), nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", kind)
+}
@@ -0,0 +1,46 @@
+package passhash
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptMaxBytes is the longest password bcrypt can hash
+const BcryptMaxBytes = 72
+
+// Bcrypt hashes passwords with bcrypt at the given cost
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash implements Hasher
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+// Verify implements Hasher
+func (b Bcrypt) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MaxPasswordBytes returns BcryptMaxBytes; Hash fails for longer passwords
+func (b Bcrypt) MaxPasswordBytes() int {
+	return BcryptMaxBytes
+}
+
+// Handles implements Hasher
+func (b Bcrypt) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// NeedsRehash implements Hasher
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
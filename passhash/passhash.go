@@ -0,0 +1,80 @@
+// Package passhash hashes and verifies passwords with pluggable algorithms.
+// Hashes are self-describing strings (PHC format for argon2id, modular crypt
+// format for bcrypt) carrying their parameters, so the algorithm or its cost can
+// change without invalidating stored passwords.
+package passhash
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownHash is returned when no configured hasher recognizes a hash
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher is one password hashing algorithm with fixed parameters
+type Hasher interface {
+	// Hash returns the encoded hash of password
+	Hash(password string) (string, error)
+	// Verify reports whether password matches encoded
+	Verify(password, encoded string) (bool, error)
+	// Handles reports whether encoded was produced by this algorithm
+	Handles(encoded string) bool
+	// NeedsRehash reports whether encoded uses parameters other than the hasher's
+	NeedsRehash(encoded string) bool
+}
+
+// Manager hashes new passwords with the preferred hasher and verifies hashes
+// produced by any of the known ones
+type Manager struct {
+	preferred Hasher
+	hashers   []Hasher
+}
+
+// NewManager constructs a Manager hashing with preferred and also accepting
+// hashes of the legacy hashers
+func NewManager(preferred Hasher, legacy ...Hasher) *Manager {
+	return &Manager{preferred: preferred, hashers: append([]Hasher{preferred}, legacy...)}
+}
+
+// Hash hashes password with the preferred hasher
+func (m *Manager) Hash(password string) (string, error) {
+	return m.preferred.Hash(password)
+}
+
+// MaxPasswordBytes returns the length limit of the preferred hasher in bytes,
+// or 0 if it has none
+func (m *Manager) MaxPasswordBytes() int {
+	if l, ok := m.preferred.(interface{ MaxPasswordBytes() int }); ok {
+		return l.MaxPasswordBytes()
+	}
+	return 0
+}
+
+// Verify checks password against encoded. needsRehash is true when the password
+// matched but encoded should be replaced by a hash from the preferred hasher.
+func (m *Manager) Verify(password, encoded string) (ok bool, needsRehash bool, err error) {
+	for _, h := range m.hashers {
+		if !h.Handles(encoded) {
+			continue
+		}
+		ok, err := h.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, h != m.preferred || h.NeedsRehash(encoded), nil
+	}
+	return false, false, ErrUnknownHash
+}
+
+// New returns a Manager preferring alg ("argon2id" or "bcrypt") that verifies
+// hashes of both algorithms
+func New(alg string, argon Argon2id, bc Bcrypt) (*Manager, error) {
+	switch alg {
+	case "", "argon2id":
+		return NewManager(argon, bc), nil
+	case "bcrypt":
+		return NewManager(bc, argon), nil
+	}
+	return nil, fmt.Errorf("unknown password hash algorithm %q", alg)
+}
@@ -0,0 +1,110 @@
+package passhash_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"authgo/passhash"
+)
+
+// cheap parameters, for tests only
+var (
+	argon  = passhash.Argon2id{Time: 1, Memory: 64, Threads: 1, KeyLen: 16, SaltLen: 8}
+	bcrypt = passhash.Bcrypt{Cost: 4}
+)
+
+func mustHash(t *testing.T, h passhash.Hasher, password string) string {
+	t.Helper()
+	encoded, err := h.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	encoded := mustHash(t, argon, "correct horse battery staple")
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %q does not carry its parameters in PHC format", encoded)
+	}
+	if other := mustHash(t, argon, "correct horse battery staple"); other == encoded {
+		t.Error("two hashes of the same password are equal, want a random salt")
+	}
+
+	// verification uses the parameters of the hash, not of the hasher
+	stronger := passhash.Argon2id{Time: 2, Memory: 128, Threads: 2, KeyLen: 32, SaltLen: 16}
+	for _, password := range []string{"correct horse battery staple", "wrong password"} {
+		ok, err := stronger.Verify(password, encoded)
+		if want := password == "correct horse battery staple"; err != nil || ok != want {
+			t.Errorf("Verify(%q) = %v, %v, want %v", password, ok, err, want)
+		}
+	}
+}
+
+func TestArgon2idRejectsMalformedHashes(t *testing.T) {
+	valid := mustHash(t, argon, "password")
+	parts := strings.Split(valid, "$")
+	tests := map[string]string{
+		"too few fields":    strings.Join(parts[:5], "$"),
+		"other algorithm":   strings.Replace(valid, "$argon2id$", "$argon2i$", 1),
+		"other version":     strings.Replace(valid, "$v=19$", "$v=16$", 1),
+		"bad parameters":    strings.Replace(valid, "m=64,t=1,p=1", "m=64;t=1", 1),
+		"salt not base64":   strings.Join([]string{"", parts[1], parts[2], parts[3], "!!", parts[5]}, "$"),
+		"empty key":         strings.Join([]string{"", parts[1], parts[2], parts[3], parts[4], ""}, "$"),
+		"key not base64":    strings.Join([]string{"", parts[1], parts[2], parts[3], parts[4], "%%"}, "$"),
+		"not a hash at all": "password",
+	}
+	for name, encoded := range tests {
+		t.Run(name, func(t *testing.T) {
+			if ok, err := argon.Verify("password", encoded); ok || err == nil {
+				t.Errorf("Verify = %v, %v, want an error", ok, err)
+			}
+			if !argon.NeedsRehash(encoded) {
+				t.Error("NeedsRehash = false, want malformed hashes replaced")
+			}
+		})
+	}
+}
+
+func TestManagerVerify(t *testing.T) {
+	const password = "correct horse battery staple"
+	tests := []struct {
+		name       string
+		manager    *passhash.Manager
+		encoded    string
+		password   string
+		wantOK     bool
+		wantRehash bool
+		wantErr    error
+	}{
+		{"preferred hash", passhash.NewManager(argon, bcrypt), mustHash(t, argon, password), password, true, false, nil},
+		{"preferred algorithm, older parameters", passhash.NewManager(argon, bcrypt),
+			mustHash(t, passhash.Argon2id{Time: 1, Memory: 32, Threads: 1, KeyLen: 16, SaltLen: 8}, password), password, true, true, nil},
+		{"legacy algorithm", passhash.NewManager(argon, bcrypt), mustHash(t, bcrypt, password), password, true, true, nil},
+		{"bcrypt at another cost", passhash.NewManager(bcrypt, argon), mustHash(t, passhash.Bcrypt{Cost: 5}, password), password, true, true, nil},
+		{"wrong password needs no rehash", passhash.NewManager(argon, bcrypt), mustHash(t, bcrypt, password), "wrong password", false, false, nil},
+		{"unknown algorithm", passhash.NewManager(argon), mustHash(t, bcrypt, password), password, false, false, passhash.ErrUnknownHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := tt.manager.Verify(tt.password, tt.encoded)
+			if ok != tt.wantOK || rehash != tt.wantRehash || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify = %v, %v, %v, want %v, %v, %v", ok, rehash, err, tt.wantOK, tt.wantRehash, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBcryptLengthLimit(t *testing.T) {
+	m := passhash.NewManager(bcrypt, argon)
+	if got := m.MaxPasswordBytes(); got != passhash.BcryptMaxBytes {
+		t.Errorf("MaxPasswordBytes = %d, want %d", got, passhash.BcryptMaxBytes)
+	}
+	if _, err := m.Hash(strings.Repeat("a", passhash.BcryptMaxBytes+1)); err == nil {
+		t.Error("bcrypt hashed a password longer than it can verify")
+	}
+	if got := passhash.NewManager(argon, bcrypt).MaxPasswordBytes(); got != 0 {
+		t.Errorf("argon2id MaxPasswordBytes = %d, want no limit", got)
+	}
+}
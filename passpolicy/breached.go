@@ -0,0 +1,72 @@
+package passpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// BreachedList is an offline corpus of breached password SHA-1 hashes, indexed
+// like the k-anonymity range API: by the first five hex characters, each prefix
+// holding the sorted remaining 35-character suffixes
+type BreachedList struct {
+	ranges map[string][]string
+	count  int
+}
+
+// LoadBreached reads a corpus file with one uppercase or lowercase SHA-1 hex
+// digest per line, optionally followed by ":<count>" as in the Have I Been
+// Pwned downloads. Blank lines and lines starting with # are ignored.
+func LoadBreached(path string) (*BreachedList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedList{ranges: map[string][]string{}}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 40 {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hex digest", path, line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hex digest", path, line)
+		}
+		b.ranges[hash[:5]] = append(b.ranges[hash[:5]], hash[5:])
+		b.count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, suffixes := range b.ranges {
+		sort.Strings(suffixes)
+	}
+	return b, nil
+}
+
+// Len returns the number of hashes in the corpus
+func (b *BreachedList) Len() int {
+	return b.count
+}
+
+// Contains reports whether password is in the corpus
+func (b *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes := b.ranges[hash[:5]]
+	i := sort.SearchStrings(suffixes, hash[5:])
+	return i < len(suffixes) && suffixes[i] == hash[5:]
+}
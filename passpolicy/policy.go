@@ -0,0 +1,91 @@
+// Package passpolicy validates new passwords against a configurable policy:
+// length, estimated strength, username reuse and a breached-password corpus
+package passpolicy
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rule names reported in violations
+const (
+	RuleMinLength        = "min_length"
+	RuleMaxLength        = "max_length"
+	RuleStrength         = "strength"
+	RuleContainsUsername = "contains_username"
+	RuleBreached         = "breached"
+)
+
+// Violation is one failed policy rule
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Error lists every rule a password failed
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return "password does not meet policy: " + strings.Join(msgs, "; ")
+}
+
+// DefaultMaxLength caps passwords when Policy.MaxLength is zero, since scoring
+// a password takes time in proportion to its length
+const DefaultMaxLength = 1024
+
+// Policy is the set of rules new passwords must satisfy. Zero values disable a
+// rule, except MaxLength which falls back to DefaultMaxLength.
+type Policy struct {
+	MinLength        int
+	MaxLength        int
+	MaxBytes         int // limit of the password hasher, such as bcrypt's 72 bytes
+	MinScore         int // 0 (weakest) to 4, see Score
+	DisallowUsername bool
+	Breached         *BreachedList
+}
+
+// Validate checks password for username and returns an *Error listing every
+// failed rule, or nil
+func (p *Policy) Validate(username, password string) error {
+	if p == nil {
+		return nil
+	}
+	var violations []Violation
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		violations = append(violations, Violation{RuleMinLength, fmt.Sprintf("must be at least %d characters", p.MinLength)})
+	}
+	maxLength := p.MaxLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLength
+	}
+	if length > maxLength {
+		violations = append(violations, Violation{RuleMaxLength, fmt.Sprintf("must be at most %d characters", maxLength)})
+	} else if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		violations = append(violations, Violation{RuleMaxLength, fmt.Sprintf("must be at most %d bytes", p.MaxBytes)})
+	}
+	if len(violations) > 0 {
+		// scoring and the breached lookup are not worth their cost here
+		return &Error{Violations: violations}
+	}
+	if p.DisallowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, Violation{RuleContainsUsername, "must not contain the username"})
+	}
+	if p.MinScore > 0 && Score(password, username) < p.MinScore {
+		violations = append(violations, Violation{RuleStrength, "is too easy to guess"})
+	}
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, Violation{RuleBreached, "appears in a list of breached passwords"})
+	}
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package passpolicy_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"authgo/passpolicy"
+)
+
+// writeCorpus writes a breached password file listing passwords, and returns
+// its path
+func writeCorpus(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLoadBreached(t *testing.T) {
+	path := writeCorpus(t,
+		"# breached passwords",
+		strings.ToUpper(sha1Hex("Tr0ub4dor&3"))+":42",
+		"",
+		sha1Hex("hunter2"), // lowercase, without a count
+	)
+	b, err := passpolicy.LoadBreached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 2 {
+		t.Errorf("Len = %d, want 2", b.Len())
+	}
+	for password, want := range map[string]bool{"Tr0ub4dor&3": true, "hunter2": true, "tr0ub4dor&3": false, "correct horse battery staple": false} {
+		if got := b.Contains(password); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", password, got, want)
+		}
+	}
+
+	for name, line := range map[string]string{"too short": "5BAA61E4C9B93F3F", "not hex": strings.Repeat("Z", 40)} {
+		if _, err := passpolicy.LoadBreached(writeCorpus(t, line)); err == nil {
+			t.Errorf("%s line accepted", name)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		password string
+		min, max int
+	}{
+		{"password", 0, 0},
+		{"P@ssw0rd", 0, 0},
+		{"qwertyuiop", 0, 0},
+		{"aaaaaaaaaaaa", 0, 0},
+		{"abcdefgh12345678", 0, 1},
+		{"correct horse battery staple", 4, 4},
+		{"xK9#mQ2$vL7!", 4, 4},
+	}
+	for _, tt := range tests {
+		if got := passpolicy.Score(tt.password); got < tt.min || got > tt.max {
+			t.Errorf("Score(%q) = %d, want %d to %d", tt.password, got, tt.min, tt.max)
+		}
+	}
+	if with, without := passpolicy.Score("alice2024", "alice"), passpolicy.Score("alice2024"); with >= without {
+		t.Errorf("Score with the username as input = %d, want less than %d", with, without)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	breached, err := passpolicy.LoadBreached(writeCorpus(t, sha1Hex("Tr0ub4dor&3")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &passpolicy.Policy{MinLength: 8, MaxBytes: 72, MinScore: 2, DisallowUsername: true, Breached: breached}
+
+	tests := []struct {
+		name     string
+		policy   *passpolicy.Policy
+		password string
+		want     []string
+	}{
+		{"strong", policy, "correct horse battery staple", nil},
+		{"too short, not scored", policy, "abc", []string{passpolicy.RuleMinLength}},
+		{"over the hasher limit", policy, strings.Repeat("correct horse ", 6), []string{passpolicy.RuleMaxLength}},
+		{"over the default length", &passpolicy.Policy{}, strings.Repeat("a", passpolicy.DefaultMaxLength+1), []string{passpolicy.RuleMaxLength}},
+		{"contains the username", policy, "correct Alice battery", []string{passpolicy.RuleContainsUsername}},
+		{"easy to guess", policy, "password1234", []string{passpolicy.RuleStrength}},
+		{"breached", policy, "Tr0ub4dor&3", []string{passpolicy.RuleBreached}},
+		{"no policy", nil, "a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate("alice", tt.password)
+			var got []string
+			var perr *passpolicy.Error
+			if errors.As(err, &perr) {
+				for _, v := range perr.Violations {
+					got = append(got, v.Rule)
+				}
+			} else if err != nil {
+				t.Fatalf("err = %v, want a *passpolicy.Error", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
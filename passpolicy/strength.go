@@ -0,0 +1,181 @@
+package passpolicy
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// commonPasswords are among the most used passwords and base words; they are
+// matched case-insensitively as substrings
+var commonPasswords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "monkey", "dragon",
+	"football", "baseball", "iloveyou", "admin", "login", "master", "sunshine",
+	"princess", "shadow", "superman", "michael", "jennifer", "trustno1",
+	"passw0rd", "abc123", "starwars", "whatever", "freedom", "hello", "secret",
+	"charlie", "hunter", "ranger", "batman", "soccer", "summer", "winter",
+	"spring", "autumn", "computer", "internet", "changeme", "default", "access",
+	"flower", "cookie", "pepper", "killer", "ginger", "hockey", "tigger",
+	"buster", "jordan", "harley", "andrew", "thomas", "robert", "daniel",
+	"matrix", "mustang", "corvette", "cheese", "banana", "orange", "purple",
+	"silver", "golden", "diamond", "qazwsx", "zaq12wsx", "1q2w3e4r", "asdfgh",
+	"zxcvbn", "google", "yankees", "lakers", "chelsea", "arsenal", "liverpool",
+}
+
+// keyboardRows are matched for runs such as "qwer" or "asdf"
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+// maxRowLength bounds the keyboard runs looked for
+var maxRowLength = len(slices.MaxFunc(keyboardRows, func(a, b string) int { return len(a) - len(b) }))
+
+// Score estimates password strength from 0 (trivially guessable) to 4 (very
+// strong), in the spirit of zxcvbn: the password is split into dictionary
+// words, repeats, sequences and keyboard runs, each costing far fewer guesses
+// than random characters. userInputs (such as the username) count as words.
+func Score(password string, userInputs ...string) int {
+	bits := entropyBits(password, userInputs)
+	// zxcvbn thresholds of 1e3, 1e6, 1e8 and 1e10 guesses
+	switch {
+	case bits < 10:
+		return 0
+	case bits < 20:
+		return 1
+	case bits < 26.6:
+		return 2
+	case bits < 33.2:
+		return 3
+	}
+	return 4
+}
+
+func entropyBits(password string, userInputs []string) float64 {
+	lower := []rune(strings.ToLower(password))
+	// substitutions are one character each, so indexes into lower hold
+	plain := []rune(unleet(string(lower)))
+	words := make([][]rune, 0, len(commonPasswords)+len(userInputs))
+	for _, w := range commonPasswords {
+		words = append(words, []rune(w))
+	}
+	for _, in := range userInputs {
+		if len(in) >= 3 {
+			words = append(words, []rune(strings.ToLower(in)))
+		}
+	}
+	charBits := math.Log2(float64(charsetSize(password)))
+
+	var bits float64
+	for i := 0; i < len(lower); {
+		n, cost := longestPattern(lower[i:], plain[i:], words)
+		if n == 0 {
+			bits += charBits
+			i++
+			continue
+		}
+		bits += cost
+		i += n
+	}
+	return bits
+}
+
+// longestPattern returns the length and cost in bits of the longest low-entropy
+// pattern at the start of s, or 0 if none matches. plain is s with leet
+// substitutions undone. Only as much of s as the longest word or keyboard row
+// is compared, which keeps scoring linear in the password length.
+func longestPattern(s, plain []rune, words [][]rune) (int, float64) {
+	best, cost := 0, 0.0
+	consider := func(n int, c float64) {
+		if n > best {
+			best, cost = n, c
+		}
+	}
+	for rank, w := range words {
+		if hasPrefix(s, w) || hasPrefix(plain, w) {
+			consider(len(w), math.Log2(float64(rank+2))+1)
+		}
+	}
+	// repeated character
+	if n := runLength(s, func(a, b rune) bool { return a == b }); n >= 3 {
+		consider(n, math.Log2(float64(n)*26))
+	}
+	// ascending or descending sequence such as "abcd" or "4321"
+	if n := runLength(s, func(a, b rune) bool { return b == a+1 }); n >= 3 {
+		consider(n, math.Log2(float64(n)*26))
+	}
+	if n := runLength(s, func(a, b rune) bool { return b == a-1 }); n >= 3 {
+		consider(n, math.Log2(float64(n)*52))
+	}
+	// keyboard row run
+	for _, row := range keyboardRows {
+		for n := min(len(s), maxRowLength); n >= 4; n-- {
+			if strings.Contains(row, string(s[:n])) {
+				consider(n, math.Log2(float64(n)*47))
+				break
+			}
+		}
+	}
+	return best, cost
+}
+
+// hasPrefix reports whether s begins with prefix
+func hasPrefix(s, prefix []rune) bool {
+	return len(s) >= len(prefix) && slices.Equal(s[:len(prefix)], prefix)
+}
+
+// runLength returns how many leading runes of s form a chain under next
+func runLength(s []rune, next func(a, b rune) bool) int {
+	if len(s) == 0 {
+		return 0
+	}
+	n := 1
+	for n < len(s) && next(s[n-1], s[n]) {
+		n++
+	}
+	return n
+}
+
+var leet = strings.NewReplacer("@", "a", "4", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+// unleet undoes common character substitutions such as "p@ssw0rd"
+func unleet(s string) string {
+	return leet.Replace(s)
+}
+
+// charsetSize estimates the alphabet a brute-force attacker has to cover
+func charsetSize(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	if size == 0 {
+		size = 1
+	}
+	return size
+}
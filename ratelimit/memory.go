@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket is full again if left idle
+}
+
+// sweepInterval is how often idle buckets are dropped
+const sweepInterval = time.Minute
+
+// MemoryStore is a token bucket store kept in process memory. Limits are per
+// instance, so use MongoStore when running several replicas.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryStore constructs a MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+// Take removes one token from the key's bucket, which holds limit.Requests
+// tokens and refills continuously over limit.Period
+func (s *MemoryStore) Take(key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Period.Seconds() // tokens per second
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+		b.updated = now
+	}
+
+	res := Result{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = secondsToDuration((capacity - b.tokens) / rate)
+	b.full = now.Add(res.Reset)
+
+	s.sweep(now)
+	return res, nil
+}
+
+// sweep drops buckets idle long enough to be full again, at most once per
+// sweepInterval. Each bucket carries its own refill time, as buckets of
+// different limits share the store.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for k, b := range s.buckets {
+		if now.After(b.full) {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+func secondsToDuration(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second))
+}
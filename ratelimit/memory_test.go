@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// rewind moves every bucket of s back by d, as if d had passed
+func rewind(s *MemoryStore, d time.Duration) {
+	for _, b := range s.buckets {
+		b.updated = b.updated.Add(-d)
+		b.full = b.full.Add(-d)
+	}
+	s.lastSweep = s.lastSweep.Add(-d)
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Requests: 2, Period: time.Second}
+
+	for i := 0; i < 2; i++ {
+		if res, _ := s.Take("k", limit); !res.Allowed || res.Remaining != 1-i {
+			t.Fatalf("request %d: %+v, want allowed with %d remaining", i+1, res, 1-i)
+		}
+	}
+	res, _ := s.Take("k", limit)
+	if res.Allowed {
+		t.Fatal("third request allowed, want the bucket empty")
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > 500*time.Millisecond {
+		t.Errorf("RetryAfter = %v, want up to the 500ms one token takes", res.RetryAfter)
+	}
+
+	// one token comes back every 500ms
+	rewind(s, 500*time.Millisecond)
+	if res, _ := s.Take("k", limit); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("after 500ms: %+v, want one request allowed", res)
+	}
+	// and the bucket holds no more than its capacity
+	rewind(s, time.Hour)
+	if res, _ := s.Take("k", limit); !res.Allowed || res.Remaining != 1 {
+		t.Errorf("after an hour: %+v, want a full bucket", res)
+	}
+}
+
+func TestMemoryStoreSweepsEachBucketByItsOwnLimit(t *testing.T) {
+	s := NewMemoryStore()
+	s.Take("short", Limit{Requests: 1, Period: time.Second})
+	s.Take("long", Limit{Requests: 1, Period: time.Hour})
+
+	rewind(s, 2*sweepInterval)
+	// the sweep runs on the next request, whatever its limit
+	s.Take("other", Limit{Requests: 1, Period: time.Second})
+	if _, ok := s.buckets["short"]; ok {
+		t.Error("refilled bucket kept")
+	}
+	if _, ok := s.buckets["long"]; !ok {
+		t.Fatal("bucket of the hourly limit dropped before it refilled")
+	}
+	if res, _ := s.Take("long", Limit{Requests: 1, Period: time.Hour}); res.Allowed {
+		t.Error("hourly limit allowed a second request within the hour")
+	}
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type window struct {
+	Count int `bson:"count"`
+}
+
+// MongoStore is a sliding window store backed by MongoDB, so that limits hold
+// across replicas. The rate is estimated from the counts of the current and the
+// previous fixed window, weighting the previous one by how much of it still
+// overlaps the sliding window.
+type MongoStore struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+}
+
+// NewMongoStore constructs a MongoStore
+func NewMongoStore(coll *mongo.Collection) *MongoStore {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return &MongoStore{collection: coll, timeout: 2 * time.Second}
+}
+
+// Take counts one request for key and reports whether it is within limit
+func (s *MongoStore) Take(key string, limit Limit) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	now := time.Now()
+	start := now.Truncate(limit.Period)
+	elapsed := now.Sub(start)
+
+	// count this request in the current window
+	current := fmt.Sprintf("%s|%d", key, start.Unix())
+	update := bson.M{
+		"$inc":         bson.M{"count": 1},
+		"$setOnInsert": bson.M{"expires_at": start.Add(2 * limit.Period)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var cur window
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": current}, update, opts).Decode(&cur); err != nil {
+		return Result{}, err
+	}
+
+	var prev window
+	previous := fmt.Sprintf("%s|%d", key, start.Add(-limit.Period).Unix())
+	if err := s.collection.FindOne(ctx, bson.M{"_id": previous}).Decode(&prev); err != nil && err != mongo.ErrNoDocuments {
+		return Result{}, err
+	}
+
+	overlap := 1 - elapsed.Seconds()/limit.Period.Seconds()
+	estimated := float64(prev.Count)*overlap + float64(cur.Count)
+
+	res := Result{
+		Allowed:   estimated <= float64(limit.Requests),
+		Remaining: int(math.Max(0, float64(limit.Requests)-estimated)),
+		Reset:     limit.Period - elapsed,
+	}
+	if !res.Allowed {
+		res.RetryAfter = retryAfter(prev.Count, cur.Count, limit, elapsed)
+	}
+	return res, nil
+}
+
+// retryAfter estimates when the sliding count drops back under the limit,
+// assuming no further requests: first by the previous window sliding out, and
+// failing that, at the start of the next window
+func retryAfter(prev, cur int, limit Limit, elapsed time.Duration) time.Duration {
+	if prev > 0 {
+		// prev*(1 - t/period) + cur <= limit  =>  t >= period*(1 - (limit-cur)/prev)
+		t := limit.Period.Seconds() * (1 - float64(limit.Requests-cur)/float64(prev))
+		if t > elapsed.Seconds() && t < limit.Period.Seconds() {
+			return secondsToDuration(t) - elapsed
+		}
+	}
+	return limit.Period - elapsed
+}
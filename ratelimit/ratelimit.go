@@ -0,0 +1,134 @@
+// Package ratelimit provides gin middleware that throttles requests per client
+// key, with in-memory and MongoDB backed stores
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limit allows Requests per Period
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit parses limits such as "10/m", "5/s", "1000/h" or "100/30s".
+// An empty string or "0" disables the limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, want <requests>/<period>", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid request count in rate limit %q", s)
+	}
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		d, err = time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return Limit{}, fmt.Errorf("invalid period in rate limit %q", s)
+		}
+	}
+	return Limit{Requests: n, Period: d}, nil
+}
+
+// Enabled reports whether the limit throttles anything
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// Result describes the outcome of taking a request from a key's allowance
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration // until the allowance is fully restored
+	RetryAfter time.Duration // until the next request would be allowed, when denied
+}
+
+// Store keeps per-key request allowances
+type Store interface {
+	Take(key string, limit Limit) (Result, error)
+}
+
+// KeyFunc derives the throttling key of a request
+type KeyFunc func(c *gin.Context) string
+
+// ByIP keys requests by client IP
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUsername keys requests by the authenticated username, falling back to the
+// client IP; it must run after AuthRequired
+func ByUsername(c *gin.Context) string {
+	if u := c.GetString("username"); u != "" {
+		return "user:" + u
+	}
+	return ByIP(c)
+}
+
+// Limiter builds throttling middleware on top of a Store
+type Limiter struct {
+	store Store
+}
+
+// New constructs a Limiter
+func New(store Store) *Limiter {
+	return &Limiter{store: store}
+}
+
+// Limit returns middleware allowing limit requests per key. name separates
+// the counters of different route groups. Responses carry RateLimit-* headers;
+// throttled requests get 429 with Retry-After. If the store fails the request
+// is let through.
+func (l *Limiter) Limit(name string, limit Limit, key KeyFunc) gin.HandlerFunc {
+	if !limit.Enabled() {
+		return func(c *gin.Context) { c.Next() }
+	}
+	policy := fmt.Sprintf("%d;w=%d", limit.Requests, int(limit.Period.Seconds()))
+	return func(c *gin.Context) {
+		res, err := l.store.Take(name+"|"+key(c), limit)
+		if err != nil {
+			log.Printf("rate limit store error: %v", err)
+			c.Next()
+			return
+		}
+		c.Header("RateLimit-Policy", policy)
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("RateLimit-Reset", seconds(res.Reset))
+		if !res.Allowed {
+			c.Header("Retry-After", seconds(res.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func seconds(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,35 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limit
+		wantErr bool
+	}{
+		{"10/m", Limit{10, time.Minute}, false},
+		{"5/s", Limit{5, time.Second}, false},
+		{" 1000/h ", Limit{1000, time.Hour}, false},
+		{"100/30s", Limit{100, 30 * time.Second}, false},
+		{"", Limit{}, false},
+		{"0", Limit{}, false},
+		{"10", Limit{}, true},
+		{"x/m", Limit{}, true},
+		{"-1/m", Limit{}, true},
+		{"10/fortnight", Limit{}, true},
+		{"10/-1s", Limit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLimit(%q) = %+v, %v, want %+v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if (Limit{}).Enabled() || (Limit{Requests: 0, Period: time.Minute}).Enabled() {
+		t.Error("zero limit enabled")
+	}
+}
@@ -3,37 +3,158 @@ package router
 import (
 	"authgo/controllers"
 	"authgo/middleware"
+	"authgo/models"
+	"authgo/ratelimit"
 
 	"github.com/gin-gonic/gin"
 )
 
+// RateLimits configures throttling per route group
+type RateLimits struct {
+	Auth ratelimit.Limit // public auth endpoints, per client IP
+	API  ratelimit.Limit // authenticated endpoints, per user
+}
+
 // SetupRouter configures routes and middleware
-func SetupRouter(ctl *controllers.Controller, authMw *middleware.AuthMiddleware) *gin.Engine {
+func SetupRouter(ctl *controllers.Controller, oauth *controllers.OAuthController, fed *controllers.FederationController, passkeys *controllers.WebAuthnController, authMw *middleware.AuthMiddleware, rl *ratelimit.Limiter, limits RateLimits) *gin.Engine {
 	r := gin.Default()
 
+	r.GET("/.well-known/jwks.json", ctl.JWKS)
+	r.GET("/.well-known/openid-configuration", oauth.Discovery)
+
 	// Public auth endpoints
-	r.POST("/register", ctl.Register)
-	r.POST("/login", ctl.Login)
+	public := r.Group("/")
+	public.Use(rl.Limit("auth", limits.Auth, ratelimit.ByIP))
+	{
+		public.POST("/register", ctl.Register)
+		public.POST("/login", ctl.Login)
+		public.POST("/login/mfa", ctl.LoginMFA)
+		public.POST("/login/magic", ctl.RequestMagicLink)
+		public.GET("/login/magic/verify", ctl.VerifyMagicLink)
+		public.POST("/token/refresh", ctl.Refresh)
+		public.POST("/password/forgot", ctl.ForgotPassword)
+		public.POST("/password/reset", ctl.ResetPassword)
+		// the token identifies the account, so users who may not log in
+		// before verifying can use it
+		public.POST("/me/email/verify", ctl.VerifyEmail)
+
+		// OAuth 2.0 authorization server
+		public.GET("/oauth/authorize", oauth.Authorize)
+		public.POST("/oauth/authorize", oauth.AuthorizeSubmit)
+		public.GET("/oauth/device", oauth.DeviceVerify)
+		public.POST("/oauth/device", oauth.DeviceVerifySubmit)
+
+		// sign in through external OpenID Connect providers
+		public.GET("/auth/:provider/start", fed.Start)
+		public.GET("/auth/:provider/callback", fed.Callback)
+
+		// passkey login, or a passkey as the second factor of a password login
+		public.POST("/webauthn/login/begin", passkeys.BeginLogin)
+		public.POST("/webauthn/login/finish", passkeys.FinishLogin)
+	}
+
+	// authenticated groups share one per-user allowance
+	apiLimit := rl.Limit("api", limits.API, ratelimit.ByUsername)
+
+	// OAuth endpoints called by client backends, devices and resource
+	// servers, at API rates per client IP. Their counters are kept apart from
+	// the per-user ones.
+	tokenAPI := r.Group("/oauth", rl.Limit("oauth", limits.API, ratelimit.ByIP))
+	{
+		tokenAPI.POST("/token", oauth.Token)
+		tokenAPI.POST("/device/code", oauth.DeviceAuthorization)
+		tokenAPI.POST("/introspect", oauth.Introspect)
+		tokenAPI.POST("/revoke", oauth.Revoke)
+	}
 
-	// Routes requiring authentication
+	// Routes requiring authentication. API keys only reach routes granted by
+	// one of their scopes.
 	auth := r.Group("/")
-	auth.Use(authMw.AuthRequired())
+	auth.Use(authMw.AuthRequired(), apiLimit)
 	{
-		// All authenticated users can read tasks
-		auth.GET("/tasks", ctl.GetTasks)
-		auth.GET("/tasks/:id", ctl.GetTaskByID)
+		// Users whose roles grant tasks:read, "user" by default
+		tasks := auth.Group("/", authMw.RequireScope(models.ScopeTasksRead), authMw.RequirePermission(models.PermTasksRead), authMw.RequireVerifiedEmail())
+		tasks.GET("/tasks", ctl.GetTasks)
+		tasks.GET("/tasks/:id", ctl.GetTaskByID)
+
+		// OpenID Connect userinfo
+		userinfo := auth.Group("/", authMw.RequireScope(models.ScopeOpenID))
+		userinfo.GET("/userinfo", oauth.UserInfo)
+		userinfo.POST("/userinfo", oauth.UserInfo)
+	}
+
+	// Account management, only from a user session
+	account := r.Group("/")
+	account.Use(authMw.AuthRequired(), apiLimit, authMw.RequireSession())
+	{
+		account.POST("/logout", ctl.Logout)
+
+		// Self-service
+		account.GET("/me", ctl.GetMe)
+		account.PATCH("/me", ctl.UpdateMe)
+		account.POST("/me/password", ctl.ChangePassword)
+		account.DELETE("/me", ctl.DeleteMe)
+		account.POST("/me/email/verification", ctl.RequestEmailVerification)
+
+		// Where the user is logged in
+		account.GET("/me/sessions", ctl.ListMySessions)
+		account.DELETE("/me/sessions/:id", ctl.DeleteMySession)
+
+		// Two-factor authentication
+		account.POST("/me/mfa/totp/enroll", ctl.EnrollTOTP)
+		account.POST("/me/mfa/totp/confirm", ctl.ConfirmTOTP)
+		account.DELETE("/me/mfa/totp", ctl.DisableTOTP)
+
+		// Passkeys and security keys
+		account.POST("/webauthn/register/begin", passkeys.BeginRegistration)
+		account.POST("/webauthn/register/finish", passkeys.FinishRegistration)
+		account.GET("/me/webauthn/credentials", passkeys.ListWebAuthnCredentials)
+		account.DELETE("/me/webauthn/credentials/:id", passkeys.DeleteWebAuthnCredential)
+
+		// Personal access tokens
+		account.POST("/me/tokens", ctl.CreateAPIKey)
+		account.GET("/me/tokens", ctl.ListAPIKeys)
+		account.DELETE("/me/tokens/:id", ctl.DeleteAPIKey)
 	}
 
-	// Admin-only actions
+	// Administrative actions, each gated by a permission
 	admin := r.Group("/")
-	admin.Use(authMw.AuthRequired(), authMw.RequireAdmin())
+	admin.Use(authMw.AuthRequired(), apiLimit, authMw.RequireAdminMFA())
 	{
-		admin.POST("/tasks", ctl.CreateTask)
-		admin.PUT("/tasks/:id", ctl.UpdateTask)
-		admin.DELETE("/tasks/:id", ctl.DeleteTask)
+		taskAdmin := admin.Group("/", authMw.RequireScope(models.ScopeTasksWrite), authMw.RequirePermission(models.PermTasksWrite), authMw.RequireVerifiedEmail())
+		taskAdmin.POST("/tasks", ctl.CreateTask)
+		taskAdmin.PUT("/tasks/:id", ctl.UpdateTask)
+		taskAdmin.DELETE("/tasks/:id", ctl.DeleteTask)
+
+		userAdmin := admin.Group("/", authMw.RequireScope(models.ScopeUsersManage))
+		// granting roles
+		promote := userAdmin.Group("/", authMw.RequirePermission(models.PermUsersPromote))
+		promote.POST("/promote/:username", ctl.Promote)
+		promote.PUT("/users/:username/roles", ctl.SetUserRoles)
+		promote.POST("/users/:username/demote", ctl.Demote)
+
+		// sessions, lockouts and accounts
+		manage := userAdmin.Group("/", authMw.RequirePermission(models.PermUsersManage))
+		manage.GET("/users/:username/sessions", ctl.ListUserSessions)
+		manage.DELETE("/users/:username/sessions", ctl.RevokeUserSessions)
+		manage.DELETE("/users/:username/sessions/:id", ctl.DeleteUserSession)
+		manage.POST("/users/:username/unlock", ctl.Unlock)
+		manage.POST("/users/:username/disable", ctl.DisableUser)
+		manage.POST("/users/:username/enable", ctl.EnableUser)
+		manage.DELETE("/users/:username", ctl.DeleteUser)
+
+		// OAuth client registration
+		clientAdmin := admin.Group("/oauth/clients", authMw.RequireSession(), authMw.RequirePermission(models.PermClientsManage))
+		clientAdmin.POST("", oauth.CreateClient)
+		clientAdmin.GET("", oauth.ListClients)
+		clientAdmin.DELETE("/:client_id", oauth.DeleteClient)
 
-		// promote endpoint
-		admin.POST("/promote/:username", ctl.Promote)
+		// Roles and the permissions they grant
+		roleAdmin := admin.Group("/roles", authMw.RequireSession(), authMw.RequirePermission(models.PermRolesManage))
+		roleAdmin.GET("", ctl.ListRoles)
+		roleAdmin.POST("", ctl.CreateRole)
+		roleAdmin.PUT("/:name", ctl.UpdateRole)
+		roleAdmin.DELETE("/:name", ctl.DeleteRole)
 	}
 
 	return r
@@ -0,0 +1,330 @@
+// Package tokens signs and verifies JWTs with rotating asymmetric keys
+package tokens
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"authgo/data"
+	"authgo/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// reloadInterval bounds how often an unknown kid may trigger a reload from the store
+const reloadInterval = 10 * time.Second
+
+type signingKey struct {
+	kid       string
+	alg       string
+	method    jwt.SigningMethod
+	private   crypto.PrivateKey
+	public    crypto.PublicKey
+	createdAt time.Time
+	retired   bool
+}
+
+// KeyManager holds the signing key set. One key signs new tokens; retired keys
+// remain available for verification and in the JWKS until their tokens expire.
+type KeyManager struct {
+	store       *data.SigningKeyService
+	alg         string
+	rotateEvery time.Duration
+	retention   time.Duration
+
+	mu         sync.RWMutex
+	current    *signingKey
+	keys       map[string]*signingKey
+	lastReload time.Time
+}
+
+// NewKeyManager loads the key set from the store, generating a key for alg
+// when none is active. Keys are rotated every rotateEvery; retired keys are
+// published for retention, which must exceed the lifetime of any token.
+func NewKeyManager(store *data.SigningKeyService, alg string, rotateEvery, retention time.Duration) (*KeyManager, error) {
+	if signingMethod(alg) == nil {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	m := &KeyManager{
+		store:       store,
+		alg:         alg,
+		rotateEvery: rotateEvery,
+		retention:   retention,
+		keys:        map[string]*signingKey{},
+	}
+	if err := m.Load(); err != nil {
+		return nil, err
+	}
+	if m.needsRotation() {
+		if err := m.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Load replaces the in-memory key set with the keys from the store
+func (m *KeyManager) Load() error {
+	stored, err := m.store.List()
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*signingKey, len(stored))
+	var current *signingKey
+	for _, sk := range stored {
+		k, err := decodeKey(sk)
+		if err != nil {
+			log.Printf("skipping signing key %s: %v", sk.ID, err)
+			continue
+		}
+		keys[k.kid] = k
+		// stored keys are sorted newest first
+		if current == nil && !k.retired && k.alg == m.alg {
+			current = k
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = keys
+	m.current = current
+	m.lastReload = time.Now()
+	return nil
+}
+
+// Rotate generates a new signing key and retires the current one. Replicas
+// may rotate at the same time: the new key only takes over if the current key
+// was still active, otherwise another instance rotated first and the new key
+// is retired again. Either way it is inserted before anything is retired, so
+// there is always an active key, and it stays published in case it was used.
+func (m *KeyManager) Rotate() error {
+	m.mu.RLock()
+	prev := m.current
+	m.mu.RUnlock()
+
+	k, sk, err := generateKey(m.alg)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Insert(sk); err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(m.retention)
+	var won bool
+	if prev != nil {
+		won, err = m.store.Retire(prev.kid, expiresAt)
+	} else {
+		// no key to compare against; of keys generated at once the newest wins
+		var newer bool
+		newer, err = m.store.HasNewerActive(k.kid, sk.CreatedAt)
+		won = !newer
+	}
+	if err != nil {
+		return err
+	}
+	if !won {
+		if _, err := m.store.Retire(k.kid, expiresAt); err != nil {
+			return err
+		}
+		log.Printf("signing key rotated by another instance, retired kid %s", k.kid)
+		return m.Load()
+	}
+	// keys of instances that lost the race, or left over from before
+	if err := m.store.RetireOlder(k.kid, sk.CreatedAt, expiresAt); err != nil {
+		return err
+	}
+	log.Printf("rotated signing key, new kid %s", k.kid)
+	return m.Load()
+}
+
+// Run reloads the key set periodically, picking up keys rotated by other
+// instances, and rotates the signing key when it is due. It blocks until ctx is done.
+func (m *KeyManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Load(); err != nil {
+				log.Printf("failed to reload signing keys: %v", err)
+				continue
+			}
+			if m.needsRotation() {
+				if err := m.Rotate(); err != nil {
+					log.Printf("failed to rotate signing key: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (m *KeyManager) needsRotation() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current == nil || time.Since(m.current.createdAt) >= m.rotateEvery
+}
+
+// Algorithm returns the algorithm new tokens are signed with
+func (m *KeyManager) Algorithm() string {
+	return m.alg
+}
+
+// Sign returns the claims signed with the current key, with its kid in the header
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	m.mu.RLock()
+	k := m.current
+	m.mu.RUnlock()
+	if k == nil {
+		return "", errors.New("no signing key available")
+	}
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.private)
+}
+
+// Keyfunc selects the verification key by the token's kid header
+func (m *KeyManager) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("missing kid header")
+	}
+	k := m.lookup(kid)
+	if k == nil {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if t.Method.Alg() != k.alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return k.public, nil
+}
+
+// Parse verifies tokenString and returns its claims
+func (m *KeyManager) Parse(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, m.Keyfunc, jwt.WithValidMethods([]string{RS256, ES256, EdDSA}))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// lookup returns the key for kid, reloading from the store (at most every
+// reloadInterval) when the key was created by another instance
+func (m *KeyManager) lookup(kid string) *signingKey {
+	m.mu.RLock()
+	k, ok := m.keys[kid]
+	stale := time.Since(m.lastReload) > reloadInterval
+	m.mu.RUnlock()
+	if ok || !stale {
+		return k
+	}
+	if err := m.Load(); err != nil {
+		log.Printf("failed to reload signing keys: %v", err)
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys[kid]
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	switch alg {
+	case RS256:
+		return jwt.SigningMethodRS256
+	case ES256:
+		return jwt.SigningMethodES256
+	case EdDSA:
+		return jwt.SigningMethodEdDSA
+	}
+	return nil
+}
+
+func generateKey(alg string) (*signingKey, models.SigningKey, error) {
+	var (
+		private crypto.Signer
+		err     error
+	)
+	switch alg {
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, models.SigningKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, models.SigningKey{}, err
+	}
+	kidBytes := make([]byte, 8)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return nil, models.SigningKey{}, err
+	}
+	sk := models.SigningKey{
+		ID:         hex.EncodeToString(kidBytes),
+		Algorithm:  alg,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		// as precise as it is stored, as keys are ordered by it
+		CreatedAt: time.Now().Truncate(time.Millisecond),
+	}
+	k, err := decodeKey(sk)
+	return k, sk, err
+}
+
+func decodeKey(sk models.SigningKey) (*signingKey, error) {
+	method := signingMethod(sk.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", sk.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(sk.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid private key pem")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+	return &signingKey{
+		kid:       sk.ID,
+		alg:       sk.Algorithm,
+		method:    method,
+		private:   parsed,
+		public:    signer.Public(),
+		createdAt: sk.CreatedAt,
+		retired:   sk.RetiredAt != nil,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package tokens_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"authgo/data"
+	"authgo/data/datatest"
+	"authgo/tokens"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestConcurrentRotationKeepsOneActiveKey(t *testing.T) {
+	store := data.NewSigningKeyService(datatest.Database(t).Collection("signing_keys"))
+	managers := make([]*tokens.KeyManager, 4)
+	for i := range managers {
+		m, err := tokens.NewKeyManager(store, tokens.ES256, time.Hour, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		managers[i] = m
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range managers {
+		wg.Add(1)
+		go func(m *tokens.KeyManager) {
+			defer wg.Done()
+			if err := m.Rotate(); err != nil {
+				t.Error(err)
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	keys, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := 0
+	for _, k := range keys {
+		if k.RetiredAt == nil {
+			active++
+		}
+	}
+	if active != 1 {
+		t.Fatalf("%d active keys after concurrent rotations, want 1", active)
+	}
+	// whichever key an instance signed with stays verifiable everywhere
+	for _, m := range managers {
+		signed, err := m.Sign(jwt.MapClaims{"sub": "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, other := range managers {
+			if _, err := other.Parse(signed); err != nil {
+				t.Errorf("token of one instance rejected by another: %v", err)
+			}
+		}
+	}
+}
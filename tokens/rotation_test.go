@@ -0,0 +1,120 @@
+package tokens
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newMemoryManager returns a KeyManager holding a single key in memory. It has
+// no store, so unknown kids must not trigger a reload.
+func newMemoryManager(t *testing.T, alg string) *KeyManager {
+	t.Helper()
+	m := &KeyManager{alg: alg, keys: map[string]*signingKey{}, lastReload: time.Now().Add(time.Hour)}
+	rotateInMemory(t, m)
+	return m
+}
+
+// rotateInMemory does to m what Rotate does to the stored key set
+func rotateInMemory(t *testing.T, m *KeyManager) *signingKey {
+	t.Helper()
+	k, _, err := generateKey(m.alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.current != nil {
+		m.current.retired = true
+	}
+	m.keys[k.kid] = k
+	m.current = k
+	return k
+}
+
+func sign(t *testing.T, m *KeyManager, sub string) string {
+	t.Helper()
+	signed, err := m.Sign(jwt.MapClaims{"sub": sub, "exp": time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestSignAndVerifyAcrossRotation(t *testing.T) {
+	for _, alg := range []string{RS256, ES256, EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			m := newMemoryManager(t, alg)
+			oldKid := m.current.kid
+			before := sign(t, m, "alice")
+			rotateInMemory(t, m)
+			after := sign(t, m, "bob")
+
+			for token, sub := range map[string]string{before: "alice", after: "bob"} {
+				claims, err := m.Parse(token)
+				if err != nil || claims["sub"] != sub {
+					t.Errorf("Parse = %v, %v, want the claims of %s", claims, err, sub)
+				}
+			}
+
+			// relying parties verify both tokens with the published keys
+			set := m.JWKS()
+			if len(set.Keys) != 2 {
+				t.Fatalf("JWKS has %d keys, want the current and the retired one", len(set.Keys))
+			}
+			for _, token := range []string{before, after} {
+				_, err := jwt.Parse(token, func(tok *jwt.Token) (interface{}, error) {
+					kid, _ := tok.Header["kid"].(string)
+					k, ok := set.Key(kid)
+					if !ok || k.Alg != tok.Method.Alg() {
+						t.Fatalf("kid %q not published for %s", kid, tok.Method.Alg())
+					}
+					return k.PublicKey()
+				})
+				if err != nil {
+					t.Errorf("token rejected with the published key: %v", err)
+				}
+			}
+
+			// once the retired key is no longer published its tokens fail
+			delete(m.keys, oldKid)
+			if _, err := m.Parse(before); err == nil {
+				t.Error("token of a dropped key accepted")
+			}
+			if _, err := m.Parse(after); err != nil {
+				t.Errorf("token of the current key rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseRejectsForeignSignatures(t *testing.T) {
+	m := newMemoryManager(t, ES256)
+	other := newMemoryManager(t, ES256)
+
+	// signed by another key under a kid this manager knows
+	forged := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "mallory"})
+	forged.Header["kid"] = m.current.kid
+	signed, err := forged.SignedString(other.current.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Parse(signed); err == nil {
+		t.Error("token signed by a foreign key accepted")
+	}
+
+	// right key, but the kid belongs to a key of another algorithm
+	mixed := newMemoryManager(t, EdDSA)
+	m.keys[mixed.current.kid] = mixed.current
+	swapped := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "mallory"})
+	swapped.Header["kid"] = mixed.current.kid
+	if signed, err = swapped.SignedString(m.current.private); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Parse(signed); err == nil {
+		t.Error("token accepted under the kid of a key of another algorithm")
+	}
+
+	if _, err := m.Parse(sign(t, other, "mallory")); err == nil {
+		t.Error("token with an unknown kid accepted")
+	}
+}
@@ -0,0 +1,79 @@
+package totp_test
+
+import (
+	"testing"
+	"time"
+
+	"authgo/totp"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 appendix B, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// the RFC lists 8 digit codes; 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := totp.Code(rfcSecret, totp.Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := totp.Step(now)
+	codeAt := func(step int64) string {
+		code, err := totp.Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		skew     int
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", codeAt(step), 0, step, true},
+		{"previous step within skew", codeAt(step - 1), 1, step - 1, true},
+		{"next step within skew", codeAt(step + 1), 1, step + 1, true},
+		{"previous step without skew", codeAt(step - 1), 0, 0, false},
+		{"two steps back", codeAt(step - 2), 1, 0, false},
+		{"spaces are ignored", codeAt(step)[:3] + " " + codeAt(step)[3:], 0, step, true},
+		{"too short", codeAt(step)[:5], 1, 0, false},
+		{"wrong code", "000000", 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := totp.Validate(rfcSecret, tt.code, now, tt.skew)
+			if ok != tt.wantOK || got != tt.wantStep {
+				t.Errorf("Validate(%q) = %d, %v, want %d, %v", tt.code, got, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsLowercaseSecret(t *testing.T) {
+	now := time.Unix(59, 0)
+	if _, ok := totp.Validate(" gezdgnbvgy3tqojqgezdgnbvgy3tqojq ", "287082", now, 0); !ok {
+		t.Error("lowercase secret with surrounding spaces rejected")
+	}
+}